@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// Limits for anchor values coming from WordPress
+const (
+	MinAnchorAltitude = -500.0  // meters, Dead Sea shore is about -430
+	MaxAnchorAltitude = 9000.0  // meters
+	MaxAnchorScale    = 1000.0  // times the model's authored size
+	MaxAnchorOffset   = 1000.0  // meters along any ENU axis
+	MaxAnchorDistance = 50000.0 // get_anchor refuses devices farther than this
+)
+
+// East/north/up offset in meters from the building's lat/lon/altitude
+type ENU struct {
+	East  float64 `json:"east"`
+	North float64 `json:"north"`
+	Up    float64 `json:"up"`
+}
+
+// Where and how to place a building's 3D content in AR
+type Anchor struct {
+	// Meters above the WGS84 ellipsoid; nil means "at the device's altitude"
+	Altitude *float64 `json:"altitude,omitempty"`
+	// Degrees clockwise from true north the model's forward axis faces, 0..360
+	Heading float64 `json:"heading"`
+	Scale   float64 `json:"scale"`
+	Offset  ENU     `json:"offset"`
+}
+
+func (a *Anchor) Validate() error {
+	if a.Altitude != nil && (math.IsNaN(*a.Altitude) || *a.Altitude < MinAnchorAltitude || *a.Altitude > MaxAnchorAltitude) {
+		return fmt.Errorf("altitude %v out of range", *a.Altitude)
+	}
+	if math.IsNaN(a.Heading) || a.Heading < 0 || a.Heading >= 360 {
+		return fmt.Errorf("heading %v must be in [0, 360)", a.Heading)
+	}
+	if math.IsNaN(a.Scale) || a.Scale <= 0 || a.Scale > MaxAnchorScale {
+		return fmt.Errorf("scale %v must be in (0, %v]", a.Scale, MaxAnchorScale)
+	}
+	for _, v := range []float64{a.Offset.East, a.Offset.North, a.Offset.Up} {
+		if math.IsNaN(v) || math.Abs(v) > MaxAnchorOffset {
+			return fmt.Errorf("offset %v out of range", a.Offset)
+		}
+	}
+	return nil
+}
+
+// Parse the ACF "anchor" group: {altitude, heading, scale, offset_east,
+// offset_north, offset_up}, values as numbers or numeric strings. An empty
+// group means no anchor. Headings are wrapped into [0, 360), scale defaults to 1.
+func parseAnchorField(v interface{}) (*Anchor, error) {
+	var fields map[string]interface{}
+	switch g := v.(type) {
+	case nil, bool:
+		return nil, nil
+	case map[string]interface{}:
+		fields = g
+	case json.RawMessage:
+		if len(g) == 0 || string(g) == "null" || string(g) == "false" {
+			return nil, nil
+		}
+		if err := json.Unmarshal(g, &fields); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported anchor type %T", v)
+	}
+
+	values := make(map[string]float64)
+	for _, key := range []string{"altitude", "heading", "scale", "offset_east", "offset_north", "offset_up"} {
+		raw, ok := fields[key]
+		if !ok || raw == false {
+			continue
+		}
+		n, err := parseCoordinate(raw)
+		if errors.Is(err, errMissingCoordinate) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		values[key] = n
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	a := &Anchor{
+		Heading: math.Mod(math.Mod(values["heading"], 360)+360, 360),
+		Scale:   1,
+		Offset:  ENU{East: values["offset_east"], North: values["offset_north"], Up: values["offset_up"]},
+	}
+	if alt, ok := values["altitude"]; ok {
+		a.Altitude = &alt
+	}
+	if scale, ok := values["scale"]; ok {
+		a.Scale = scale
+	}
+	return a, a.Validate()
+}
+
+// Anchor of a building, or the default (at lat/lon, facing north, scale 1)
+func (b Building) anchorOrDefault() Anchor {
+	if b.Anchor != nil {
+		return *b.Anchor
+	}
+	return Anchor{Scale: 1}
+}
+
+type AnchorRequest struct {
+	BuildingID int      `json:"building_id"`
+	Lat        *float64 `json:"lat"`
+	Lon        *float64 `json:"lon"`
+	Altitude   *float64 `json:"altitude,omitempty"` // device, meters above the ellipsoid
+	Heading    *float64 `json:"heading,omitempty"`  // device compass, degrees from true north
+}
+
+// Content pose in the device's local frame
+type AnchorPose struct {
+	BuildingID int     `json:"building_id"`
+	Position   ENU     `json:"position"` // meters from the device
+	Distance   float64 `json:"distance"` // meters, straight line
+	Bearing    float64 `json:"bearing"`  // degrees from true north, device to content
+	Heading    float64 `json:"heading"`  // content forward axis, degrees from true north
+	// Content heading relative to where the device faces, when the device sent its heading
+	RelativeHeading *float64 `json:"relative_heading,omitempty"`
+	Scale           float64  `json:"scale"`
+	Lat             float64  `json:"lat"` // where the content sits
+	Lon             float64  `json:"lon"`
+	Altitude        float64  `json:"altitude"`
+}
+
+// Work out where a building's content is relative to a device
+func anchorPose(b Building, lat, lon, alt float64, deviceHeading *float64) AnchorPose {
+	a := b.anchorOrDefault()
+	baseAlt := alt
+	if a.Altitude != nil {
+		baseAlt = *a.Altitude
+	}
+
+	cLat, cLon, cAlt := enuToGeodetic(a.Offset.East, a.Offset.North, a.Offset.Up, b.Lat, b.Lon, baseAlt)
+	east, north, up := geodeticToENU(cLat, cLon, cAlt, lat, lon, alt)
+
+	pose := AnchorPose{
+		BuildingID: b.ID,
+		Position:   ENU{East: east, North: north, Up: up},
+		Distance:   math.Sqrt(east*east + north*north + up*up),
+		Bearing:    math.Mod(toDegrees(math.Atan2(east, north))+360, 360),
+		Heading:    a.Heading,
+		Scale:      a.Scale,
+		Lat:        cLat,
+		Lon:        cLon,
+		Altitude:   cAlt,
+	}
+	if deviceHeading != nil {
+		rel := math.Mod(a.Heading-*deviceHeading+540, 360) - 180
+		pose.RelativeHeading = &rel
+	}
+	return pose
+}
+
+// RPC returning where a building's AR content sits relative to the caller.
+// Payload: {"building_id", "lat", "lon", "altitude"?, "heading"?}.
+func rpcGetAnchor(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var req AnchorRequest
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		return "", runtime.NewError("invalid payload", codeInvalidArgument)
+	}
+	if req.BuildingID <= 0 {
+		return "", runtime.NewError("building_id is required", codeInvalidArgument)
+	}
+	if req.Lat == nil || req.Lon == nil || *req.Lat < -90 || *req.Lat > 90 || *req.Lon < -180 || *req.Lon > 180 {
+		return "", runtime.NewError("lat and lon must be valid coordinates", codeInvalidArgument)
+	}
+	alt := 0.0
+	if req.Altitude != nil {
+		if *req.Altitude < MinAnchorAltitude || *req.Altitude > MaxAnchorAltitude {
+			return "", runtime.NewError("altitude out of range", codeInvalidArgument)
+		}
+		alt = *req.Altitude
+	}
+	if req.Heading != nil && (*req.Heading < 0 || *req.Heading >= 360) {
+		return "", runtime.NewError("heading must be in [0, 360)", codeInvalidArgument)
+	}
+
+	b, ok := buildingIndex.Get(req.BuildingID)
+	if !ok {
+		return "", runtime.NewError("building not found", codeNotFound)
+	}
+	if haversineMeters(*req.Lat, *req.Lon, b.Lat, b.Lon) > MaxAnchorDistance {
+		return "", runtime.NewError("device is too far from the building", codeFailedPrecondition)
+	}
+
+	data, err := json.Marshal(anchorPose(b, *req.Lat, *req.Lon, alt, req.Heading))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
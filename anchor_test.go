@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestParseAnchorField(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      interface{}
+		want    *Anchor
+		wantErr bool
+	}{
+		{"nil", nil, nil, false},
+		{"false", false, nil, false},
+		{"empty group", map[string]interface{}{"heading": "", "scale": false}, nil, false},
+		{"heading only", map[string]interface{}{"heading": 90.0}, &Anchor{Heading: 90, Scale: 1}, false},
+		{"negative heading wraps", map[string]interface{}{"heading": -90.0}, &Anchor{Heading: 270, Scale: 1}, false},
+		{"full turn wraps", map[string]interface{}{"heading": 360.0}, &Anchor{Heading: 0, Scale: 1}, false},
+		{"several turns wrap", map[string]interface{}{"heading": "-810"}, &Anchor{Heading: 270, Scale: 1}, false},
+		{"string values", json.RawMessage(`{"heading":"45","scale":"2.5","offset_east":"1","offset_north":-2,"offset_up":"0.5"}`),
+			&Anchor{Heading: 45, Scale: 2.5, Offset: ENU{East: 1, North: -2, Up: 0.5}}, false},
+		{"zero scale", map[string]interface{}{"scale": 0.0}, nil, true},
+		{"huge offset", map[string]interface{}{"offset_up": MaxAnchorOffset + 1}, nil, true},
+		{"altitude too low", map[string]interface{}{"altitude": MinAnchorAltitude - 1}, nil, true},
+		{"not a number", map[string]interface{}{"heading": "north"}, nil, true},
+		{"unsupported type", "heading", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseAnchorField(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if (got == nil) != (tt.want == nil) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+			continue
+		}
+		if got != nil && (got.Heading != tt.want.Heading || got.Scale != tt.want.Scale || got.Offset != tt.want.Offset || got.Altitude != nil) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, *got, *tt.want)
+		}
+	}
+
+	got, err := parseAnchorField(map[string]interface{}{"altitude": "12.5"})
+	if err != nil || got == nil || got.Altitude == nil || *got.Altitude != 12.5 {
+		t.Errorf("altitude: got %+v, %v", got, err)
+	}
+}
+
+func TestAnchorPose(t *testing.T) {
+	const lat, lon = 45.0, 7.0
+	float := func(v float64) *float64 { return &v }
+	building := func(a *Anchor) Building {
+		return Building{ID: 1, Lat: lat, Lon: lon, Anchor: a}
+	}
+	// Device 100 m south of the building, on the same ellipsoid height
+	southLat, _, _ := enuToGeodetic(0, -100, 0, lat, lon, 0)
+
+	tests := []struct {
+		name          string
+		b             Building
+		devLat        float64
+		devLon        float64
+		devHeading    *float64
+		wantBearing   float64
+		wantDistance  float64
+		wantUp        float64
+		wantRelative  *float64
+		wantHeading   float64
+		bearingSlack  float64
+		distanceSlack float64
+	}{
+		{"default anchor at the device", building(nil), lat, lon, nil, 0, 0, 0, nil, 0, 360, 1e-6},
+		{"content due north", building(nil), southLat, lon, nil, 0, 100, 0, nil, 0, 1e-6, 0.01},
+		{"offset north-east of the building", building(&Anchor{Scale: 1, Offset: ENU{East: 100, North: 100}}), southLat, lon, nil, toDegrees(math.Atan2(100, 200)), math.Hypot(100, 200), 0, nil, 0, 0.01, 0.5},
+		{"relative heading ahead", building(&Anchor{Heading: 90, Scale: 1}), southLat, lon, float(80), 0, 100, 0, float(10), 90, 1e-6, 0.01},
+		{"relative heading wraps past north", building(&Anchor{Heading: 10, Scale: 1}), southLat, lon, float(350), 0, 100, 0, float(20), 10, 1e-6, 0.01},
+		{"relative heading wraps negative", building(&Anchor{Heading: 350, Scale: 1}), southLat, lon, float(10), 0, 100, 0, float(-20), 350, 1e-6, 0.01},
+		{"opposite heading", building(&Anchor{Heading: 0, Scale: 1}), southLat, lon, float(180), 0, 100, 0, float(-180), 0, 1e-6, 0.01},
+		{"fixed altitude above the device", building(&Anchor{Altitude: float(30), Scale: 1}), lat, lon, nil, 0, 30, 30, nil, 0, 360, 1e-6},
+	}
+	for _, tt := range tests {
+		pose := anchorPose(tt.b, tt.devLat, tt.devLon, 0, tt.devHeading)
+		if math.Abs(pose.Distance-tt.wantDistance) > tt.distanceSlack {
+			t.Errorf("%s: distance = %v, want %v", tt.name, pose.Distance, tt.wantDistance)
+		}
+		if d := math.Abs(math.Mod(pose.Bearing-tt.wantBearing+540, 360) - 180); d > tt.bearingSlack {
+			t.Errorf("%s: bearing = %v, want %v", tt.name, pose.Bearing, tt.wantBearing)
+		}
+		if pose.Bearing < 0 || pose.Bearing >= 360 {
+			t.Errorf("%s: bearing %v out of [0, 360)", tt.name, pose.Bearing)
+		}
+		if math.Abs(pose.Position.Up-tt.wantUp) > 0.01 {
+			t.Errorf("%s: up = %v, want %v", tt.name, pose.Position.Up, tt.wantUp)
+		}
+		if pose.Heading != tt.wantHeading {
+			t.Errorf("%s: heading = %v, want %v", tt.name, pose.Heading, tt.wantHeading)
+		}
+		switch {
+		case (pose.RelativeHeading == nil) != (tt.wantRelative == nil):
+			t.Errorf("%s: relative heading = %v, want %v", tt.name, pose.RelativeHeading, tt.wantRelative)
+		case pose.RelativeHeading != nil && math.Abs(*pose.RelativeHeading-*tt.wantRelative) > 1e-9:
+			t.Errorf("%s: relative heading = %v, want %v", tt.name, *pose.RelativeHeading, *tt.wantRelative)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	EnvDev        = "dev"
+	EnvStaging    = "staging"
+	EnvProduction = "production"
+)
+
+// Rewrites URLs starting with From so they start with To instead
+type AssetRewriteRule struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Parse "from=>to,from=>to" rule lists from the runtime env
+func parseAssetRewrites(raw string) ([]AssetRewriteRule, error) {
+	var rules []AssetRewriteRule
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(part, "=>")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid asset rewrite %q, expected from=>to", part)
+		}
+		rules = append(rules, AssetRewriteRule{From: from, To: to})
+	}
+	return rules, nil
+}
+
+// Hosts that only resolve inside the docker network or on the editor's machine
+func isInternalAssetHost(u *url.URL, c Config) bool {
+	if wp, err := url.Parse(c.WPBaseURL); err == nil && strings.EqualFold(wp.Host, u.Host) {
+		return true
+	}
+	switch strings.ToLower(u.Hostname()) {
+	case "wordpress", "localhost", "127.0.0.1":
+		return true
+	}
+	return false
+}
+
+// Turn a stored media/asset URL into one browsers running the WebAR client can load.
+// Explicit rules win; otherwise internal hosts are swapped for PublicAssetBaseURL.
+// The result must be absolute, and HTTPS in production.
+func rewriteAssetURL(raw string, c Config) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", nil
+	}
+
+	rewritten := raw
+	matched := false
+	for _, rule := range c.AssetRewrites {
+		if len(raw) >= len(rule.From) && strings.EqualFold(raw[:len(rule.From)], rule.From) {
+			rewritten = rule.To + raw[len(rule.From):]
+			matched = true
+			break
+		}
+	}
+
+	u, err := url.Parse(rewritten)
+	if err != nil {
+		return "", fmt.Errorf("invalid asset URL %q: %w", raw, err)
+	}
+	if !matched && c.PublicAssetBaseURL != "" {
+		base, _ := url.Parse(c.PublicAssetBaseURL)
+		if !u.IsAbs() {
+			u = base.ResolveReference(u)
+		} else if isInternalAssetHost(u, c) {
+			u.Scheme, u.Host = base.Scheme, base.Host
+			u.Path = strings.TrimRight(base.Path, "/") + u.Path
+		}
+	}
+
+	if !u.IsAbs() || u.Host == "" {
+		return "", fmt.Errorf("asset URL %q is not absolute", raw)
+	}
+	if c.Environment == EnvProduction && u.Scheme != "https" {
+		return "", fmt.Errorf("asset URL %q must be https in production", u.String())
+	}
+	return u.String(), nil
+}
+
+// Rewrite every asset URL on a building in place
+func (b *Building) rewriteAssets(c Config) error {
+	var err error
+	if b.Image, err = rewriteAssetURL(b.Image, c); err != nil {
+		return fmt.Errorf("building %d: image: %w", b.ID, err)
+	}
+	if b.Model, err = rewriteAssetURL(b.Model, c); err != nil {
+		return fmt.Errorf("building %d: model: %w", b.ID, err)
+	}
+	return nil
+}
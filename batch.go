@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// One player's position as relayed on a cell or group stream
+type PositionUpdate struct {
+	UserID string      `json:"user_id"`
+	Data   interface{} `json:"data"`
+	Group  interface{} `json:"group"`
+	Cell   string      `json:"cell,omitempty"`
+}
+
+// Stream message carrying every position that changed on a stream during one tick
+type PositionBatch struct {
+	Type    string           `json:"type"` // "positions"
+	Stream  string           `json:"stream"`
+	Updates []PositionUpdate `json:"updates"`
+}
+
+// Position updates waiting for the next tick, per stream label. A newer
+// update from the same user replaces the pending one, so each stream gets
+// at most one message per tick however often players report.
+type LocationBatcher struct {
+	mu      sync.Mutex
+	pending map[string]map[string]PositionUpdate
+}
+
+var locationBatches = &LocationBatcher{pending: make(map[string]map[string]PositionUpdate)}
+
+func (b *LocationBatcher) Queue(stream string, update PositionUpdate) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	updates := b.pending[stream]
+	if updates == nil {
+		updates = make(map[string]PositionUpdate)
+		b.pending[stream] = updates
+	}
+	updates[update.UserID] = update
+}
+
+// Forget a user's pending updates, so nothing follows their player_left
+func (b *LocationBatcher) Drop(userID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for stream, updates := range b.pending {
+		delete(updates, userID)
+		if len(updates) == 0 {
+			delete(b.pending, stream)
+		}
+	}
+}
+
+// Take everything queued since the last tick
+func (b *LocationBatcher) drain() []PositionBatch {
+	b.mu.Lock()
+	pending := b.pending
+	b.pending = make(map[string]map[string]PositionUpdate)
+	b.mu.Unlock()
+
+	batches := make([]PositionBatch, 0, len(pending))
+	for stream, updates := range pending {
+		batch := PositionBatch{Type: "positions", Stream: stream, Updates: make([]PositionUpdate, 0, len(updates))}
+		for _, u := range updates {
+			batch.Updates = append(batch.Updates, u)
+		}
+		sort.Slice(batch.Updates, func(i, j int) bool { return batch.Updates[i].UserID < batch.Updates[j].UserID })
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// Send the queued positions every location_tick
+func startLocationBatcher(logger runtime.Logger, nk runtime.NakamaModule) {
+	go func() {
+		ticker := time.NewTicker(cfg().LocationTick)
+		defer ticker.Stop()
+		for range ticker.C {
+			for _, batch := range locationBatches.drain() {
+				msg, _ := json.Marshal(batch)
+				if err := nk.StreamSend(cfg().StreamMode, "", "", batch.Stream, string(msg), nil, true); err != nil {
+					logger.WithField("stream", batch.Stream).WithField("err", err).Warn("Failed to send position batch")
+				}
+			}
+		}
+	}()
+}
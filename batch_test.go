@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestLocationBatcher(t *testing.T) {
+	update := func(userID, stream string, lat float64) PositionUpdate {
+		return PositionUpdate{UserID: userID, Data: lat, Cell: stream}
+	}
+	tests := []struct {
+		name  string
+		queue []PositionUpdate
+		drop  []string
+		want  []PositionBatch
+	}{
+		{"nothing queued", nil, nil, []PositionBatch{}},
+		{"one update", []PositionUpdate{update("alice", "c1", 1)}, nil, []PositionBatch{
+			{Type: "positions", Stream: "c1", Updates: []PositionUpdate{update("alice", "c1", 1)}},
+		}},
+		{"newer update replaces pending", []PositionUpdate{update("alice", "c1", 1), update("alice", "c1", 2)}, nil, []PositionBatch{
+			{Type: "positions", Stream: "c1", Updates: []PositionUpdate{update("alice", "c1", 2)}},
+		}},
+		{"one batch per stream, sorted by user", []PositionUpdate{update("bob", "c1", 1), update("alice", "c1", 2), update("alice", "c2", 3)}, nil, []PositionBatch{
+			{Type: "positions", Stream: "c1", Updates: []PositionUpdate{update("alice", "c1", 2), update("bob", "c1", 1)}},
+			{Type: "positions", Stream: "c2", Updates: []PositionUpdate{update("alice", "c2", 3)}},
+		}},
+		{"dropped user sends nothing", []PositionUpdate{update("alice", "c1", 1), update("bob", "c1", 2), update("alice", "c2", 3)}, []string{"alice"}, []PositionBatch{
+			{Type: "positions", Stream: "c1", Updates: []PositionUpdate{update("bob", "c1", 2)}},
+		}},
+	}
+	for _, tt := range tests {
+		b := &LocationBatcher{pending: make(map[string]map[string]PositionUpdate)}
+		for _, u := range tt.queue {
+			b.Queue(u.Cell, u)
+		}
+		for _, userID := range tt.drop {
+			b.Drop(userID)
+		}
+		got := b.drain()
+		sort.Slice(got, func(i, j int) bool { return got[i].Stream < got[j].Stream })
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: batches = %+v, want %+v", tt.name, got, tt.want)
+		}
+		if again := b.drain(); len(again) != 0 {
+			t.Errorf("%s: second drain = %+v, want nothing", tt.name, again)
+		}
+	}
+}
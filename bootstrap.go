@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// Backoff bounds for retrying the initial building sync
+const (
+	BootstrapMinBackoff = 2 * time.Second
+	BootstrapMaxBackoff = 5 * time.Minute
+)
+
+type SyncState string
+
+const (
+	SyncStarting SyncState = "starting" // no sync attempted yet
+	SyncPending  SyncState = "pending"  // initial sync failing, serving whatever is in storage
+	SyncReady    SyncState = "ready"    // initial sync done
+	SyncDegraded SyncState = "degraded" // was ready, but the latest sync/reconcile failed
+)
+
+// Health of the building pipeline, see rpcGetBuildingsStatus
+type SyncStatus struct {
+	State       SyncState    `json:"state"`
+	Source      string       `json:"source"`
+	Breaker     BreakerState `json:"breaker"`
+	LastSuccess int64        `json:"last_success,omitempty"`
+	LastAttempt int64        `json:"last_attempt,omitempty"`
+	Attempts    int          `json:"attempts"`
+	LastError   string       `json:"last_error,omitempty"`
+	Failed      int          `json:"failed"` // buildings the last pass couldn't load, the cursor waits for them
+}
+
+var (
+	syncStatusMu sync.RWMutex
+	syncStatus   = SyncStatus{State: SyncStarting}
+)
+
+func currentSyncStatus() SyncStatus {
+	syncStatusMu.RLock()
+	s := syncStatus
+	syncStatusMu.RUnlock()
+	s.Breaker = sourceBreaker.State()
+	return s
+}
+
+// Record the outcome of a sync or reconcile pass
+func recordSyncResult(source string, err error) {
+	syncStatusMu.Lock()
+	defer syncStatusMu.Unlock()
+
+	now := time.Now().Unix()
+	syncStatus.Source = source
+	syncStatus.LastAttempt = now
+	syncStatus.Attempts++
+	if err == nil {
+		syncStatus.State = SyncReady
+		syncStatus.LastSuccess = now
+		syncStatus.LastError = ""
+		return
+	}
+	syncStatus.LastError = err.Error()
+	if syncStatus.State == SyncReady || syncStatus.State == SyncDegraded {
+		syncStatus.State = SyncDegraded
+	} else {
+		syncStatus.State = SyncPending
+	}
+}
+
+// Record how many buildings the latest pass left behind on transient errors
+func recordSyncFailures(n int) {
+	syncStatusMu.Lock()
+	syncStatus.Failed = n
+	syncStatusMu.Unlock()
+}
+
+// Exponential backoff with +-20% jitter
+func bootstrapBackoff(attempt int) time.Duration {
+	d := BootstrapMinBackoff
+	for i := 1; i < attempt && d < BootstrapMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > BootstrapMaxBackoff {
+		d = BootstrapMaxBackoff
+	}
+	jitter := time.Duration(rand.Int63n(int64(d)/5*2+1)) - d/5
+	return d + jitter
+}
+
+// Run the initial sync in the background, retrying with backoff until it succeeds.
+// The rest of the module serves from storage in the meantime.
+func startBuildingBootstrap(logger runtime.Logger, nk runtime.NakamaModule) {
+	go func() {
+		ctx := context.Background()
+		for attempt := 1; ; attempt++ {
+			err := bootstrapBuildings(ctx, logger, nk)
+			if err == nil {
+				return
+			}
+
+			wait := bootstrapBackoff(attempt)
+			logger.Warn("Building bootstrap attempt %d failed: %v (retrying in %v)", attempt, err, wait.Round(time.Second))
+			time.Sleep(wait)
+		}
+	}()
+}
+
+// One bootstrap attempt: full sync if storage is empty, otherwise incremental
+func bootstrapBuildings(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule) error {
+	source, err := newBuildingSource(cfg(), nk)
+	if err != nil {
+		recordSyncResult("", err)
+		return err
+	}
+	guarded := guardedSource(source, sourceBreaker)
+
+	if err := guarded.Ready(ctx); err != nil {
+		recordSyncResult(source.Name(), err)
+		return err
+	}
+
+	objects, _, err := nk.StorageList(ctx, "", "", "buildings", 1, "")
+	if err != nil {
+		recordSyncResult(source.Name(), err)
+		return err
+	}
+	if len(objects) == 0 {
+		logger.Info("No buildings in storage, fetching initial data from %s...", source.Name())
+	}
+
+	count, err := syncBuildings(ctx, logger, nk, guarded, len(objects) > 0)
+	recordSyncResult(source.Name(), err)
+	if err != nil {
+		return err
+	}
+	logger.Info("Synced %d buildings from %s to storage", count, source.Name())
+
+	// Clients that loaded while we were pending should refetch
+	if count > 0 {
+		buildingsHint.schedule(logger, nk)
+	}
+	return nil
+}
+
+// RPC reporting whether buildings are synced. Everyone gets the state; the
+// admin also gets the last error.
+func rpcGetBuildingsStatus(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	status := currentSyncStatus()
+	if requireAdmin(ctx) != nil {
+		status.LastError = ""
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
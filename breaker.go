@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// Returned instead of calling the source while the breaker is open
+var errCircuitOpen = errors.New("circuit breaker open")
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// Minimal circuit breaker: after Threshold consecutive failures calls are
+// refused for Cooldown, then a single trial call decides whether to close again.
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu        sync.Mutex
+	state     BreakerState
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{Threshold: threshold, Cooldown: cooldown, state: BreakerClosed}
+}
+
+// Returns errCircuitOpen if the call should not be attempted
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Now().Before(b.openUntil) {
+			return errCircuitOpen
+		}
+		b.state = BreakerHalfOpen
+		b.trial = true
+		return nil
+	case BreakerHalfOpen:
+		// Only one trial call at a time
+		if b.trial {
+			return errCircuitOpen
+		}
+		b.trial = true
+		return nil
+	}
+	return nil
+}
+
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	b.state = BreakerClosed
+	b.failures = 0
+	b.trial = false
+	b.mu.Unlock()
+}
+
+func (b *CircuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.trial = false
+	if b.state == BreakerHalfOpen || b.failures >= b.Threshold {
+		b.state = BreakerOpen
+		b.openUntil = time.Now().Add(b.Cooldown)
+	}
+}
+
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && !time.Now().Before(b.openUntil) {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// Shared by the bootstrap and the reconciler so both back off from a dead source
+var sourceBreaker = NewCircuitBreaker(5, 2*time.Minute)
+
+// BuildingSource wrapper that routes every call through a circuit breaker
+type breakerSource struct {
+	BuildingSource
+	breaker *CircuitBreaker
+}
+
+func guardedSource(source BuildingSource, breaker *CircuitBreaker) BuildingSource {
+	return &breakerSource{BuildingSource: source, breaker: breaker}
+}
+
+func (s *breakerSource) call(fn func() error) error {
+	if err := s.breaker.Allow(); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		s.breaker.Failure()
+		return err
+	}
+	s.breaker.Success()
+	return nil
+}
+
+func (s *breakerSource) Ready(ctx context.Context) error {
+	return s.call(func() error { return s.BuildingSource.Ready(ctx) })
+}
+
+func (s *breakerSource) FetchBuildings(ctx context.Context, logger runtime.Logger, cursor string) (FetchResult, error) {
+	var result FetchResult
+	err := s.call(func() error {
+		var err error
+		result, err = s.BuildingSource.FetchBuildings(ctx, logger, cursor)
+		return err
+	})
+	return result, err
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bump when the stored Building layout changes; decodeBuilding migrates older records.
+//
+//	1: canonical record with status and modified_gmt
+//	2: categories, model, radius, geometry and anchor
+const BuildingSchemaVersion = 2
+
+// Canonical building record. Everything that reads or writes the "buildings"
+// collection (initial fetch, push, reconcile, get) goes through this type.
+type Building struct {
+	SchemaVersion int       `json:"schema_version"`
+	ID            int       `json:"id"`
+	Title         string    `json:"title"`
+	Slug          string    `json:"slug,omitempty"`
+	Link          string    `json:"link,omitempty"`
+	Image         string    `json:"image"`
+	Model         string    `json:"model,omitempty"`
+	Status        string    `json:"status"`
+	Categories    []int     `json:"categories,omitempty"`
+	Lat           float64   `json:"lat"`
+	Lon           float64   `json:"lon"`
+	Radius        float64   `json:"radius,omitempty"`   // geofence radius in meters, 0 uses the configured default
+	Geometry      *Geometry `json:"geometry,omitempty"` // GeoJSON footprint; lat/lon is then its centroid unless set explicitly
+	Anchor        *Anchor   `json:"anchor,omitempty"`   // AR placement of the model
+	ModifiedGMT   string    `json:"modified_gmt,omitempty"`
+	UpdatedAt     int64     `json:"updated_at,omitempty"`
+}
+
+var (
+	errMissingCoordinate = errors.New("missing coordinate")
+	errNullIsland        = errors.New("coordinates are 0,0")
+)
+
+// Parse a lat/lon value as WP hands it to us: ACF gives numbers or numeric
+// strings depending on field config, the notifier plugin always sends strings.
+func parseCoordinate(v interface{}) (float64, error) {
+	switch c := v.(type) {
+	case float64:
+		return c, nil
+	case json.Number:
+		return c.Float64()
+	case string:
+		s := strings.TrimSpace(c)
+		if s == "" {
+			return 0, errMissingCoordinate
+		}
+		return strconv.ParseFloat(s, 64)
+	case nil:
+		return 0, errMissingCoordinate
+	default:
+		return 0, fmt.Errorf("unsupported coordinate type %T", v)
+	}
+}
+
+// Set lat/lon from the raw values, or from the geometry's centroid when the
+// post only has a footprint
+func (b *Building) locate(lat, lon interface{}) error {
+	var errLat, errLon error
+	b.Lat, errLat = parseCoordinate(lat)
+	b.Lon, errLon = parseCoordinate(lon)
+	if b.Geometry != nil && errors.Is(errLat, errMissingCoordinate) && errors.Is(errLon, errMissingCoordinate) {
+		b.Lat, b.Lon = b.Geometry.Centroid()
+		return nil
+	}
+	if errLat != nil {
+		return fmt.Errorf("lat %v: %w", lat, errLat)
+	}
+	if errLon != nil {
+		return fmt.Errorf("lon %v: %w", lon, errLon)
+	}
+	return nil
+}
+
+// Like parseCoordinate, but a missing value is just zero
+func parseOptionalNumber(v interface{}) (float64, error) {
+	if v == false {
+		// ACF sends false for empty fields
+		return 0, nil
+	}
+	n, err := parseCoordinate(v)
+	if errors.Is(err, errMissingCoordinate) {
+		return 0, nil
+	}
+	return n, err
+}
+
+// Check a building is safe to store and hand to clients
+func (b *Building) Validate() error {
+	if b.ID <= 0 {
+		return fmt.Errorf("invalid building id %d", b.ID)
+	}
+	if math.IsNaN(b.Lat) || b.Lat < -90 || b.Lat > 90 {
+		return fmt.Errorf("building %d: latitude %v out of range", b.ID, b.Lat)
+	}
+	if math.IsNaN(b.Lon) || b.Lon < -180 || b.Lon > 180 {
+		return fmt.Errorf("building %d: longitude %v out of range", b.ID, b.Lon)
+	}
+	if b.Lat == 0 && b.Lon == 0 {
+		return fmt.Errorf("building %d: %w", b.ID, errNullIsland)
+	}
+	if math.IsNaN(b.Radius) || b.Radius < 0 || b.Radius > MaxGeofenceRadius {
+		return fmt.Errorf("building %d: radius %v out of range", b.ID, b.Radius)
+	}
+	if b.Geometry != nil {
+		if err := b.Geometry.Validate(); err != nil {
+			return fmt.Errorf("building %d: geometry: %w", b.ID, err)
+		}
+	}
+	if b.Anchor != nil {
+		if err := b.Anchor.Validate(); err != nil {
+			return fmt.Errorf("building %d: anchor: %w", b.ID, err)
+		}
+	}
+	if b.ModifiedGMT != "" && parseModifiedGMT(b.ModifiedGMT).IsZero() {
+		return fmt.Errorf("building %d: invalid modified_gmt %q", b.ID, b.ModifiedGMT)
+	}
+	return nil
+}
+
+// Same content, ignoring bookkeeping that changes on every write
+func (b Building) SameContent(other Building) bool {
+	b.UpdatedAt, other.UpdatedAt = 0, 0
+	b.SchemaVersion, other.SchemaVersion = 0, 0
+	return reflect.DeepEqual(b, other)
+}
+
+func (b Building) Key() string {
+	return strconv.Itoa(b.ID)
+}
+
+// Prepare a building for storage: stamp schema/version info, make asset URLs public and validate
+func (b *Building) normalize() error {
+	b.SchemaVersion = BuildingSchemaVersion
+	// WP hands out titles entity-encoded (REST title.rendered and get_the_title
+	// in the push alike); store them decoded so both paths agree
+	b.Title = strings.TrimSpace(html.UnescapeString(b.Title))
+	if b.Status == "" {
+		b.Status = "publish"
+	}
+	b.UpdatedAt = time.Now().Unix()
+	if err := b.rewriteAssets(cfg()); err != nil {
+		return err
+	}
+	return b.Validate()
+}
+
+// Build a Building from a WP REST post and its resolved image URL
+func buildingFromWPPost(post WPPost, imageURL string) (Building, error) {
+	b := Building{
+		ID:          post.ID,
+		Title:       post.Title.Rendered,
+		Slug:        post.Slug,
+		Link:        post.Link,
+		Image:       imageURL,
+		Status:      post.Status,
+		Categories:  post.Categories,
+		ModifiedGMT: post.ModifiedGMT,
+	}
+	if post.NakamaModel != nil {
+		b.Model = *post.NakamaModel
+	} else if model, ok := post.ACF["model"].(string); ok {
+		b.Model = model
+	}
+
+	var err error
+	if b.Geometry, err = parseGeometryField(post.ACF["geometry"]); err != nil {
+		return b, fmt.Errorf("post %d: geometry: %w", post.ID, err)
+	}
+	if err := b.locate(post.ACF["lat"], post.ACF["lon"]); err != nil {
+		return b, fmt.Errorf("post %d: %w", post.ID, err)
+	}
+	if b.Anchor, err = parseAnchorField(post.ACF["anchor"]); err != nil {
+		return b, fmt.Errorf("post %d: anchor: %w", post.ID, err)
+	}
+	if b.Radius, err = parseOptionalNumber(post.ACF["radius"]); err != nil {
+		return b, fmt.Errorf("post %d: radius: %w", post.ID, err)
+	}
+
+	return b, b.normalize()
+}
+
+// Payload sent by the nakama-notifier plugin
+type BuildingPush struct {
+	ID     int    `json:"id"`
+	Title  string `json:"title,omitempty"`
+	Slug   string `json:"slug,omitempty"`
+	Link   string `json:"link,omitempty"`
+	Lat    string `json:"lat,omitempty"`
+	Lon    string `json:"lon,omitempty"`
+	Radius string `json:"radius,omitempty"`
+	// GeoJSON footprint, as the ACF text or as an object
+	Geometry json.RawMessage `json:"geometry,omitempty"`
+	// AR anchor group: {altitude, heading, scale, offset_east, offset_north, offset_up}
+	Anchor      json.RawMessage `json:"anchor,omitempty"`
+	Image       string          `json:"image,omitempty"`
+	Model       string          `json:"model,omitempty"`
+	Status      string          `json:"status,omitempty"`
+	Categories  []int           `json:"categories,omitempty"`
+	ModifiedGMT string          `json:"modified_gmt,omitempty"`
+	// Publish date, used to schedule "future" posts
+	DateGMT string `json:"date_gmt,omitempty"`
+	// Status the post went back to, sent with "untrash"
+	RestoreStatus string `json:"restore_status,omitempty"`
+}
+
+// Build a Building from a push payload, failing instead of defaulting bad coordinates to 0
+func buildingFromPush(p BuildingPush) (Building, error) {
+	b := Building{
+		ID:          p.ID,
+		Title:       p.Title,
+		Slug:        p.Slug,
+		Link:        p.Link,
+		Image:       p.Image,
+		Model:       p.Model,
+		Status:      p.Status,
+		Categories:  p.Categories,
+		ModifiedGMT: p.ModifiedGMT,
+	}
+	if b.Status == "update" {
+		b.Status = "publish"
+	}
+
+	var err error
+	if b.Geometry, err = parseGeometryField(p.Geometry); err != nil {
+		return b, fmt.Errorf("geometry: %w", err)
+	}
+	if err := b.locate(p.Lat, p.Lon); err != nil {
+		return b, err
+	}
+	if b.Anchor, err = parseAnchorField(p.Anchor); err != nil {
+		return b, fmt.Errorf("anchor: %w", err)
+	}
+	if b.Radius, err = parseOptionalNumber(p.Radius); err != nil {
+		return b, fmt.Errorf("radius %q: %w", p.Radius, err)
+	}
+
+	return b, b.normalize()
+}
+
+// Decode and validate a stored record, upgrading records written before schema versioning
+func decodeBuilding(value string) (Building, error) {
+	var b Building
+	if err := json.Unmarshal([]byte(value), &b); err != nil {
+		return b, err
+	}
+	if b.SchemaVersion > BuildingSchemaVersion {
+		return b, fmt.Errorf("building %d: unknown schema version %d", b.ID, b.SchemaVersion)
+	}
+	if b.SchemaVersion == 0 {
+		// v0 records came from the narrow struct or the push map, status may be missing or "update"
+		if b.Status == "" || b.Status == "update" {
+			b.Status = "publish"
+		}
+	}
+	// v1 records only lack the optional v2 fields, their zero values mean "not set"
+	b.SchemaVersion = BuildingSchemaVersion
+	return b, b.Validate()
+}
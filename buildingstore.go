@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// Returned by upsertBuilding when storage already holds a newer revision
+var errStaleBuilding = errors.New("stale building revision")
+
+// Parse a WP modified_gmt value, zero time if missing or malformed
+func parseModifiedGMT(s string) time.Time {
+	t, err := time.ParseInLocation(wpDateLayout, s, time.UTC)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// Write a building only if it is not older than the stored one. The write is
+// conditional on the storage versions we read (OCC) of both the building and
+// the change sequence, and carries the change record, so a concurrent writer
+// makes us re-read and compare again instead of silently overwriting it.
+func upsertBuilding(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, b *Building) error {
+	if err := b.normalize(); err != nil {
+		return err
+	}
+
+	key := b.Key()
+	incoming := parseModifiedGMT(b.ModifiedGMT)
+	if incoming.IsZero() {
+		logger.Warn("Building %s has no modified_gmt, ordering can't be checked", key)
+	}
+
+	val, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	config := cfg()
+	var lastErr error
+	for attempt := 1; attempt <= config.LockRetryCount; attempt++ {
+		records, err := nk.StorageRead(ctx, []*runtime.StorageRead{{
+			Collection: "buildings",
+			Key:        key,
+			UserID:     "",
+		}})
+		if err != nil {
+			return err
+		}
+		seq, seqVersion, err := readChangeSeq(ctx, nk)
+		if err != nil {
+			return err
+		}
+
+		version := "*" // create-only if nothing is stored yet
+		if len(records) > 0 {
+			var current struct {
+				ModifiedGMT string `json:"modified_gmt"`
+			}
+			_ = json.Unmarshal([]byte(records[0].Value), &current)
+			stored := parseModifiedGMT(current.ModifiedGMT)
+			if !incoming.IsZero() && incoming.Before(stored) {
+				logger.Warn("Ignoring stale building %s: incoming modified_gmt %s is older than stored %s", key, b.ModifiedGMT, current.ModifiedGMT)
+				return errStaleBuilding
+			}
+			version = records[0].Version
+		}
+
+		seq.Seq++
+		writes := []*runtime.StorageWrite{{
+			Collection: "buildings",
+			Key:        key,
+			UserID:     "",
+			Value:      string(val),
+			Version:    version,
+		}, changeSeqWrite(seq, seqVersion)}
+		writes = append(writes, changeWrites(ChangeUpsert, seq.Seq, []int{b.ID}, []*Building{b})...)
+		if _, lastErr = nk.StorageWrite(ctx, writes); lastErr == nil {
+			buildingIndex.Upsert(*b)
+			return nil
+		}
+
+		logger.Debug("Building %s write conflict (attempt %d/%d): %v", key, attempt, config.LockRetryCount, lastErr)
+		time.Sleep(config.LockRetryDelay)
+	}
+
+	return fmt.Errorf("building write kept conflicting, giving up: %w", lastErr)
+}
+
+// Delete buildings from storage and the spatial index, leaving tombstones in
+// the change log. The deletes, tombstones and sequence bump go in one update.
+func deleteBuildings(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, ids []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	deletes := make([]*runtime.StorageDelete, 0, len(ids))
+	for _, id := range ids {
+		deletes = append(deletes, &runtime.StorageDelete{Collection: "buildings", Key: strconv.Itoa(id), UserID: ""})
+	}
+
+	config := cfg()
+	var lastErr error
+	for attempt := 1; attempt <= config.LockRetryCount; attempt++ {
+		seq, seqVersion, err := readChangeSeq(ctx, nk)
+		if err != nil {
+			return err
+		}
+		first := seq.Seq + 1
+		seq.Seq += int64(len(ids))
+		writes := append([]*runtime.StorageWrite{changeSeqWrite(seq, seqVersion)}, changeWrites(ChangeDelete, first, ids, nil)...)
+		if _, _, lastErr = nk.MultiUpdate(ctx, nil, writes, deletes, nil, false); lastErr == nil {
+			for _, id := range ids {
+				buildingIndex.Remove(id)
+			}
+			return nil
+		}
+
+		logger.Debug("Building delete conflict (attempt %d/%d): %v", attempt, config.LockRetryCount, lastErr)
+		time.Sleep(config.LockRetryDelay)
+	}
+	return fmt.Errorf("building delete kept conflicting, giving up: %w", lastErr)
+}
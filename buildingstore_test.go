@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Stored value of collection/key, decoded into v
+func (s *fakeStorage) decode(t *testing.T, collection, key string, v interface{}) bool {
+	t.Helper()
+	s.mu.Lock()
+	obj, ok := s.objects[fakeStorageKey(collection, "", key)]
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+	if err := json.Unmarshal([]byte(obj.value), v); err != nil {
+		t.Fatalf("%s/%s: %v", collection, key, err)
+	}
+	return true
+}
+
+func TestConcurrentUpsertsKeepChangeInStep(t *testing.T) {
+	const id = 9001
+	defer buildingIndex.Remove(id)
+
+	nk := newFakeStorage()
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		b := &Building{ID: id, Lat: 45, Lon: 7, ModifiedGMT: start.Add(time.Duration(i) * time.Minute).Format(wpDateLayout)}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Stale snapshots and exhausted retries are expected losers here
+			_ = upsertBuilding(context.Background(), nopLogger{}, nk, b)
+		}()
+	}
+	wg.Wait()
+
+	var stored Building
+	var change BuildingChange
+	var seq changeSeqState
+	key := Building{ID: id}.Key()
+	if !nk.decode(t, "buildings", key, &stored) || !nk.decode(t, ChangesCollection, key, &change) || !nk.decode(t, SyncCollection, ChangeSeqKey, &seq) {
+		t.Fatal("building, change or sequence missing after upserts")
+	}
+	if change.Op != ChangeUpsert || change.Building == nil || change.Building.ModifiedGMT != stored.ModifiedGMT {
+		t.Errorf("change %+v does not match stored building modified %s", change, stored.ModifiedGMT)
+	}
+	if change.Seq != seq.Seq {
+		t.Errorf("change seq = %d, counter = %d", change.Seq, seq.Seq)
+	}
+}
+
+func TestDeleteBuildingsWritesTombstones(t *testing.T) {
+	ids := []int{9002, 9003}
+	defer func() {
+		for _, id := range ids {
+			buildingIndex.Remove(id)
+		}
+	}()
+
+	nk := newFakeStorage()
+	ctx := context.Background()
+	for _, id := range ids {
+		b := &Building{ID: id, Lat: 45, Lon: 7, ModifiedGMT: "2024-01-01T12:00:00"}
+		if err := upsertBuilding(ctx, nopLogger{}, nk, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := deleteBuildings(ctx, nopLogger{}, nk, ids); err != nil {
+		t.Fatal(err)
+	}
+
+	var seq changeSeqState
+	if !nk.decode(t, SyncCollection, ChangeSeqKey, &seq) || seq.Seq != 4 {
+		t.Fatalf("counter = %+v, want seq 4", seq)
+	}
+	for i, id := range ids {
+		key := Building{ID: id}.Key()
+		if nk.decode(t, "buildings", key, &Building{}) {
+			t.Errorf("building %d still stored", id)
+		}
+		if _, ok := buildingIndex.Get(id); ok {
+			t.Errorf("building %d still indexed", id)
+		}
+		var change BuildingChange
+		if !nk.decode(t, ChangesCollection, key, &change) {
+			t.Errorf("no tombstone for building %d", id)
+			continue
+		}
+		if want := int64(3 + i); change.Op != ChangeDelete || change.Seq != want || change.Building != nil {
+			t.Errorf("tombstone %+v, want delete at seq %d", change, want)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// Edge of a level 0 location cell in degrees (~200m north-south). Every
+// level up doubles the edge, so four cells make one cell of the next level.
+const CellSize = 0.002
+
+// Coarsest cell level, ~57km north-south
+const MaxCellLevel = 8
+
+// Largest subscription radius a session may ask for, in meters
+const MaxViewRadius = 10000.0
+
+// Subscription views. "ar" sessions only need players close by at full
+// rate; "map" sessions also get coarse summaries of everyone further out.
+const (
+	ViewAR  = "ar"
+	ViewMap = "map"
+)
+
+// Integer grid position of a cell: Row counts cell edges of latitude, Col
+// of longitude, both from 0,0, at the given level. Level 0 cells carry every
+// position update; coarser levels only get summaries. The server owns this
+// grid; clients only ever see the labels.
+type CellID struct {
+	Level int
+	Row   int
+	Col   int
+}
+
+func cellFor(lat, lon float64) CellID {
+	return cellAt(lat, lon, 0)
+}
+
+func cellAt(lat, lon float64, level int) CellID {
+	size := cellSize(level)
+	return CellID{Level: level, Row: int(math.Floor(lat / size)), Col: int(math.Floor(lon / size))}
+}
+
+// Edge of a cell at the given level, in degrees
+func cellSize(level int) float64 {
+	return CellSize * float64(int(1)<<uint(level))
+}
+
+// Stream label clients receive cell messages on. Level 0 keeps the plain
+// cell_<row>_<col> form buildings are announced on.
+func (c CellID) Label() string {
+	if c.Level == 0 {
+		return fmt.Sprintf("cell_%d_%d", c.Row, c.Col)
+	}
+	return fmt.Sprintf("cell_l%d_%d_%d", c.Level, c.Row, c.Col)
+}
+
+// South-west corner of the cell
+func (c CellID) Origin() (float64, float64) {
+	size := cellSize(c.Level)
+	return float64(c.Row) * size, float64(c.Col) * size
+}
+
+// Distance in meters a level's interest cells are guaranteed to cover
+// around a point at lat: half an edge, along the shorter longitude side.
+func cellReach(lat float64, level int) float64 {
+	return cellSize(level) / 2 * metersPerDegreeLat * math.Cos(lat*math.Pi/180)
+}
+
+// Finest level whose interest cells cover radius meters around lat
+func levelForRadius(lat, radius float64) int {
+	for level := 0; level < MaxCellLevel; level++ {
+		if cellReach(lat, level) >= radius {
+			return level
+		}
+	}
+	return MaxCellLevel
+}
+
+// Stream label of the cell containing a point
+func cellLabelFor(lat, lon float64) string {
+	return cellFor(lat, lon).Label()
+}
+
+// Cells at a level a player at lat/lon should hear: their own cell plus the
+// three neighbours on the side of the cell they're in, so someone just across
+// an edge is never missed. The home cell comes first.
+func interestCells(lat, lon float64, level int) []CellID {
+	home := cellAt(lat, lon, level)
+	originLat, originLon := home.Origin()
+	half := cellSize(level) / 2
+
+	dRow, dCol := -1, -1
+	if lat-originLat >= half {
+		dRow = 1
+	}
+	if lon-originLon >= half {
+		dCol = 1
+	}
+	return []CellID{
+		home,
+		{Level: level, Row: home.Row + dRow, Col: home.Col},
+		{Level: level, Row: home.Row, Col: home.Col + dCol},
+		{Level: level, Row: home.Row + dRow, Col: home.Col + dCol},
+	}
+}
+
+// How far a session wants to see. Both fields are optional: an empty view
+// keeps the current one and a zero radius uses the view's default.
+type ViewOptions struct {
+	View   string  `json:"view"`
+	Radius float64 `json:"radius"`
+}
+
+func (o ViewOptions) Validate() error {
+	switch o.View {
+	case "", ViewAR, ViewMap:
+	default:
+		return fmt.Errorf("view must be %q or %q", ViewAR, ViewMap)
+	}
+	if o.Radius < 0 || o.Radius > MaxViewRadius {
+		return fmt.Errorf("radius must be between 0 and %v meters", MaxViewRadius)
+	}
+	return nil
+}
+
+// Cell streams one session is in
+type Subscription struct {
+	UserID string
+	Home   CellID
+	Cells  map[CellID]bool
+	View   string
+	Radius float64 // 0 for the view's default
+	Level  int     // coarse level on top of level 0, 0 for none
+
+	moving *sync.Mutex // held while a move makes its stream calls
+}
+
+// Apply a client's view options; changing the view resets the radius
+func (s *Subscription) setView(opts ViewOptions) {
+	if opts.View != "" && opts.View != s.View {
+		s.View = opts.View
+		s.Radius = 0
+	}
+	if opts.Radius > 0 {
+		s.Radius = opts.Radius
+	}
+}
+
+func (s *Subscription) radius() float64 {
+	if s.Radius > 0 {
+		return s.Radius
+	}
+	if s.View == ViewMap {
+		return cfg().MapViewRadius
+	}
+	return cfg().ARViewRadius
+}
+
+// What a client gets back after its subscription changed
+type SubscriptionState struct {
+	Home   string   `json:"home"`
+	Cells  []string `json:"cells"`
+	Joined []string `json:"joined,omitempty"`
+	Left   []string `json:"left,omitempty"`
+	View   string   `json:"view,omitempty"`
+	Radius float64  `json:"radius,omitempty"`
+	Level  int      `json:"level"`
+
+	// Last known positions in the level 0 cells, see PositionCache
+	Occupants map[string][]CellOccupant `json:"occupants,omitempty"`
+	// Current summaries of occupied coarse cells, see CoarseCells
+	Summaries []CellSummary `json:"summaries,omitempty"`
+
+	joinedFine   []CellID // level 0 cells joined by this move
+	joinedCoarse []CellID // coarse cells joined by this move
+}
+
+// Cell memberships of every session on this node
+type SubscriptionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*Subscription
+}
+
+var subscriptions = &SubscriptionRegistry{sessions: make(map[string]*Subscription)}
+
+func (r *SubscriptionRegistry) Get(sessionID string) (Subscription, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sub, ok := r.sessions[sessionID]
+	if !ok {
+		return Subscription{}, false
+	}
+	return sub.clone(), true
+}
+
+// Copy with its own cell set; call with the registry lock held
+func (s *Subscription) clone() Subscription {
+	copied := *s
+	copied.Cells = make(map[CellID]bool, len(s.Cells))
+	for c := range s.Cells {
+		copied.Cells[c] = true
+	}
+	return copied
+}
+
+// Forget a session, returning what it was subscribed to
+func (r *SubscriptionRegistry) Remove(sessionID string) (Subscription, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sub, ok := r.sessions[sessionID]
+	if !ok {
+		return Subscription{}, false
+	}
+	delete(r.sessions, sessionID)
+	return *sub, true
+}
+
+// Coarse cells any session on this node is subscribed to
+func (r *SubscriptionRegistry) coarseCells() map[CellID]bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cells := make(map[CellID]bool)
+	for _, sub := range r.sessions {
+		for c := range sub.Cells {
+			if c.Level > 0 {
+				cells[c] = true
+			}
+		}
+	}
+	return cells
+}
+
+// Move a session to the cells around lat/lon: join the new streams, leave
+// the ones it no longer needs and remember the result. Level 0 cells are
+// always wanted; a coarse level is added when the view radius reaches
+// beyond them. The diff is planned and committed under the registry lock,
+// the stream calls in between only hold the session's own lock.
+func moveSubscription(ctx context.Context, nk runtime.NakamaModule, userID, sessionID string, lat, lon float64, opts ViewOptions) (SubscriptionState, error) {
+	subscriptions.mu.Lock()
+	sub := subscriptions.sessions[sessionID]
+	if sub == nil {
+		sub = &Subscription{UserID: userID, View: ViewAR, Cells: make(map[CellID]bool), moving: &sync.Mutex{}}
+		subscriptions.sessions[sessionID] = sub
+	}
+	moving := sub.moving
+	subscriptions.mu.Unlock()
+
+	moving.Lock()
+	defer moving.Unlock()
+
+	subscriptions.mu.Lock()
+	next := sub.clone()
+	subscriptions.mu.Unlock()
+
+	next.setView(opts)
+	wanted := interestCells(lat, lon, 0)
+	next.Level = levelForRadius(lat, next.radius())
+	if next.Level > 0 {
+		wanted = append(wanted, interestCells(lat, lon, next.Level)...)
+	}
+	keep := make(map[CellID]bool, len(wanted))
+	var join, leave []CellID
+	for _, c := range wanted {
+		keep[c] = true
+		if !next.Cells[c] {
+			join = append(join, c)
+		}
+	}
+	for c := range next.Cells {
+		if !keep[c] {
+			leave = append(leave, c)
+		}
+	}
+
+	var state SubscriptionState
+	streamMode := cfg().StreamMode
+	leaveJoined := func(cells []CellID) {
+		for _, c := range cells {
+			_ = nk.StreamUserLeave(streamMode, "", "", c.Label(), userID, sessionID)
+		}
+	}
+	for i, c := range join {
+		if _, err := nk.StreamUserJoin(streamMode, "", "", c.Label(), userID, sessionID, false, false, ""); err != nil {
+			// Back out so the streams still match the stored subscription
+			leaveJoined(join[:i])
+			return state, fmt.Errorf("failed to join %s: %w", c.Label(), err)
+		}
+		next.Cells[c] = true
+		state.Joined = append(state.Joined, c.Label())
+		if c.Level == 0 {
+			state.joinedFine = append(state.joinedFine, c)
+		} else {
+			state.joinedCoarse = append(state.joinedCoarse, c)
+		}
+	}
+	var leaveErr error
+	for _, c := range leave {
+		if err := nk.StreamUserLeave(streamMode, "", "", c.Label(), userID, sessionID); err != nil {
+			// Still in the stream, so keep it for the next move or the session end
+			if leaveErr == nil {
+				leaveErr = fmt.Errorf("failed to leave %s: %w", c.Label(), err)
+			}
+			continue
+		}
+		delete(next.Cells, c)
+		state.Left = append(state.Left, c.Label())
+	}
+	next.Home = wanted[0]
+
+	subscriptions.mu.Lock()
+	current := subscriptions.sessions[sessionID] == sub
+	if current {
+		*sub = next
+	}
+	subscriptions.mu.Unlock()
+	if !current {
+		// The session ended mid-move and its old cells were already left
+		leaveJoined(join)
+		return SubscriptionState{}, fmt.Errorf("session %s ended while moving cells", sessionID)
+	}
+
+	state.Home = next.Home.Label()
+	state.Cells = next.labels()
+	state.View = next.View
+	state.Radius = next.radius()
+	state.Level = next.Level
+	sort.Strings(state.Left)
+	return state, leaveErr
+}
+
+// Leave every cell stream a session is in
+func dropSubscription(nk runtime.NakamaModule, sessionID string) (Subscription, error) {
+	sub, ok := subscriptions.Remove(sessionID)
+	if !ok {
+		return sub, nil
+	}
+	streamMode := cfg().StreamMode
+	var firstErr error
+	for c := range sub.Cells {
+		if err := nk.StreamUserLeave(streamMode, "", "", c.Label(), sub.UserID, sessionID); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return sub, firstErr
+}
+
+func (s *Subscription) labels() []string {
+	labels := make([]string, 0, len(s.Cells))
+	for c := range s.Cells {
+		labels = append(labels, c.Label())
+	}
+	sort.Strings(labels)
+	return labels
+}
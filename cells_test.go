@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// Stream membership of one session, failing joins to failJoin
+type fakeStreams struct {
+	runtime.NakamaModule
+
+	mu       sync.Mutex
+	joined   map[string]bool
+	failJoin string
+}
+
+func (f *fakeStreams) StreamUserJoin(mode uint8, subject, subcontext, label, userID, sessionID string, hidden, persistence bool, status string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if label == f.failJoin {
+		return false, errors.New("stream join failed")
+	}
+	f.joined[label] = true
+	return true, nil
+}
+
+func (f *fakeStreams) StreamUserLeave(mode uint8, subject, subcontext, label, userID, sessionID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.joined, label)
+	return nil
+}
+
+func (f *fakeStreams) labels() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	labels := make([]string, 0, len(f.joined))
+	for label := range f.joined {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+func TestMoveSubscription(t *testing.T) {
+	const userID, sessionID = "user", "session"
+	defer subscriptions.Remove(sessionID)
+
+	nk := &fakeStreams{joined: make(map[string]bool)}
+	steps := []struct {
+		name     string
+		lat, lon float64
+		failJoin bool
+	}{
+		{"first move", 0.0005, 0.0005, false},
+		{"same cell", 0.0006, 0.0006, false},
+		{"next cell over", 0.0025, 0.0005, false},
+		{"far away", 1, 1, false},
+		{"join fails", 2, 2, true},
+		{"retry", 2, 2, false},
+	}
+	for _, step := range steps {
+		before, _ := subscriptions.Get(sessionID)
+		nk.failJoin = ""
+		if step.failJoin {
+			nk.failJoin = interestCells(step.lat, step.lon, 0)[2].Label()
+		}
+
+		state, err := moveSubscription(context.Background(), nk, userID, sessionID, step.lat, step.lon, ViewOptions{})
+		sub, _ := subscriptions.Get(sessionID)
+		if step.failJoin {
+			if err == nil {
+				t.Fatalf("%s: expected an error", step.name)
+			}
+			if !reflect.DeepEqual(sub.Cells, before.Cells) {
+				t.Errorf("%s: cells changed on failure: %v, was %v", step.name, sub.labels(), before.labels())
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("%s: %v", step.name, err)
+			}
+			if want := interestCells(step.lat, step.lon, 0)[0].Label(); state.Home != want {
+				t.Errorf("%s: home = %s, want %s", step.name, state.Home, want)
+			}
+			if !reflect.DeepEqual(state.Cells, sub.labels()) {
+				t.Errorf("%s: reported cells %v, stored %v", step.name, state.Cells, sub.labels())
+			}
+		}
+		if got := nk.labels(); !reflect.DeepEqual(got, sub.labels()) {
+			t.Errorf("%s: streams joined %v, subscription has %v", step.name, got, sub.labels())
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	ChangesCollection = "building_changes"
+	ChangeSeqKey      = "change_seq"
+
+	// Tombstones older than this are pruned; clients further behind must resync fully
+	TombstoneRetention = 30 * 24 * time.Hour
+
+	DefaultChangesLimit = 200
+	MaxChangesLimit     = 1000
+
+	// Storage list page size used while scanning for changes
+	changesPageSize = 100
+)
+
+const (
+	ChangeUpsert = "upsert"
+	ChangeDelete = "delete"
+)
+
+// Latest change for one building. Only the newest change per building is kept,
+// so deletes stay around as tombstones until they are pruned.
+type BuildingChange struct {
+	Seq      int64     `json:"seq"`
+	Op       string    `json:"op"`
+	ID       int       `json:"id"`
+	Building *Building `json:"building,omitempty"`
+	At       int64     `json:"at"`
+}
+
+// Change sequence counter, stored in the sync collection
+type changeSeqState struct {
+	Seq           int64 `json:"seq"`
+	PrunedThrough int64 `json:"pruned_through"`
+}
+
+func readChangeSeq(ctx context.Context, nk runtime.NakamaModule) (changeSeqState, string, error) {
+	var state changeSeqState
+	records, err := nk.StorageRead(ctx, []*runtime.StorageRead{{
+		Collection: SyncCollection,
+		Key:        ChangeSeqKey,
+		UserID:     "",
+	}})
+	if err != nil {
+		return state, "", err
+	}
+	if len(records) == 0 {
+		return state, "*", nil
+	}
+	if err := json.Unmarshal([]byte(records[0].Value), &state); err != nil {
+		return state, "", err
+	}
+	return state, records[0].Version, nil
+}
+
+// Write for the counter, conditional on the version it was read at
+func changeSeqWrite(state changeSeqState, version string) *runtime.StorageWrite {
+	val, _ := json.Marshal(state)
+	return &runtime.StorageWrite{
+		Collection:      SyncCollection,
+		Key:             ChangeSeqKey,
+		UserID:          "",
+		Value:           string(val),
+		Version:         version,
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}
+}
+
+// Update the counter with an OCC loop so concurrent writers never share a
+// sequence
+func updateChangeSeq(ctx context.Context, nk runtime.NakamaModule, fn func(*changeSeqState)) (changeSeqState, error) {
+	config := cfg()
+	var lastErr error
+	for attempt := 1; attempt <= config.LockRetryCount; attempt++ {
+		state, version, err := readChangeSeq(ctx, nk)
+		if err != nil {
+			return state, err
+		}
+		fn(&state)
+		if _, lastErr = nk.StorageWrite(ctx, []*runtime.StorageWrite{changeSeqWrite(state, version)}); lastErr == nil {
+			return state, nil
+		}
+		time.Sleep(config.LockRetryDelay)
+	}
+	return changeSeqState{}, fmt.Errorf("change sequence kept conflicting, giving up: %w", lastErr)
+}
+
+// Change log writes for upserts (buildings set) or deletes (buildings nil),
+// numbered from first. Callers put them in the same storage write as the
+// sequence bump and the building itself, so a reader that sees sequence N can
+// always list change N, and a later change of a building always has the
+// higher sequence.
+func changeWrites(op string, first int64, ids []int, buildings []*Building) []*runtime.StorageWrite {
+	now := time.Now().Unix()
+	writes := make([]*runtime.StorageWrite, 0, len(ids))
+	for i, id := range ids {
+		change := BuildingChange{Seq: first + int64(i), Op: op, ID: id, At: now}
+		if op == ChangeUpsert {
+			change.Building = buildings[i]
+		}
+		val, _ := json.Marshal(change)
+		writes = append(writes, &runtime.StorageWrite{
+			Collection:      ChangesCollection,
+			Key:             strconv.Itoa(id),
+			UserID:          "",
+			Value:           string(val),
+			PermissionRead:  0,
+			PermissionWrite: 0,
+		})
+	}
+	return writes
+}
+
+func listAllChanges(ctx context.Context, nk runtime.NakamaModule) ([]BuildingChange, error) {
+	var changes []BuildingChange
+	cursor := ""
+	for {
+		objects, next, err := nk.StorageList(ctx, "", "", ChangesCollection, 100, cursor)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objects {
+			var c BuildingChange
+			if err := json.Unmarshal([]byte(obj.Value), &c); err == nil {
+				changes = append(changes, c)
+			}
+		}
+		if next == "" || len(objects) == 0 {
+			return changes, nil
+		}
+		cursor = next
+	}
+}
+
+// Current change token, handed out with full fetches so clients can switch to deltas
+func currentChangeToken(ctx context.Context, nk runtime.NakamaModule) (string, error) {
+	state, _, err := readChangeSeq(ctx, nk)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(state.Seq, 10), nil
+}
+
+// Position in the change feed. A settled token is just the sequence the
+// client is caught up to. While a scan of the change collection is under way
+// it also carries the sequence the scan will settle on and the storage
+// cursor to resume from: "<since>.<upper>.<cursor>".
+type changeToken struct {
+	Since  int64
+	Upper  int64
+	Cursor string
+}
+
+func parseChangeToken(token string) (changeToken, error) {
+	var t changeToken
+	parts := strings.SplitN(token, ".", 3)
+	since, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || since < 0 {
+		return t, fmt.Errorf("invalid token %q", token)
+	}
+	t.Since = since
+	if len(parts) == 1 {
+		return t, nil
+	}
+	if len(parts) != 3 || parts[2] == "" {
+		return t, fmt.Errorf("invalid token %q", token)
+	}
+	if t.Upper, err = strconv.ParseInt(parts[1], 10, 64); err != nil || t.Upper < since {
+		return t, fmt.Errorf("invalid token %q", token)
+	}
+	t.Cursor = parts[2]
+	return t, nil
+}
+
+func (t changeToken) String() string {
+	if t.Cursor == "" {
+		return strconv.FormatInt(t.Since, 10)
+	}
+	return fmt.Sprintf("%d.%d.%s", t.Since, t.Upper, t.Cursor)
+}
+
+// RPC returning building changes since a token.
+// Payload: {"token": "<from get_buildings or a previous call>", "limit": 200}.
+// Returns {"changes": [...], "token": "...", "more": bool, "reset": bool}.
+// Each call reads storage pages until about limit changes are found; with
+// more set the client calls again with the new token. With reset set the
+// token is too old (tombstones were pruned) and the client must refetch
+// everything with get_buildings.
+func rpcGetBuildingsChanges(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var req struct {
+		Token string `json:"token"`
+		Limit int    `json:"limit,omitempty"`
+	}
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		return "", runtime.NewError("invalid payload", codeInvalidArgument)
+	}
+	token, err := parseChangeToken(req.Token)
+	if err != nil {
+		return "", runtime.NewError("invalid token", codeInvalidArgument)
+	}
+	if req.Limit <= 0 {
+		req.Limit = DefaultChangesLimit
+	}
+	if req.Limit > MaxChangesLimit {
+		req.Limit = MaxChangesLimit
+	}
+
+	state, _, err := readChangeSeq(ctx, nk)
+	if err != nil {
+		logger.Error("Failed to read change sequence: %v", err)
+		return "", runtime.NewError("failed to read changes", codeInternal)
+	}
+
+	resp := map[string]interface{}{"changes": []BuildingChange{}, "token": token.String(), "more": false, "reset": false}
+	if token.Since < state.PrunedThrough || token.Since > state.Seq || token.Upper > state.Seq {
+		resp["reset"] = true
+		return marshalChangesResponse(resp)
+	}
+	if token.Cursor == "" {
+		if token.Since == state.Seq {
+			return marshalChangesResponse(resp)
+		}
+		// Every change up to here was committed with its sequence bump, so a
+		// full scan from now sees all of them (or a newer change of the same building)
+		token.Upper = state.Seq
+	}
+
+	pageSize := req.Limit
+	if pageSize > changesPageSize {
+		pageSize = changesPageSize
+	}
+	var changes []BuildingChange
+	for {
+		objects, next, err := nk.StorageList(ctx, "", "", ChangesCollection, pageSize, token.Cursor)
+		if err != nil {
+			logger.Error("Failed to list building changes: %v", err)
+			return "", runtime.NewError("failed to read changes", codeInternal)
+		}
+		for _, obj := range objects {
+			var c BuildingChange
+			if err := json.Unmarshal([]byte(obj.Value), &c); err == nil && c.Seq > token.Since {
+				changes = append(changes, c)
+			}
+		}
+		token.Cursor = next
+		if next == "" || len(objects) == 0 {
+			token.Cursor = ""
+			break
+		}
+		if len(changes) >= req.Limit {
+			break
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Seq < changes[j].Seq })
+
+	if token.Cursor == "" {
+		token = changeToken{Since: token.Upper}
+	} else {
+		resp["more"] = true
+	}
+	resp["token"] = token.String()
+
+	config := cfg()
+	for _, c := range changes {
+		if c.Building != nil {
+			if err := c.Building.rewriteAssets(config); err != nil {
+				logger.Warn("Building %d has an unusable asset URL: %v", c.ID, err)
+			}
+		}
+	}
+	if changes != nil {
+		resp["changes"] = changes
+	}
+	return marshalChangesResponse(resp)
+}
+
+func marshalChangesResponse(resp map[string]interface{}) (string, error) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Drop tombstones past TombstoneRetention and remember the newest pruned sequence
+func pruneTombstones(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule) error {
+	all, err := listAllChanges(ctx, nk)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-TombstoneRetention).Unix()
+	var deletes []*runtime.StorageDelete
+	var newest int64
+	for _, c := range all {
+		if c.Op == ChangeDelete && c.At < cutoff {
+			deletes = append(deletes, &runtime.StorageDelete{Collection: ChangesCollection, Key: strconv.Itoa(c.ID), UserID: ""})
+			if c.Seq > newest {
+				newest = c.Seq
+			}
+		}
+	}
+	if len(deletes) == 0 {
+		return nil
+	}
+
+	// Bump pruned_through first so no client can miss a delete we're about to drop
+	if _, err := updateChangeSeq(ctx, nk, func(s *changeSeqState) {
+		if newest > s.PrunedThrough {
+			s.PrunedThrough = newest
+		}
+	}); err != nil {
+		return fmt.Errorf("error updating pruned_through: %w", err)
+	}
+	if err := nk.StorageDelete(ctx, deletes); err != nil {
+		return err
+	}
+	logger.Info("Pruned %d building tombstones (through seq %d)", len(deletes), newest)
+	return nil
+}
+
+func startTombstoneJanitor(logger runtime.Logger, nk runtime.NakamaModule) {
+	go func() {
+		ticker := time.NewTicker(6 * time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := pruneTombstones(context.Background(), logger, nk); err != nil {
+				logger.Error("Failed to prune building tombstones: %v", err)
+			}
+		}
+	}()
+}
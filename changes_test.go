@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestParseChangeToken(t *testing.T) {
+	tests := []struct {
+		token   string
+		want    changeToken
+		wantErr bool
+	}{
+		{"0", changeToken{}, false},
+		{"42", changeToken{Since: 42}, false},
+		{"42.50.Q3Vyc29y+/=", changeToken{Since: 42, Upper: 50, Cursor: "Q3Vyc29y+/="}, false},
+		{"", changeToken{}, true},
+		{"-1", changeToken{}, true},
+		{"abc", changeToken{}, true},
+		{"42.50", changeToken{}, true},
+		{"42.50.", changeToken{}, true},
+		{"42.41.cursor", changeToken{}, true},
+		{"42.x.cursor", changeToken{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseChangeToken(tt.token)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseChangeToken(%q) error = %v, want error %v", tt.token, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("parseChangeToken(%q) = %+v, want %+v", tt.token, got, tt.want)
+		}
+		if err == nil && got.String() != tt.token {
+			t.Errorf("round trip of %q gave %q", tt.token, got.String())
+		}
+	}
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// Defaults used when the runtime env doesn't set a value
+const (
+	DefaultWPBaseURL         = "http://wordpress:80"
+	DefaultWPCategoryID      = 3
+	DefaultMaxGroups         = 80
+	DefaultStreamMode        = 2
+	DefaultLockRetryCount    = 5
+	DefaultLockRetryDelay    = 100 * time.Millisecond
+	DefaultAdminID           = "319e1542-46ed-42fa-aa71-3d26dc6c976e"
+	DefaultInitialGroupSize  = 6
+	DefaultReconcileInterval = 10 * time.Minute
+	DefaultGeofenceRadius    = 30.0 // meters
+	DefaultGeofenceMinDwell  = 30 * time.Second
+	DefaultMapViewRadius     = 1500.0 // meters
+	DefaultARViewRadius      = 100.0  // meters
+	DefaultCoarseTick        = 2 * time.Second
+	DefaultLocationTick      = 150 * time.Millisecond
+)
+
+const (
+	ConfigCollection   = "config"
+	ConfigOverridesKey = "runtime"
+
+	// Groups are listed in one GroupsList page, which holds at most 100
+	MaxGroupsLimit = 100
+)
+
+// Module configuration, loaded from the Nakama runtime.env map at startup.
+// Fields marked "runtime" can also be changed by an admin through the
+// admin_set_config RPC without rebuilding the plugin.
+type Config struct {
+	WPBaseURL          string             // wp_base_url (runtime)
+	WPCategoryID       int                // wp_category_id (runtime)
+	BuildingSource     string             // building_source (runtime)
+	BuildingSourcePath string             // building_source_path (runtime)
+	ReconcileInterval  time.Duration      // reconcile_interval, 0 disables (runtime)
+	LockRetryCount     int                // lock_retry_count (runtime)
+	LockRetryDelay     time.Duration      // lock_retry_delay (runtime)
+	InitialGroupSize   int                // initial_group_size (runtime)
+	MaxGroups          int                // max_groups
+	StreamMode         uint8              // stream_mode
+	AdminID            string             // admin_id
+	WebhookSecret      string             // wp_webhook_secret
+	Environment        string             // environment: dev | staging | production
+	PublicAssetBaseURL string             // public_asset_base_url (runtime)
+	AssetRewrites      []AssetRewriteRule // asset_url_rewrites_<environment> or asset_url_rewrites: "from=>to,..."
+	GeofenceRadius     float64            // geofence_radius in meters, for buildings without their own (runtime)
+	GeofenceMinDwell   time.Duration      // geofence_min_dwell before a visit counts (runtime)
+	MapViewRadius      float64            // map_view_radius in meters, default for the "map" view (runtime)
+	ARViewRadius       float64            // ar_view_radius in meters, default for the "ar" view (runtime)
+	CoarseTick         time.Duration      // coarse_tick between coarse cell summaries
+	LocationTick       time.Duration      // location_tick between batched position messages
+}
+
+// Admin-settable subset of Config, stored in the "config" collection.
+// Nil fields fall back to the env value.
+type ConfigOverrides struct {
+	WPBaseURL          *string  `json:"wp_base_url,omitempty"`
+	WPCategoryID       *int     `json:"wp_category_id,omitempty"`
+	BuildingSource     *string  `json:"building_source,omitempty"`
+	BuildingSourcePath *string  `json:"building_source_path,omitempty"`
+	ReconcileInterval  *string  `json:"reconcile_interval,omitempty"`
+	LockRetryCount     *int     `json:"lock_retry_count,omitempty"`
+	LockRetryDelay     *string  `json:"lock_retry_delay,omitempty"`
+	InitialGroupSize   *int     `json:"initial_group_size,omitempty"`
+	PublicAssetBaseURL *string  `json:"public_asset_base_url,omitempty"`
+	GeofenceRadius     *float64 `json:"geofence_radius,omitempty"`
+	GeofenceMinDwell   *string  `json:"geofence_min_dwell,omitempty"`
+	MapViewRadius      *float64 `json:"map_view_radius,omitempty"`
+	ARViewRadius       *float64 `json:"ar_view_radius,omitempty"`
+}
+
+var (
+	configMu        sync.RWMutex
+	envConfig       = defaultConfig()
+	activeConfig    = defaultConfig()
+	activeOverrides ConfigOverrides
+)
+
+func defaultConfig() Config {
+	return Config{
+		WPBaseURL:         DefaultWPBaseURL,
+		WPCategoryID:      DefaultWPCategoryID,
+		BuildingSource:    "wordpress",
+		ReconcileInterval: DefaultReconcileInterval,
+		LockRetryCount:    DefaultLockRetryCount,
+		LockRetryDelay:    DefaultLockRetryDelay,
+		InitialGroupSize:  DefaultInitialGroupSize,
+		MaxGroups:         DefaultMaxGroups,
+		StreamMode:        DefaultStreamMode,
+		AdminID:           DefaultAdminID,
+		Environment:       EnvDev,
+		GeofenceRadius:    DefaultGeofenceRadius,
+		GeofenceMinDwell:  DefaultGeofenceMinDwell,
+		MapViewRadius:     DefaultMapViewRadius,
+		ARViewRadius:      DefaultARViewRadius,
+		CoarseTick:        DefaultCoarseTick,
+		LocationTick:      DefaultLocationTick,
+	}
+}
+
+// Current configuration (env values with admin overrides applied)
+func cfg() Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return activeConfig
+}
+
+// Parse "0" as zero so intervals can be switched off without a unit
+func parseDurationValue(raw string) (time.Duration, error) {
+	if raw == "0" {
+		return 0, nil
+	}
+	return time.ParseDuration(raw)
+}
+
+// Build a Config from the runtime env map on top of the defaults
+func configFromEnv(env map[string]string) (Config, error) {
+	c := defaultConfig()
+
+	str := func(key string, dst *string) {
+		if v, ok := env[key]; ok && v != "" {
+			*dst = v
+		}
+	}
+	num := func(key string, dst *int) error {
+		if v, ok := env[key]; ok && v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			*dst = n
+		}
+		return nil
+	}
+	dur := func(key string, dst *time.Duration) error {
+		if v, ok := env[key]; ok && v != "" {
+			d, err := parseDurationValue(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			*dst = d
+		}
+		return nil
+	}
+	flt := func(key string, dst *float64) error {
+		if v, ok := env[key]; ok && v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			*dst = f
+		}
+		return nil
+	}
+
+	str("wp_base_url", &c.WPBaseURL)
+	str("building_source", &c.BuildingSource)
+	str("building_source_path", &c.BuildingSourcePath)
+	str("admin_id", &c.AdminID)
+	str("wp_webhook_secret", &c.WebhookSecret)
+	str("environment", &c.Environment)
+	str("public_asset_base_url", &c.PublicAssetBaseURL)
+
+	rewrites, ok := env["asset_url_rewrites_"+c.Environment]
+	if !ok {
+		rewrites = env["asset_url_rewrites"]
+	}
+	rules, err := parseAssetRewrites(rewrites)
+	if err != nil {
+		return c, err
+	}
+	c.AssetRewrites = rules
+
+	streamMode := int(c.StreamMode)
+	for _, err := range []error{
+		num("wp_category_id", &c.WPCategoryID),
+		num("lock_retry_count", &c.LockRetryCount),
+		num("initial_group_size", &c.InitialGroupSize),
+		num("max_groups", &c.MaxGroups),
+		num("stream_mode", &streamMode),
+		dur("reconcile_interval", &c.ReconcileInterval),
+		dur("lock_retry_delay", &c.LockRetryDelay),
+		flt("geofence_radius", &c.GeofenceRadius),
+		dur("geofence_min_dwell", &c.GeofenceMinDwell),
+		flt("map_view_radius", &c.MapViewRadius),
+		flt("ar_view_radius", &c.ARViewRadius),
+		dur("coarse_tick", &c.CoarseTick),
+		dur("location_tick", &c.LocationTick),
+	} {
+		if err != nil {
+			return c, err
+		}
+	}
+	if streamMode < 0 || streamMode > 255 {
+		return c, fmt.Errorf("stream_mode %d out of range", streamMode)
+	}
+	c.StreamMode = uint8(streamMode)
+
+	return c, c.Validate()
+}
+
+func (c Config) Validate() error {
+	u, err := url.Parse(c.WPBaseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("wp_base_url %q must be an absolute http(s) URL", c.WPBaseURL)
+	}
+	if c.WPCategoryID <= 0 {
+		return fmt.Errorf("wp_category_id must be positive, got %d", c.WPCategoryID)
+	}
+	switch c.BuildingSource {
+	case "wordpress", "memory":
+	case "file":
+		if c.BuildingSourcePath == "" {
+			return fmt.Errorf("building_source=file needs building_source_path")
+		}
+	default:
+		return fmt.Errorf("unknown building_source %q", c.BuildingSource)
+	}
+	if c.ReconcileInterval < 0 || (c.ReconcileInterval > 0 && c.ReconcileInterval < 10*time.Second) {
+		return fmt.Errorf("reconcile_interval must be 0 or at least 10s, got %v", c.ReconcileInterval)
+	}
+	if c.LockRetryCount < 1 {
+		return fmt.Errorf("lock_retry_count must be at least 1, got %d", c.LockRetryCount)
+	}
+	if c.LockRetryDelay < 0 {
+		return fmt.Errorf("lock_retry_delay must not be negative")
+	}
+	if c.InitialGroupSize < 1 {
+		return fmt.Errorf("initial_group_size must be at least 1, got %d", c.InitialGroupSize)
+	}
+	if c.MaxGroups < 1 || c.MaxGroups > MaxGroupsLimit {
+		return fmt.Errorf("max_groups must be between 1 and %d, got %d", MaxGroupsLimit, c.MaxGroups)
+	}
+	if c.AdminID == "" {
+		return fmt.Errorf("admin_id must be set")
+	}
+	switch c.Environment {
+	case EnvDev, EnvStaging, EnvProduction:
+	default:
+		return fmt.Errorf("environment must be dev, staging or production, got %q", c.Environment)
+	}
+	if c.PublicAssetBaseURL != "" {
+		u, err := url.Parse(c.PublicAssetBaseURL)
+		if err != nil || !u.IsAbs() || u.Host == "" {
+			return fmt.Errorf("public_asset_base_url %q must be an absolute URL", c.PublicAssetBaseURL)
+		}
+		if c.Environment == EnvProduction && u.Scheme != "https" {
+			return fmt.Errorf("public_asset_base_url must be https in production")
+		}
+	}
+	for _, rule := range c.AssetRewrites {
+		u, err := url.Parse(rule.To)
+		if err != nil || !u.IsAbs() || u.Host == "" {
+			return fmt.Errorf("asset rewrite target %q must be an absolute URL", rule.To)
+		}
+		if c.Environment == EnvProduction && u.Scheme != "https" {
+			return fmt.Errorf("asset rewrite target %q must be https in production", rule.To)
+		}
+	}
+	if c.GeofenceRadius <= 0 || c.GeofenceRadius > MaxGeofenceRadius {
+		return fmt.Errorf("geofence_radius must be in (0, %v] meters, got %v", MaxGeofenceRadius, c.GeofenceRadius)
+	}
+	if c.GeofenceMinDwell < 0 {
+		return fmt.Errorf("geofence_min_dwell must not be negative")
+	}
+	for key, radius := range map[string]float64{"map_view_radius": c.MapViewRadius, "ar_view_radius": c.ARViewRadius} {
+		if radius <= 0 || radius > MaxViewRadius {
+			return fmt.Errorf("%s must be in (0, %v] meters, got %v", key, MaxViewRadius, radius)
+		}
+	}
+	if c.CoarseTick < 100*time.Millisecond {
+		return fmt.Errorf("coarse_tick must be at least 100ms, got %v", c.CoarseTick)
+	}
+	if c.LocationTick < 50*time.Millisecond || c.LocationTick > time.Second {
+		return fmt.Errorf("location_tick must be between 50ms and 1s, got %v", c.LocationTick)
+	}
+	if c.Environment != EnvDev && c.PublicAssetBaseURL == "" && len(c.AssetRewrites) == 0 {
+		return fmt.Errorf("%s needs public_asset_base_url or asset_url_rewrites", c.Environment)
+	}
+	return nil
+}
+
+// Apply overrides on top of a base config
+func (o ConfigOverrides) apply(c Config) (Config, error) {
+	if o.WPBaseURL != nil {
+		c.WPBaseURL = *o.WPBaseURL
+	}
+	if o.WPCategoryID != nil {
+		c.WPCategoryID = *o.WPCategoryID
+	}
+	if o.BuildingSource != nil {
+		c.BuildingSource = *o.BuildingSource
+	}
+	if o.BuildingSourcePath != nil {
+		c.BuildingSourcePath = *o.BuildingSourcePath
+	}
+	if o.LockRetryCount != nil {
+		c.LockRetryCount = *o.LockRetryCount
+	}
+	if o.InitialGroupSize != nil {
+		c.InitialGroupSize = *o.InitialGroupSize
+	}
+	if o.PublicAssetBaseURL != nil {
+		c.PublicAssetBaseURL = *o.PublicAssetBaseURL
+	}
+	if o.GeofenceRadius != nil {
+		c.GeofenceRadius = *o.GeofenceRadius
+	}
+	if o.MapViewRadius != nil {
+		c.MapViewRadius = *o.MapViewRadius
+	}
+	if o.ARViewRadius != nil {
+		c.ARViewRadius = *o.ARViewRadius
+	}
+	if o.GeofenceMinDwell != nil {
+		d, err := parseDurationValue(*o.GeofenceMinDwell)
+		if err != nil {
+			return c, fmt.Errorf("geofence_min_dwell: %w", err)
+		}
+		c.GeofenceMinDwell = d
+	}
+	if o.ReconcileInterval != nil {
+		d, err := parseDurationValue(*o.ReconcileInterval)
+		if err != nil {
+			return c, fmt.Errorf("reconcile_interval: %w", err)
+		}
+		c.ReconcileInterval = d
+	}
+	if o.LockRetryDelay != nil {
+		d, err := parseDurationValue(*o.LockRetryDelay)
+		if err != nil {
+			return c, fmt.Errorf("lock_retry_delay: %w", err)
+		}
+		c.LockRetryDelay = d
+	}
+	return c, c.Validate()
+}
+
+// Load config from the init context env, then apply any stored admin overrides.
+// Invalid env values fail module init; invalid stored overrides are logged and ignored.
+func loadConfig(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule) error {
+	env, _ := ctx.Value(runtime.RUNTIME_CTX_ENV).(map[string]string)
+	base, err := configFromEnv(env)
+	if err != nil {
+		return fmt.Errorf("invalid runtime config: %w", err)
+	}
+
+	active := base
+	var overrides ConfigOverrides
+	records, err := nk.StorageRead(ctx, []*runtime.StorageRead{{
+		Collection: ConfigCollection,
+		Key:        ConfigOverridesKey,
+		UserID:     "",
+	}})
+	if err != nil {
+		return err
+	}
+	if len(records) > 0 {
+		if err := json.Unmarshal([]byte(records[0].Value), &overrides); err != nil {
+			logger.Error("Ignoring unreadable config overrides: %v", err)
+			overrides = ConfigOverrides{}
+		} else if merged, err := overrides.apply(base); err != nil {
+			logger.Error("Ignoring invalid config overrides: %v", err)
+			overrides = ConfigOverrides{}
+		} else {
+			active = merged
+			logger.Info("Applied config overrides from storage")
+		}
+	}
+
+	configMu.Lock()
+	envConfig = base
+	activeConfig = active
+	activeOverrides = overrides
+	configMu.Unlock()
+
+	logger.Info("Config: env=%s wp=%s category=%d source=%s reconcile=%v max_groups=%d",
+		active.Environment, active.WPBaseURL, active.WPCategoryID, active.BuildingSource, active.ReconcileInterval, active.MaxGroups)
+	return nil
+}
+
+// Only the configured admin user may call admin RPCs
+func requireAdmin(ctx context.Context) error {
+	userID, _ := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+	if userID == "" || userID != cfg().AdminID {
+		return runtime.NewError("admin only", codePermissionDenied)
+	}
+	return nil
+}
+
+// JSON view of the active config for admin RPCs; the webhook secret is never returned
+func configResponse() (string, error) {
+	configMu.RLock()
+	c, o := activeConfig, activeOverrides
+	configMu.RUnlock()
+
+	data, err := json.Marshal(map[string]interface{}{
+		"config": map[string]interface{}{
+			"wp_base_url":           c.WPBaseURL,
+			"wp_category_id":        c.WPCategoryID,
+			"building_source":       c.BuildingSource,
+			"building_source_path":  c.BuildingSourcePath,
+			"reconcile_interval":    c.ReconcileInterval.String(),
+			"lock_retry_count":      c.LockRetryCount,
+			"lock_retry_delay":      c.LockRetryDelay.String(),
+			"initial_group_size":    c.InitialGroupSize,
+			"max_groups":            c.MaxGroups,
+			"stream_mode":           c.StreamMode,
+			"admin_id":              c.AdminID,
+			"environment":           c.Environment,
+			"public_asset_base_url": c.PublicAssetBaseURL,
+			"asset_url_rewrites":    c.AssetRewrites,
+			"geofence_radius":       c.GeofenceRadius,
+			"geofence_min_dwell":    c.GeofenceMinDwell.String(),
+			"map_view_radius":       c.MapViewRadius,
+			"ar_view_radius":        c.ARViewRadius,
+			"coarse_tick":           c.CoarseTick.String(),
+			"location_tick":         c.LocationTick.String(),
+		},
+		"overrides": o,
+	})
+	return string(data), err
+}
+
+// Admin RPC returning the active config and the stored overrides
+func rpcAdminGetConfig(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return "", err
+	}
+	return configResponse()
+}
+
+// Admin RPC replacing the stored overrides. The payload is a ConfigOverrides
+// object; fields left out fall back to the env value, so "{}" resets everything.
+func rpcAdminSetConfig(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return "", err
+	}
+
+	var overrides ConfigOverrides
+	if err := json.Unmarshal([]byte(payload), &overrides); err != nil {
+		return "", runtime.NewError("invalid payload", codeInvalidArgument)
+	}
+
+	configMu.RLock()
+	base := envConfig
+	configMu.RUnlock()
+
+	merged, err := overrides.apply(base)
+	if err != nil {
+		return "", runtime.NewError(err.Error(), codeInvalidArgument)
+	}
+
+	val, _ := json.Marshal(overrides)
+	if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      ConfigCollection,
+		Key:             ConfigOverridesKey,
+		UserID:          "",
+		Value:           string(val),
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}}); err != nil {
+		logger.Error("Failed to store config overrides: %v", err)
+		return "", runtime.NewError("failed to store config", codeInternal)
+	}
+
+	configMu.Lock()
+	activeConfig = merged
+	activeOverrides = overrides
+	configMu.Unlock()
+
+	logger.Info("Config overrides updated: %s", string(val))
+	return configResponse()
+}
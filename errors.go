@@ -0,0 +1,14 @@
+package main
+
+// gRPC status codes used for runtime.NewError, see
+// https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const (
+	codeInvalidArgument    = 3
+	codeNotFound           = 5
+	codePermissionDenied   = 7
+	codeFailedPrecondition = 9
+	codeAborted            = 10
+	codeInternal           = 13
+	codeUnavailable        = 14
+	codeUnauthenticated    = 16
+)
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	ExportGeoJSON = "geojson"
+	ExportKML     = "kml"
+
+	DefaultExportLimit = 500
+	MaxExportLimit     = 2000
+)
+
+type ExportRequest struct {
+	Format         string `json:"format"`
+	IncludeVisits  bool   `json:"include_visits,omitempty"`
+	IncludeHeatmap bool   `json:"include_heatmap,omitempty"`
+	Cursor         string `json:"cursor,omitempty"`
+	Limit          int    `json:"limit,omitempty"`
+}
+
+// Export position: which layer we're in and the storage cursor within it.
+// Buildings come first, then heatmap cells if asked for.
+type exportCursor struct {
+	Layer   string `json:"l"`
+	Storage string `json:"c,omitempty"`
+}
+
+func encodeExportCursor(c exportCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeExportCursor(s string) (exportCursor, error) {
+	c := exportCursor{Layer: "buildings"}
+	if s == "" {
+		return c, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, err
+	}
+	if c.Layer != "buildings" && c.Layer != "heatmap" {
+		return c, fmt.Errorf("unknown layer %q", c.Layer)
+	}
+	return c, nil
+}
+
+// One exported feature, before it's written out in the requested format
+type exportFeature struct {
+	ID         string
+	Name       string
+	Lat, Lon   float64
+	Geometry   *Geometry
+	Properties map[string]interface{}
+}
+
+// Admin RPC exporting buildings (and optionally visit totals and heatmap cells)
+// for GIS tools. Payload: {"format": "geojson"|"kml", "include_visits",
+// "include_heatmap", "cursor", "limit"}. Every page is a complete document,
+// pass the returned cursor back until it comes back empty.
+// Returns {"format", "content", "count", "cursor"}.
+func rpcAdminExportBuildings(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return "", err
+	}
+
+	var req ExportRequest
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &req); err != nil {
+			return "", runtime.NewError("invalid payload", codeInvalidArgument)
+		}
+	}
+	if req.Format == "" {
+		req.Format = ExportGeoJSON
+	}
+	if req.Format != ExportGeoJSON && req.Format != ExportKML {
+		return "", runtime.NewError(fmt.Sprintf("unknown format %q", req.Format), codeInvalidArgument)
+	}
+	if req.Limit <= 0 {
+		req.Limit = DefaultExportLimit
+	}
+	if req.Limit > MaxExportLimit {
+		req.Limit = MaxExportLimit
+	}
+	pos, err := decodeExportCursor(req.Cursor)
+	if err != nil {
+		return "", runtime.NewError("invalid cursor", codeInvalidArgument)
+	}
+
+	var features []exportFeature
+	var next string
+	switch pos.Layer {
+	case "buildings":
+		features, next, err = exportBuildingFeatures(ctx, logger, nk, req, pos.Storage)
+		if err == nil && next == "" && req.IncludeHeatmap {
+			next = encodeExportCursor(exportCursor{Layer: "heatmap"})
+		} else if next != "" {
+			next = encodeExportCursor(exportCursor{Layer: "buildings", Storage: next})
+		}
+	case "heatmap":
+		features, next, err = exportHeatmapFeatures(ctx, nk, req, pos.Storage)
+		if next != "" {
+			next = encodeExportCursor(exportCursor{Layer: "heatmap", Storage: next})
+		}
+	}
+	if err != nil {
+		logger.Error("Export failed: %v", err)
+		return "", runtime.NewError("export failed", codeInternal)
+	}
+
+	var content string
+	if req.Format == ExportKML {
+		content = renderKML(features)
+	} else if content, err = renderGeoJSON(features); err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"format":  req.Format,
+		"content": content,
+		"count":   len(features),
+		"cursor":  next,
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func exportBuildingFeatures(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, req ExportRequest, cursor string) ([]exportFeature, string, error) {
+	objects, next, err := nk.StorageList(ctx, "", "", "buildings", req.Limit, cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var stats map[string]VisitStats
+	if req.IncludeVisits && len(objects) > 0 {
+		reads := make([]*runtime.StorageRead, 0, len(objects))
+		for _, obj := range objects {
+			reads = append(reads, &runtime.StorageRead{Collection: VisitStatsCollection, Key: obj.Key, UserID: ""})
+		}
+		records, err := nk.StorageRead(ctx, reads)
+		if err != nil {
+			return nil, "", err
+		}
+		stats = make(map[string]VisitStats, len(records))
+		for _, r := range records {
+			var s VisitStats
+			if err := json.Unmarshal([]byte(r.Value), &s); err == nil {
+				stats[r.Key] = s
+			}
+		}
+	}
+
+	config := cfg()
+	features := make([]exportFeature, 0, len(objects))
+	for _, obj := range objects {
+		b, err := decodeBuilding(obj.Value)
+		if err != nil {
+			logger.WithField("key", obj.Key).WithField("err", err).Warn("Skipping undecodable stored building in export")
+			continue
+		}
+		_ = b.rewriteAssets(config)
+
+		props := map[string]interface{}{
+			"id":           b.ID,
+			"title":        b.Title,
+			"slug":         b.Slug,
+			"link":         b.Link,
+			"image":        b.Image,
+			"model":        b.Model,
+			"status":       b.Status,
+			"categories":   b.Categories,
+			"modified_gmt": b.ModifiedGMT,
+		}
+		if req.IncludeVisits {
+			s := stats[obj.Key]
+			props["visits"] = s.Visits
+			props["visitors"] = s.Visitors
+			props["total_dwell_seconds"] = s.TotalDwellSeconds
+		}
+		features = append(features, exportFeature{
+			ID:         "building-" + strconv.Itoa(b.ID),
+			Name:       b.Title,
+			Lat:        b.Lat,
+			Lon:        b.Lon,
+			Geometry:   b.Geometry,
+			Properties: props,
+		})
+	}
+	return features, next, nil
+}
+
+func exportHeatmapFeatures(ctx context.Context, nk runtime.NakamaModule, req ExportRequest, cursor string) ([]exportFeature, string, error) {
+	objects, next, err := nk.StorageList(ctx, "", "", HeatmapCollection, req.Limit, cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	features := make([]exportFeature, 0, len(objects))
+	for _, obj := range objects {
+		var c HeatCell
+		if err := json.Unmarshal([]byte(obj.Value), &c); err != nil || c.Size <= 0 {
+			continue
+		}
+		// The cell square, south-west corner first
+		ring := Ring{
+			{c.Lon, c.Lat},
+			{c.Lon + c.Size, c.Lat},
+			{c.Lon + c.Size, c.Lat + c.Size},
+			{c.Lon, c.Lat + c.Size},
+			{c.Lon, c.Lat},
+		}
+		features = append(features, exportFeature{
+			ID:       obj.Key,
+			Name:     obj.Key,
+			Lat:      c.Lat + c.Size/2,
+			Lon:      c.Lon + c.Size/2,
+			Geometry: &Geometry{Type: GeometryPolygon, Polygons: []Polygon{{ring}}},
+			Properties: map[string]interface{}{
+				"layer":        "heatmap",
+				"samples":      c.Samples,
+				"user_minutes": c.UserMinutes,
+				"last_at":      c.LastAt,
+			},
+		})
+	}
+	return features, next, nil
+}
+
+func renderGeoJSON(features []exportFeature) (string, error) {
+	out := make([]map[string]interface{}, 0, len(features))
+	for _, f := range features {
+		var geom interface{} = f.Geometry
+		if f.Geometry == nil {
+			geom = Geometry{Type: GeometryPoint, Point: Position{f.Lon, f.Lat}}
+		}
+		out = append(out, map[string]interface{}{
+			"type":       "Feature",
+			"id":         f.ID,
+			"geometry":   geom,
+			"properties": f.Properties,
+		})
+	}
+	data, err := json.Marshal(map[string]interface{}{"type": "FeatureCollection", "features": out})
+	return string(data), err
+}
+
+func kmlEscape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func kmlCoordinates(ring Ring) string {
+	parts := make([]string, 0, len(ring))
+	for _, p := range ring {
+		parts = append(parts, strconv.FormatFloat(p.Lon(), 'f', -1, 64)+","+strconv.FormatFloat(p.Lat(), 'f', -1, 64)+",0")
+	}
+	return strings.Join(parts, " ")
+}
+
+func kmlPolygon(b *strings.Builder, poly Polygon) {
+	b.WriteString("<Polygon><outerBoundaryIs><LinearRing><coordinates>")
+	b.WriteString(kmlCoordinates(poly[0]))
+	b.WriteString("</coordinates></LinearRing></outerBoundaryIs>")
+	for _, hole := range poly[1:] {
+		b.WriteString("<innerBoundaryIs><LinearRing><coordinates>")
+		b.WriteString(kmlCoordinates(hole))
+		b.WriteString("</coordinates></LinearRing></innerBoundaryIs>")
+	}
+	b.WriteString("</Polygon>")
+}
+
+// KML 2.2 document with one Placemark per feature. Footprints become a
+// MultiGeometry of the point and the polygons; properties go into ExtendedData.
+func renderKML(features []exportFeature) string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	b.WriteString(`<kml xmlns="http://www.opengis.net/kml/2.2"><Document>`)
+	for _, f := range features {
+		fmt.Fprintf(&b, `<Placemark id="%s"><name>%s</name><ExtendedData>`, kmlEscape(f.ID), kmlEscape(f.Name))
+		keys := make([]string, 0, len(f.Properties))
+		for key := range f.Properties {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			var s string
+			switch v := f.Properties[key].(type) {
+			case string:
+				s = v
+			default:
+				data, _ := json.Marshal(v)
+				s = string(data)
+			}
+			fmt.Fprintf(&b, `<Data name="%s"><value>%s</value></Data>`, kmlEscape(key), kmlEscape(s))
+		}
+		b.WriteString("</ExtendedData>")
+
+		point := fmt.Sprintf("<Point><coordinates>%s,%s,0</coordinates></Point>",
+			strconv.FormatFloat(f.Lon, 'f', -1, 64), strconv.FormatFloat(f.Lat, 'f', -1, 64))
+		if f.Geometry.HasArea() {
+			b.WriteString("<MultiGeometry>" + point)
+			for _, poly := range f.Geometry.Polygons {
+				kmlPolygon(&b, poly)
+			}
+			b.WriteString("</MultiGeometry>")
+		} else {
+			b.WriteString(point)
+		}
+		b.WriteString("</Placemark>")
+	}
+	b.WriteString("</Document></kml>")
+	return b.String()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+func TestDecodeExportCursor(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    exportCursor
+		wantErr bool
+	}{
+		{"empty starts at buildings", "", exportCursor{Layer: "buildings"}, false},
+		{"buildings page", encodeExportCursor(exportCursor{Layer: "buildings", Storage: "abc"}), exportCursor{Layer: "buildings", Storage: "abc"}, false},
+		{"heatmap start", encodeExportCursor(exportCursor{Layer: "heatmap"}), exportCursor{Layer: "heatmap"}, false},
+		{"unknown layer", encodeExportCursor(exportCursor{Layer: "visits"}), exportCursor{}, true},
+		{"not base64", "not a cursor!", exportCursor{}, true},
+	}
+	for _, tt := range tests {
+		got, err := decodeExportCursor(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExportPaging(t *testing.T) {
+	nk := newFakeStorage()
+	var writes []*runtime.StorageWrite
+	for _, b := range []Building{
+		{ID: 1, Title: "One", Lat: 45, Lon: 7, Status: "publish"},
+		{ID: 2, Title: "Two", Lat: 45.1, Lon: 7.1, Status: "publish"},
+		{ID: 3, Title: "Three", Lat: 45.2, Lon: 7.2, Status: "publish"},
+	} {
+		val, _ := json.Marshal(b)
+		writes = append(writes, &runtime.StorageWrite{Collection: "buildings", Key: b.Key(), Value: string(val)})
+	}
+	stats, _ := json.Marshal(VisitStats{BuildingID: 2, Visits: 5, Visitors: 3})
+	cell, _ := json.Marshal(HeatCell{Lat: 45, Lon: 7, Size: 0.01, Samples: 4})
+	writes = append(writes,
+		&runtime.StorageWrite{Collection: VisitStatsCollection, Key: "2", Value: string(stats)},
+		&runtime.StorageWrite{Collection: HeatmapCollection, Key: "cell-a", Value: string(cell)},
+	)
+	if _, err := nk.StorageWrite(context.Background(), writes); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), runtime.RUNTIME_CTX_USER_ID, cfg().AdminID)
+	var ids []string
+	visits := make(map[string]float64)
+	cursor := ""
+	for page := 1; ; page++ {
+		if page > 5 {
+			t.Fatal("export never ran out of pages")
+		}
+		payload, _ := json.Marshal(ExportRequest{Format: ExportGeoJSON, IncludeVisits: true, IncludeHeatmap: true, Cursor: cursor, Limit: 2})
+		out, err := rpcAdminExportBuildings(ctx, nopLogger{}, nil, nk, string(payload))
+		if err != nil {
+			t.Fatalf("page %d: %v", page, err)
+		}
+		var resp struct {
+			Content string `json:"content"`
+			Count   int    `json:"count"`
+			Cursor  string `json:"cursor"`
+		}
+		if err := json.Unmarshal([]byte(out), &resp); err != nil {
+			t.Fatalf("page %d: %v", page, err)
+		}
+		var doc struct {
+			Type     string `json:"type"`
+			Features []struct {
+				ID         string                 `json:"id"`
+				Properties map[string]interface{} `json:"properties"`
+			} `json:"features"`
+		}
+		if err := json.Unmarshal([]byte(resp.Content), &doc); err != nil || doc.Type != "FeatureCollection" {
+			t.Fatalf("page %d is not a feature collection: %v %s", page, err, resp.Content)
+		}
+		if resp.Count != len(doc.Features) {
+			t.Errorf("page %d: count %d, %d features", page, resp.Count, len(doc.Features))
+		}
+		for _, f := range doc.Features {
+			ids = append(ids, f.ID)
+			if v, ok := f.Properties["visits"].(float64); ok {
+				visits[f.ID] = v
+			}
+		}
+		if resp.Cursor == "" {
+			break
+		}
+		cursor = resp.Cursor
+	}
+
+	if want := []string{"building-1", "building-2", "building-3", "cell-a"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("exported %v, want %v", ids, want)
+	}
+	if want := map[string]float64{"building-1": 0, "building-2": 5, "building-3": 0}; !reflect.DeepEqual(visits, want) {
+		t.Errorf("visits = %v, want %v", visits, want)
+	}
+}
+
+func TestExportFormats(t *testing.T) {
+	square := Ring{{7, 45}, {7.001, 45}, {7.001, 45.001}, {7, 45.001}, {7, 45}}
+	features := []exportFeature{
+		{ID: "building-1", Name: "Bar & <Grill>", Lat: 45.0005, Lon: 7.0005,
+			Geometry:   &Geometry{Type: GeometryPolygon, Polygons: []Polygon{{square}}},
+			Properties: map[string]interface{}{"title": "Bar & <Grill>", "visits": 2}},
+		{ID: "building-2", Name: "Point only", Lat: 45.5, Lon: 7.5, Properties: map[string]interface{}{}},
+	}
+
+	kml := renderKML(features)
+	dec := xml.NewDecoder(strings.NewReader(kml))
+	for {
+		if _, err := dec.Token(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("KML is not well-formed: %v\n%s", err, kml)
+		}
+	}
+	for _, want := range []string{
+		`<name>Bar &amp; &lt;Grill&gt;</name>`,
+		`<Data name="visits"><value>2</value></Data>`,
+		`<MultiGeometry><Point><coordinates>7.0005,45.0005,0</coordinates></Point><Polygon>`,
+		`<Placemark id="building-2"><name>Point only</name><ExtendedData></ExtendedData><Point><coordinates>7.5,45.5,0</coordinates></Point></Placemark>`,
+	} {
+		if !strings.Contains(kml, want) {
+			t.Errorf("KML lacks %s", want)
+		}
+	}
+
+	content, err := renderGeoJSON(features)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Features []struct {
+			Geometry struct {
+				Type        string          `json:"type"`
+				Coordinates json.RawMessage `json:"coordinates"`
+			} `json:"geometry"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal([]byte(content), &doc); err != nil || len(doc.Features) != 2 {
+		t.Fatalf("GeoJSON: %v %s", err, content)
+	}
+	if g := doc.Features[0].Geometry; g.Type != GeometryPolygon {
+		t.Errorf("footprint exported as %s", g.Type)
+	}
+	if g := doc.Features[1].Geometry; g.Type != GeometryPoint || string(g.Coordinates) != "[7.5,45.5]" {
+		t.Errorf("point exported as %s %s", g.Type, g.Coordinates)
+	}
+}
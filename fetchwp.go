@@ -4,245 +4,416 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"strconv"
 	"fmt"
     "time"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/heroiclabs/nakama-common/runtime"
 )
 
 // WordPress structs
 type WPPost struct {
-	ID   int                    `json:"id"`
-	ACF  map[string]interface{} `json:"acf"`
-	Link string                 `json:"link"`
-	Slug string                 `json:"slug"`
+	ID          int                    `json:"id"`
+	ACF         map[string]interface{} `json:"acf"`
+	Link        string                 `json:"link"`
+	Slug        string                 `json:"slug"`
+	Status      string                 `json:"status"`
+	Categories  []int                  `json:"categories"`
+	Modified    string                 `json:"modified"`
+	ModifiedGMT string                 `json:"modified_gmt"`
+	Title       struct {
+		Rendered string `json:"rendered"`
+	} `json:"title"`
+	// Model URL resolved by the notifier plugin (ACF "model" or the first 3D
+	// asset block); nil when the plugin is too old to register the field
+	NakamaModel *string `json:"nakama_model"`
 }
 
-type WPMedia struct {
-	ID        int    `json:"id"`
-	SourceURL string `json:"source_url"`
+// Sync cursor persisted between runs so incremental syncs only pull changed posts
+type SyncCursor struct {
+	Modified string `json:"modified"`
+	SyncedAt int64  `json:"synced_at"`
 }
 
-// Nakama Building struct
-type Building struct {
-	ID    int     `json:"id"`
-	Lat   float64 `json:"lat"`
-	Lon   float64 `json:"lon"`
-	Image string  `json:"image"`
-}
+// WordPress page size, the REST API maximum
+const wpPerPage = 100
 
-// WordPress endpoints
-const wpCategoryID = 3
-const wpPostsURL = "http://wordpress:80/wp-json/wp/v2/posts?categories=%d&per_page=100"
-const wpMediaURL = "http://wordpress:80/wp-json/wp/v2/media/%d"
+// WP "modified" dates are site-local and have no zone suffix
+const wpDateLayout = "2006-01-02T15:04:05"
 
-// Fetch image URL from WordPress media ID
-func fetchImageURL(id float64) (string, error) {
-	mediaID := int(id)
-	url := fmt.Sprintf(wpMediaURL, mediaID)
-	resp, err := http.Get(url)
-	if err != nil {
-		return "", fmt.Errorf("error fetching media: %w", err)
+// Re-fetch a small window before the cursor so posts saved in the same second aren't missed
+const wpCursorOverlap = time.Minute
+
+const (
+	SyncCollection = "sync"
+	SyncCursorKey  = "wp_cursor"
+)
+
+// BuildingSource backed by the WordPress REST API. The cursor is the newest
+// post "modified" date seen, fed back as modified_after.
+type WordPressSource struct {
+	BaseURL    string
+	CategoryID int
+	Client     *http.Client
+	Media      MediaCache // optional
+}
+
+func NewWordPressSource(baseURL string, categoryID int, media MediaCache) *WordPressSource {
+	return &WordPressSource{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		CategoryID: categoryID,
+		Client:     &http.Client{Timeout: 15 * time.Second},
+		Media:      media,
 	}
-	defer resp.Body.Close()
+}
 
-	body, _ := ioutil.ReadAll(resp.Body)
+func (s *WordPressSource) Name() string { return "wordpress" }
+
+// Build the posts URL for one page, optionally limited to posts modified after a cursor
+func (s *WordPressSource) postsURL(page int, modifiedAfter string) string {
+	q := url.Values{}
+	q.Set("categories", strconv.Itoa(s.CategoryID))
+	q.Set("per_page", strconv.Itoa(wpPerPage))
+	q.Set("page", strconv.Itoa(page))
+	q.Set("orderby", "modified")
+	q.Set("order", "asc")
+	if modifiedAfter != "" {
+		q.Set("modified_after", modifiedAfter)
+	}
+	return s.BaseURL + "/wp-json/wp/v2/posts?" + q.Encode()
+}
 
-	var media WPMedia
-	if err := json.Unmarshal(body, &media); err != nil {
-		return "", fmt.Errorf("error unmarshalling media: %w", err)
+func (s *WordPressSource) get(ctx context.Context, target string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
 	}
+	return s.Client.Do(req)
+}
 
-	return media.SourceURL, nil
+// WordPress is ready once the posts endpoint answers 200
+func (s *WordPressSource) Ready(ctx context.Context) error {
+	resp, err := s.get(ctx, s.postsURL(1, ""))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("WordPress returned status %d", resp.StatusCode)
+	}
+	return nil
 }
 
-// Fetch all buildings from WordPress and return as []Building
-func fetchBuildingsFromWP(logger runtime.Logger) ([]Building, error) {
-	url := fmt.Sprintf(wpPostsURL, wpCategoryID)
-	logger.Info("Fetching WP posts from %s", url)
+// Fetch a single page of posts, returning the posts and the total page count reported by WP
+func (s *WordPressSource) fetchPostsPage(ctx context.Context, logger runtime.Logger, page int, modifiedAfter string) ([]WPPost, int, error) {
+	pageURL := s.postsURL(page, modifiedAfter)
+	logger.Debug("Fetching WP posts from %s", pageURL)
 
-	resp, err := http.Get(url)
+	resp, err := s.get(ctx, pageURL)
 	if err != nil {
-		return nil, fmt.Errorf("error fetching WP posts: %w", err)
+		return nil, 0, fmt.Errorf("error fetching WP posts: %w", err)
 	}
 	defer resp.Body.Close()
 
 	body, _ := ioutil.ReadAll(resp.Body)
-
-	// Log status and raw body for debugging
-	logger.Info("WP response status: %d", resp.StatusCode)
-	logger.Info("WP raw body: %s", string(body))
+	if resp.StatusCode != http.StatusOK {
+		logger.Error("WP posts page %d returned status %d: %s", page, resp.StatusCode, string(body))
+		return nil, 0, fmt.Errorf("WP posts page %d returned status %d", page, resp.StatusCode)
+	}
 
 	var posts []WPPost
 	if err := json.Unmarshal(body, &posts); err != nil {
-		// Log again here in case JSON fails
 		logger.Error("Failed to unmarshal WP posts. Body was: %s", string(body))
-		return nil, fmt.Errorf("error unmarshalling WP posts: %w", err)
+		return nil, 0, fmt.Errorf("error unmarshalling WP posts: %w", err)
 	}
 
-	var buildings []Building
-	for _, post := range posts {
-		acf := post.ACF
-		if acf == nil {
-			continue
+	// Fall back to "keep going while pages are full" if the header is missing
+	totalPages, err := strconv.Atoi(resp.Header.Get("X-WP-TotalPages"))
+	if err != nil {
+		totalPages = page
+		if len(posts) == wpPerPage {
+			totalPages = page + 1
 		}
+	}
+	logger.Debug("WP posts page %d/%d: %d posts (X-WP-Total=%s)", page, totalPages, len(posts), resp.Header.Get("X-WP-Total"))
 
-		lat, _ := acf["lat"].(float64)
-		lon, _ := acf["lon"].(float64)
+	return posts, totalPages, nil
+}
 
+// Fetch buildings from WordPress, following every page. If cursor is set only
+// posts changed after it (minus wpCursorOverlap) are returned. The result cursor
+// is the newest "modified" date seen. Image lookups are batched once all pages
+// are in; posts whose image lookup failed are reported in Failed, posts whose
+// image no longer exists are kept without one.
+func (s *WordPressSource) FetchBuildings(ctx context.Context, logger runtime.Logger, cursor string) (FetchResult, error) {
+	result := FetchResult{Failed: map[int]error{}}
+	modifiedAfter := ""
+	if cursor != "" {
+		modifiedAfter = cursorWithOverlap(cursor)
+	}
+	newest := cursor
+
+	var posts []WPPost
+	for page, totalPages := 1, 1; page <= totalPages; page++ {
+		pagePosts, total, err := s.fetchPostsPage(ctx, logger, page, modifiedAfter)
+		if err != nil {
+			return result, err
+		}
+		totalPages = total
+
+		for _, post := range pagePosts {
+			if post.Modified > newest {
+				newest = post.Modified
+			}
+			if post.ACF != nil {
+				posts = append(posts, post)
+			}
+		}
+	}
+
+	images, mediaErrors := s.resolveMedia(ctx, logger, postMediaIDs(posts))
+
+	for _, post := range posts {
 		var imageURL string
-		if imgID, ok := acf["image"].(float64); ok {
-			url, err := fetchImageURL(imgID)
-			if err != nil {
-				logger.Error("Failed to fetch image for ID %v: %v", imgID, err)
-			} else {
-				imageURL = url
+		if imgID, ok := post.ACF["image"].(float64); ok && imgID > 0 {
+			if err, failed := mediaErrors[int(imgID)]; failed && errors.Is(err, errMediaNotFound) {
+				logger.Warn("Image %d of post %d no longer exists, storing it without an image", int(imgID), post.ID)
+			} else if failed {
+				logger.Error("Failed to resolve image %d for post %d: %v", int(imgID), post.ID, err)
+				result.Failed[post.ID] = err
+				continue
 			}
+			imageURL = images[int(imgID)]
+		}
+
+		b, err := buildingFromWPPost(post, imageURL)
+		if err != nil {
+			logger.Error("Skipping invalid WP building: %v", err)
+			continue
+		}
+		result.Buildings = append(result.Buildings, b)
+	}
+
+	result.Cursor = newest
+	logger.Info("Fetched %d buildings from WordPress (%d failed)", len(result.Buildings), len(result.Failed))
+	return result, nil
+}
+
+// Read the last successful sync cursor, empty if we never synced
+func readSyncCursor(ctx context.Context, nk runtime.NakamaModule) (SyncCursor, error) {
+	var cursor SyncCursor
+	records, err := nk.StorageRead(ctx, []*runtime.StorageRead{{
+		Collection: SyncCollection,
+		Key:        SyncCursorKey,
+		UserID:     "",
+	}})
+	if err != nil {
+		return cursor, err
+	}
+	if len(records) == 0 {
+		return cursor, nil
+	}
+	if err := json.Unmarshal([]byte(records[0].Value), &cursor); err != nil {
+		return SyncCursor{}, fmt.Errorf("error unmarshalling sync cursor: %w", err)
+	}
+	return cursor, nil
+}
+
+func writeSyncCursor(ctx context.Context, nk runtime.NakamaModule, cursor SyncCursor) error {
+	val, _ := json.Marshal(cursor)
+	_, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      SyncCollection,
+		Key:             SyncCursorKey,
+		UserID:          "",
+		Value:           string(val),
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}})
+	return err
+}
+
+// Step a cursor back by wpCursorOverlap, keeping WP's zone-less format
+func cursorWithOverlap(modified string) string {
+	t, err := time.Parse(wpDateLayout, modified)
+	if err != nil {
+		return modified
+	}
+	return t.Add(-wpCursorOverlap).Format(wpDateLayout)
+}
+
+// Pull buildings from the source into storage. With incremental set, only
+// buildings changed since the saved cursor are fetched; otherwise everything is.
+// The cursor only advances once the writes succeeded.
+func syncBuildings(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, source BuildingSource, incremental bool) (int, error) {
+	var since string
+	if incremental {
+		cursor, err := readSyncCursor(ctx, nk)
+		if err != nil {
+			return 0, err
+		}
+		since = cursor.Modified
+	}
+	if since != "" {
+		logger.Info("Incremental %s sync, fetching buildings modified after %s", source.Name(), since)
+	} else {
+		logger.Info("Full %s sync, fetching all buildings", source.Name())
+	}
+
+	fetched, err := source.FetchBuildings(ctx, logger, since)
+	if err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for _, b := range fetched.Buildings {
+		err := upsertBuilding(ctx, logger, nk, &b)
+		if err == errStaleBuilding {
+			continue
 		}
+		if err != nil {
+			return written, err
+		}
+		written++
+	}
 
-		buildings = append(buildings, Building{
-			ID:    post.ID,
-			Lat:   lat,
-			Lon:   lon,
-			Image: imageURL,
-		})
+	// Keep the old cursor if anything failed so the next pass retries it
+	recordSyncFailures(len(fetched.Failed))
+	if len(fetched.Failed) > 0 {
+		logger.Warn("%d buildings failed to sync, not advancing cursor", len(fetched.Failed))
+	} else if fetched.Cursor != "" {
+		if err := writeSyncCursor(ctx, nk, SyncCursor{Modified: fetched.Cursor, SyncedAt: time.Now().Unix()}); err != nil {
+			logger.Error("Failed to save sync cursor: %v", err)
+		}
 	}
 
-	logger.Info("Fetched %d buildings from WordPress", len(buildings))
-	return buildings, nil
+	return written, nil
 }
 
 // RPC called by WordPress to push updates
 func rpcWpPushBuilding(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
-    logger.Error("PAYLOAD: %s", payload)
+    // Only accept pushes signed by WordPress with the shared secret
+    if err := verifyWebhook(ctx, logger, nk, payload); err != nil {
+        return "", err
+    }
+    logger.Debug("PAYLOAD: %s", payload)
 
     // Parse payload
-    var data struct {
-        ID     int     `json:"id"`
-        Lat    string  `json:"lat,omitempty"`
-        Lon    string  `json:"lon,omitempty"`
-        Image  string  `json:"image,omitempty"`
-        Title  string  `json:"title,omitempty"`
-        Status string  `json:"status,omitempty"`
-    }
+    var data BuildingPush
     if err := json.Unmarshal([]byte(payload), &data); err != nil {
         logger.Error("Failed to parse building payload: %v", err)
-        return "", err
+        return "", runtime.NewError("invalid payload", codeInvalidArgument)
+    }
+    if data.ID <= 0 {
+        return "", runtime.NewError("invalid building id", codeInvalidArgument)
     }
 
-    key := fmt.Sprintf("%d", data.ID)
+    // Out-of-order save_post, storage already has something newer
+    stale, err := isStalePush(ctx, nk, data.ID, data.ModifiedGMT)
+    if err != nil {
+        logger.Error("Failed to read building %d: %v", data.ID, err)
+        return "", err
+    }
+    if stale {
+        return `{"success":true,"stale":true}`, nil
+    }
 
     switch data.Status {
-    case "delete", "trash":
-        // Remove from storage
-        err := nk.StorageDelete(ctx, []*runtime.StorageDelete{
-            {Collection: "buildings", Key: key, UserID: ""},
-        })
-        if err != nil {
+    case "delete":
+        // Permanently deleted in WordPress
+        if err := purgeBuilding(ctx, logger, nk, data.ID); err != nil {
             logger.Error("Failed to delete building from storage: %v", err)
             return "", err
         }
 
-        // Notify clients
-        content := map[string]interface{}{"data": map[string]interface{}{"id": data.ID}}
-        if err := nk.NotificationSendAll(ctx, "building_delete", content, 1, false); err != nil {
-            logger.Error("Failed to send delete notification: %v", err)
+    case "update", StatusPublish:
+        // Validate before touching storage, never store a 0,0 building
+        b, err := buildingFromPush(data)
+        if err != nil {
+            logger.Error("Rejected building push for %d: %v", data.ID, err)
+            return "", runtime.NewError(err.Error(), codeInvalidArgument)
         }
-
-    case "update", "publish":
-        // Convert Lat/Lon to float
-        var latF, lonF float64
-        if data.Lat != "" {
-            if v, err := strconv.ParseFloat(data.Lat, 64); err == nil {
-                latF = v
-            } else {
-                logger.Error("Invalid lat value: %v", data.Lat)
+        if err := publishBuilding(ctx, logger, nk, b); err != nil {
+            if err == errStaleBuilding {
+                return `{"success":true,"stale":true}`, nil
             }
+            logger.Error("Failed to write building to storage: %v", err)
+            return "", err
         }
-        if data.Lon != "" {
-            if v, err := strconv.ParseFloat(data.Lon, 64); err == nil {
-                lonF = v
-            } else {
-                logger.Error("Invalid lon value: %v", data.Lon)
+
+    case StatusDraft, StatusAutoDraft, StatusPending, StatusPrivate, StatusFuture, StatusTrash:
+        var publishAt time.Time
+        if data.Status == StatusFuture {
+            if publishAt = parseModifiedGMT(data.DateGMT); publishAt.IsZero() {
+                return "", runtime.NewError("future post without a valid date_gmt", codeInvalidArgument)
             }
         }
 
-        // Save/update in storage
-        b := map[string]interface{}{
-            "id":    data.ID,
-            "lat":   latF,
-            "lon":   lonF,
-            "image": data.Image,
-            "title": data.Title,
-            "status": data.Status,
+        // Drafts may not have coordinates yet, then there's nothing worth keeping
+        var hidden *Building
+        if b, err := buildingFromPush(data); err == nil {
+            hidden = &b
+        } else {
+            logger.Debug("Not keeping a hidden copy of building %d: %v", data.ID, err)
         }
-        val, _ := json.Marshal(b)
-        record := &runtime.StorageWrite{
-            Collection: "buildings",
-            Key:        key,
-            UserID:     "",
-            Value:      string(val),
+        if err := hideBuilding(ctx, logger, nk, data.ID, data.Status, hidden); err != nil {
+            logger.Error("Failed to hide building %d: %v", data.ID, err)
+            return "", err
         }
-        if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{record}); err != nil {
-            logger.Error("Failed to write building to storage: %v", err)
+
+        if data.Status == StatusFuture {
+            if err := scheduleBuilding(ctx, nk, data.ID, publishAt); err != nil {
+                logger.Error("Failed to schedule building %d: %v", data.ID, err)
+                return "", err
+            }
+            logger.Info("Building %d scheduled to appear at %s", data.ID, publishAt.Format(time.RFC3339))
+        }
+
+    case "untrash":
+        // Restore the copy kept when it was trashed, falling back to the pushed fields
+        b, err := readHiddenBuilding(ctx, nk, data.ID)
+        if err != nil {
+            logger.Error("Failed to read trashed building %d: %v", data.ID, err)
             return "", err
         }
+        if b == nil {
+            pushed, err := buildingFromPush(data)
+            if err != nil {
+                return "", runtime.NewError(fmt.Sprintf("nothing to restore for building %d", data.ID), codeNotFound)
+            }
+            b = &pushed
+        }
 
-        // Notify clients
-        content := map[string]interface{}{"data": b}
-        if err := nk.NotificationSendAll(ctx, "building_update", content, 1, false); err != nil {
-            logger.Error("Failed to send update notification: %v", err)
+        // WordPress restores to draft unless told otherwise
+        restore := data.RestoreStatus
+        if restore == "" {
+            restore = StatusDraft
+        }
+        if restore == StatusPublish {
+            if err := publishBuilding(ctx, logger, nk, *b); err != nil && err != errStaleBuilding {
+                logger.Error("Failed to restore building %d: %v", data.ID, err)
+                return "", err
+            }
+        } else {
+            b.Status = restore
+            if err := writeHiddenBuilding(ctx, logger, nk, b); err != nil {
+                logger.Error("Failed to restore building %d: %v", data.ID, err)
+                return "", err
+            }
         }
 
     default:
         logger.Error("Unknown status in payload: %v", data.Status)
-        return "", fmt.Errorf("unknown status: %s", data.Status)
+        return "", runtime.NewError(fmt.Sprintf("unknown status: %s", data.Status), codeInvalidArgument)
     }
 
     return `{"success":true}`, nil
 }
 
-// RPC for clients to fetch all buildings from Nakama Storage
-func rpcGetBuildings(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
-	objects, _, err := nk.StorageList(ctx, "", "", "buildings", 1000, "")
-	if err != nil {
-		return "", err
-	}
-
-	var buildings []Building
-	for _, obj := range objects {
-		var b Building
-		if err := json.Unmarshal([]byte(obj.Value), &b); err == nil {
-			buildings = append(buildings, b)
-		}
-	}
-
-	data, _ := json.Marshal(buildings)
-	return string(data), nil
-}
-
-// Wait for WordPress to respond before initial fetch
-func waitForWP(logger runtime.Logger, url string, timeout time.Duration) error {
-	deadline := time.Now().Add(timeout)
-	for time.Now().Before(deadline) {
-		resp, err := http.Get(url)
-		if err == nil && resp.StatusCode == 200 {
-			resp.Body.Close()
-			logger.Info("WordPress is up!")
-			return nil
-		}
-		if resp != nil {
-			resp.Body.Close()
-		}
-		logger.Info("Waiting for WordPress...")
-		time.Sleep(2 * time.Second)
-	}
-	return fmt.Errorf("WordPress did not respond in %v", timeout)
-}
-
 // Module initializer
 func InitBuildings(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, initializer runtime.Initializer) error {
 	// Register RPCs
@@ -252,41 +423,57 @@ func InitBuildings(ctx context.Context, logger runtime.Logger, db *sql.DB, nk ru
 	if err := initializer.RegisterRpc("get_buildings", rpcGetBuildings); err != nil {
 		return err
 	}
-
-	// Wait for WordPress
-	wpURL := fmt.Sprintf(wpPostsURL, wpCategoryID)
-	if err := waitForWP(logger, wpURL, time.Minute); err != nil {
+	if err := initializer.RegisterRpc("wp_rotate_webhook_secret", rpcRotateWebhookSecret); err != nil {
 		return err
 	}
-
-	// Populate storage if empty
-	objects, _, err := nk.StorageList(ctx, "", "", "buildings", 1, "")
-	if err != nil {
+	if err := initializer.RegisterRpc("get_buildings_status", rpcGetBuildingsStatus); err != nil {
 		return err
 	}
-	if len(objects) == 0 {
-		logger.Info("No buildings in storage, fetching initial data from WordPress...")
-		buildings, err := fetchBuildingsFromWP(logger)
-		if err != nil {
-			return err
-		}
-		var writes []*runtime.StorageWrite
-		for _, b := range buildings {
-			val, _ := json.Marshal(b)
-			writes = append(writes, &runtime.StorageWrite{
-				Collection: "buildings",
-				Key:        fmt.Sprintf("%d", b.ID),
-                UserID:     "",
-				Value:      string(val),
-			})
-		}
-		if len(writes) > 0 {
-			if _, err := nk.StorageWrite(ctx, writes); err != nil {
-				return err
-			}
-			logger.Info("Initial buildings saved to storage")
-		}
+	if err := initializer.RegisterRpc("get_buildings_nearby", rpcGetBuildingsNearby); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("get_buildings_changes", rpcGetBuildingsChanges); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("redeem_preview_token", rpcRedeemPreviewToken); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("get_preview_buildings", rpcGetPreviewBuildings); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("admin_export_buildings", rpcAdminExportBuildings); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("get_anchor", rpcGetAnchor); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("admin_reconcile_buildings", rpcAdminReconcileBuildings); err != nil {
+		return err
+	}
+
+	// Serve nearby queries from whatever storage already has
+	if err := loadBuildingIndex(ctx, logger, nk); err != nil {
+		logger.Error("Failed to load spatial index: %v", err)
+	}
+
+	if err := initWebhookSecrets(ctx, logger, nk); err != nil {
+		return err
 	}
+	startNonceJanitor(logger, nk)
+
+	// Initial sync runs in the background so a down WordPress doesn't block module load
+	startBuildingBootstrap(logger, nk)
+
+	// Catch anything the push RPC missed
+	startReconciler(logger, nk)
+	startTombstoneJanitor(logger, nk)
+	startBuildingScheduler(logger, nk)
+	startPreviewJanitor(logger, nk)
+	startGeofenceJanitor(logger, nk)
+	startHeatmapFlusher(logger, nk)
+	startCoarseFlusher(logger, nk)
+	startLocationBatcher(logger, nk)
+	startPositionCacheJanitor(logger)
 
 	logger.Info("Buildings module initialized")
 	return nil
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Fake WordPress serving posts and media from maps
+func newFakeWordPress(t *testing.T, posts []map[string]interface{}, media map[string]WPMedia) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/wp-json/wp/v2/posts":
+			w.Header().Set("X-WP-TotalPages", "1")
+			json.NewEncoder(w).Encode(posts)
+		case "/wp-json/wp/v2/media":
+			var found []WPMedia
+			for _, id := range strings.Split(r.URL.Query().Get("include"), ",") {
+				if m, ok := media[id]; ok {
+					found = append(found, m)
+				}
+			}
+			json.NewEncoder(w).Encode(found)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func wpPost(id int, title string, acf map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"id":           id,
+		"status":       "publish",
+		"modified":     "2024-05-01T10:00:00",
+		"modified_gmt": "2024-05-01T10:00:00",
+		"title":        map[string]string{"rendered": title},
+		"acf":          acf,
+	}
+}
+
+func TestWordPressSourceFetchBuildings(t *testing.T) {
+	server := newFakeWordPress(t, []map[string]interface{}{
+		wpPost(1, "Town &amp; Gown", map[string]interface{}{"lat": "41.1", "lon": "-8.6", "image": 10}),
+		wpPost(2, "No coordinates", map[string]interface{}{"lat": "", "lon": ""}),
+		wpPost(3, "Plain", map[string]interface{}{"lat": 41.2, "lon": -8.7}),
+	}, map[string]WPMedia{
+		"10": {ID: 10, SourceURL: "http://wp.example/img.png"},
+	})
+	defer server.Close()
+
+	source := NewWordPressSource(server.URL, 3, nil)
+	if err := source.Ready(context.Background()); err != nil {
+		t.Fatalf("Ready: %v", err)
+	}
+	fetched, err := source.FetchBuildings(context.Background(), nopLogger{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fetched.Buildings) != 2 {
+		t.Fatalf("got %d buildings, want 2 (post without coordinates skipped)", len(fetched.Buildings))
+	}
+	first := fetched.Buildings[0]
+	if first.Title != "Town & Gown" || first.Image != "http://wp.example/img.png" || first.Lat != 41.1 {
+		t.Errorf("unexpected first building: %+v", first)
+	}
+	if fetched.Cursor != "2024-05-01T10:00:00" {
+		t.Errorf("cursor = %q", fetched.Cursor)
+	}
+	if len(fetched.Failed) != 0 {
+		t.Errorf("unexpected failures: %v", fetched.Failed)
+	}
+}
+
+func TestWordPressSourceNotReady(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	source := NewWordPressSource(server.URL, 3, nil)
+	if err := source.Ready(context.Background()); err == nil {
+		t.Fatal("Ready succeeded against a 503")
+	}
+	if _, err := source.FetchBuildings(context.Background(), nopLogger{}, ""); err == nil {
+		t.Fatal("FetchBuildings succeeded against a 503")
+	}
+}
+
+func TestWordPressSourceMissingMedia(t *testing.T) {
+	server := newFakeWordPress(t, []map[string]interface{}{
+		wpPost(1, "Lost image", map[string]interface{}{"lat": "41.1", "lon": "-8.6", "image": 99}),
+	}, map[string]WPMedia{})
+	defer server.Close()
+
+	fetched, err := NewWordPressSource(server.URL, 3, nil).FetchBuildings(context.Background(), nopLogger{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fetched.Failed) != 0 {
+		t.Errorf("deleted media reported as failed: %v", fetched.Failed)
+	}
+	if len(fetched.Buildings) != 1 || fetched.Buildings[0].Image != "" {
+		t.Errorf("want the building stored without an image, got %+v", fetched.Buildings)
+	}
+}
+
+func TestWordPressSourceMediaOutage(t *testing.T) {
+	posts := []map[string]interface{}{
+		wpPost(1, "Has image", map[string]interface{}{"lat": "41.1", "lon": "-8.6", "image": 10}),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/wp-json/wp/v2/media" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		json.NewEncoder(w).Encode(posts)
+	}))
+	defer server.Close()
+
+	fetched, err := NewWordPressSource(server.URL, 3, nil).FetchBuildings(context.Background(), nopLogger{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, failed := fetched.Failed[1]; !failed || len(fetched.Buildings) != 0 {
+		t.Errorf("media outage should hold the building back, got failed=%v buildings=%d", fetched.Failed, len(fetched.Buildings))
+	}
+}
+
+func TestBuildingFromWPPostModel(t *testing.T) {
+	blockModel := "http://wp.example/block.glb"
+	tests := []struct {
+		name  string
+		field *string
+		acf   interface{}
+		want  string
+	}{
+		{"resolved by the plugin", &blockModel, nil, blockModel},
+		{"plugin field wins over ACF", &blockModel, "http://wp.example/acf.glb", blockModel},
+		{"older plugin, ACF only", nil, "http://wp.example/acf.glb", "http://wp.example/acf.glb"},
+		{"no model", nil, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var post WPPost
+			post.ID = 1
+			post.ACF = map[string]interface{}{"lat": "41.1", "lon": "-8.6", "model": tt.acf}
+			post.NakamaModel = tt.field
+			b, err := buildingFromWPPost(post, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b.Model != tt.want {
+				t.Errorf("model = %q, want %q", b.Model, tt.want)
+			}
+		})
+	}
+}
+
+// MediaCache kept in a map
+type memMediaCache map[int]CachedMedia
+
+func (c memMediaCache) Get(ctx context.Context, ids []int) (map[int]CachedMedia, error) {
+	found := make(map[int]CachedMedia)
+	for _, id := range ids {
+		if e, ok := c[id]; ok {
+			found[id] = e
+		}
+	}
+	return found, nil
+}
+
+func (c memMediaCache) Put(ctx context.Context, entries []CachedMedia) error {
+	for _, e := range entries {
+		c[e.ID] = e
+	}
+	return nil
+}
+
+func (c memMediaCache) Delete(ctx context.Context, ids []int) error {
+	for _, id := range ids {
+		delete(c, id)
+	}
+	return nil
+}
+
+func TestResolveMediaRechecksStaleEntries(t *testing.T) {
+	server := newFakeWordPress(t, nil, map[string]WPMedia{
+		"10": {ID: 10, SourceURL: "http://wp.example/new.png", ModifiedGMT: "2024-06-01T00:00:00"},
+	})
+	defer server.Close()
+
+	fresh := time.Now().Unix()
+	stale := time.Now().Add(-MediaCacheTTL - time.Minute).Unix()
+	cache := memMediaCache{
+		10: {ID: 10, URL: "http://wp.example/old.png", ModifiedGMT: "2024-06-01T00:00:00", FetchedAt: stale},
+		11: {ID: 11, URL: "http://wp.example/deleted.png", FetchedAt: stale},
+		12: {ID: 12, URL: "http://wp.example/recent.png", FetchedAt: fresh},
+	}
+	source := NewWordPressSource(server.URL, 3, cache)
+	urls, failed := source.resolveMedia(context.Background(), nopLogger{}, []int{10, 11, 12})
+
+	tests := []struct {
+		id       int
+		wantURL  string
+		wantGone bool
+	}{
+		{10, "http://wp.example/new.png", false},
+		// Deleted in WordPress: dropped once the entry is stale
+		{11, "", true},
+		// Fresh entries are only checked for edits, so they're still served
+		{12, "http://wp.example/recent.png", false},
+	}
+	for _, tt := range tests {
+		if urls[tt.id] != tt.wantURL {
+			t.Errorf("media %d: url = %q, want %q", tt.id, urls[tt.id], tt.wantURL)
+		}
+		if gone := errors.Is(failed[tt.id], errMediaNotFound); gone != tt.wantGone {
+			t.Errorf("media %d: error = %v, want not found %v", tt.id, failed[tt.id], tt.wantGone)
+		}
+		if _, cachedStill := cache[tt.id]; cachedStill == tt.wantGone {
+			t.Errorf("media %d: still cached = %v", tt.id, cachedStill)
+		}
+	}
+	if cache[10].FetchedAt == stale {
+		t.Error("re-checked media 10 kept its old fetch time")
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// BuildingSource reading a local GeoJSON FeatureCollection (.geojson/.json) or
+// CSV (.csv) file, for running the module offline without a WordPress container.
+//
+// GeoJSON features need a Point, Polygon or MultiPolygon geometry and an integer
+// "id" property (footprints are placed at their centroid); "title",
+// "slug", "link", "image", "status" and "modified_gmt" properties are optional.
+// CSV files need a header row with at least id,lat,lon and may carry the same
+// optional columns.
+type FileSource struct {
+	Path string
+}
+
+func NewFileSource(path string) *FileSource {
+	return &FileSource{Path: path}
+}
+
+func (s *FileSource) Name() string { return "file" }
+
+func (s *FileSource) Ready(ctx context.Context) error {
+	_, err := os.Stat(s.Path)
+	return err
+}
+
+func (s *FileSource) FetchBuildings(ctx context.Context, logger runtime.Logger, cursor string) (FetchResult, error) {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return FetchResult{}, err
+	}
+	defer f.Close()
+
+	var buildings []Building
+	switch strings.ToLower(filepath.Ext(s.Path)) {
+	case ".geojson", ".json":
+		buildings, err = readGeoJSONBuildings(f, logger)
+	case ".csv":
+		buildings, err = readCSVBuildings(f, logger)
+	default:
+		err = fmt.Errorf("unsupported building file type %q", filepath.Ext(s.Path))
+	}
+	if err != nil {
+		return FetchResult{}, fmt.Errorf("error reading %s: %w", s.Path, err)
+	}
+
+	logger.Info("Loaded %d buildings from %s", len(buildings), s.Path)
+	return FetchResult{Buildings: buildings}, nil
+}
+
+func readGeoJSONBuildings(r io.Reader, logger runtime.Logger) ([]Building, error) {
+	var fc struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Geometry json.RawMessage `json:"geometry"`
+			Properties struct {
+				ID          int    `json:"id"`
+				Title       string `json:"title"`
+				Slug        string `json:"slug"`
+				Link        string `json:"link"`
+				Image       string `json:"image"`
+				Status      string `json:"status"`
+				ModifiedGMT string `json:"modified_gmt"`
+			} `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.NewDecoder(r).Decode(&fc); err != nil {
+		return nil, err
+	}
+	if fc.Type != "FeatureCollection" {
+		return nil, fmt.Errorf("expected a FeatureCollection, got %q", fc.Type)
+	}
+
+	var buildings []Building
+	for i, feat := range fc.Features {
+		geom, err := parseGeometryField(feat.Geometry)
+		if err != nil || geom == nil {
+			logger.Error("Skipping feature %d: geometry must be a Point, Polygon or MultiPolygon (%v)", i, err)
+			continue
+		}
+		p := feat.Properties
+		b := Building{
+			ID:          p.ID,
+			Title:       p.Title,
+			Slug:        p.Slug,
+			Link:        p.Link,
+			Image:       p.Image,
+			Status:      p.Status,
+			ModifiedGMT: p.ModifiedGMT,
+		}
+		b.Lat, b.Lon = geom.Centroid()
+		if geom.HasArea() {
+			b.Geometry = geom
+		}
+		if err := b.normalize(); err != nil {
+			logger.Error("Skipping feature %d: %v", i, err)
+			continue
+		}
+		buildings = append(buildings, b)
+	}
+	return buildings, nil
+}
+
+func readCSVBuildings(r io.Reader, logger runtime.Logger) ([]Building, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	cols := make(map[string]int, len(header))
+	for i, name := range header {
+		cols[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"id", "lat", "lon"} {
+		if _, ok := cols[required]; !ok {
+			return nil, fmt.Errorf("missing %q column", required)
+		}
+	}
+
+	var buildings []Building
+	for line := 2; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			if i, ok := cols[name]; ok && i < len(row) {
+				return row[i]
+			}
+			return ""
+		}
+
+		id, err := strconv.Atoi(field("id"))
+		if err != nil {
+			logger.Error("Skipping CSV line %d: invalid id %q", line, field("id"))
+			continue
+		}
+		b, err := buildingFromPush(BuildingPush{
+			ID:          id,
+			Title:       field("title"),
+			Slug:        field("slug"),
+			Link:        field("link"),
+			Lat:         field("lat"),
+			Lon:         field("lon"),
+			Image:       field("image"),
+			Status:      field("status"),
+			ModifiedGMT: field("modified_gmt"),
+		})
+		if err != nil {
+			logger.Error("Skipping CSV line %d: %v", line, err)
+			continue
+		}
+		buildings = append(buildings, b)
+	}
+	return buildings, nil
+}
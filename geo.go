@@ -0,0 +1,130 @@
+package main
+
+import "math"
+
+// Mean Earth radius used for great-circle math
+const earthRadiusMeters = 6371008.8
+
+// Approximate length of one degree of latitude
+const metersPerDegreeLat = 111320.0
+
+func toRadians(deg float64) float64 { return deg * math.Pi / 180 }
+func toDegrees(rad float64) float64 { return rad * 180 / math.Pi }
+
+// Great-circle distance in meters between two WGS84 points (haversine)
+func haversineMeters(lat1, lon1, lat2, lon2 float64) float64 {
+	dLat := toRadians(lat2 - lat1)
+	dLon := toRadians(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// Initial bearing in degrees clockwise from true north, 0..360, going from point 1 to point 2
+func initialBearing(lat1, lon1, lat2, lon2 float64) float64 {
+	phi1, phi2 := toRadians(lat1), toRadians(lat2)
+	dLon := toRadians(lon2 - lon1)
+	y := math.Sin(dLon) * math.Cos(phi2)
+	x := math.Cos(phi1)*math.Sin(phi2) - math.Sin(phi1)*math.Cos(phi2)*math.Cos(dLon)
+	return math.Mod(toDegrees(math.Atan2(y, x))+360, 360)
+}
+
+// Bounding boxes around a point that together contain every point within
+// radius meters. A circle crossing the antimeridian is split into one box on
+// each side of it; one reaching a pole covers every longitude.
+func boundingBoxesAround(lat, lon, radius float64) []BoundingBox {
+	dLat := radius / metersPerDegreeLat
+	cosLat := math.Cos(toRadians(lat))
+	dLon := 180.0
+	if cosLat > 1e-6 {
+		dLon = math.Min(180, radius/(metersPerDegreeLat*cosLat))
+	}
+	box := BoundingBox{
+		MinLat: math.Max(-90, lat-dLat),
+		MaxLat: math.Min(90, lat+dLat),
+		MinLon: lon - dLon,
+		MaxLon: lon + dLon,
+	}
+
+	switch {
+	case dLon >= 180 || box.MinLat == -90 || box.MaxLat == 90:
+		box.MinLon, box.MaxLon = -180, 180
+	case box.MinLon < -180:
+		east := box
+		east.MinLon, east.MaxLon = box.MinLon+360, 180
+		box.MinLon = -180
+		return []BoundingBox{box, east}
+	case box.MaxLon > 180:
+		west := box
+		west.MinLon, west.MaxLon = -180, box.MaxLon-360
+		box.MaxLon = 180
+		return []BoundingBox{box, west}
+	}
+	return []BoundingBox{box}
+}
+
+// WGS84 ellipsoid
+const (
+	wgs84A  = 6378137.0
+	wgs84F  = 1 / 298.257223563
+	wgs84E2 = wgs84F * (2 - wgs84F)
+)
+
+// Geodetic (degrees, meters above the ellipsoid) to Earth-centered, Earth-fixed meters
+func geodeticToECEF(lat, lon, alt float64) (x, y, z float64) {
+	phi, lambda := toRadians(lat), toRadians(lon)
+	sinPhi := math.Sin(phi)
+	n := wgs84A / math.Sqrt(1-wgs84E2*sinPhi*sinPhi)
+	x = (n + alt) * math.Cos(phi) * math.Cos(lambda)
+	y = (n + alt) * math.Cos(phi) * math.Sin(lambda)
+	z = (n*(1-wgs84E2) + alt) * sinPhi
+	return x, y, z
+}
+
+// ECEF back to geodetic, iterating on latitude (converges to well under a
+// millimeter in a few rounds near the surface)
+func ecefToGeodetic(x, y, z float64) (lat, lon, alt float64) {
+	lon = math.Atan2(y, x)
+	p := math.Hypot(x, y)
+	phi := math.Atan2(z, p*(1-wgs84E2))
+	for i := 0; i < 5; i++ {
+		sinPhi := math.Sin(phi)
+		n := wgs84A / math.Sqrt(1-wgs84E2*sinPhi*sinPhi)
+		alt = p/math.Cos(phi) - n
+		phi = math.Atan2(z, p*(1-wgs84E2*n/(n+alt)))
+	}
+	sinPhi := math.Sin(phi)
+	n := wgs84A / math.Sqrt(1-wgs84E2*sinPhi*sinPhi)
+	alt = p/math.Cos(phi) - n
+	return toDegrees(phi), toDegrees(lon), alt
+}
+
+// Offset of a point from a reference, in meters east/north/up of the reference
+func geodeticToENU(lat, lon, alt, refLat, refLon, refAlt float64) (east, north, up float64) {
+	x, y, z := geodeticToECEF(lat, lon, alt)
+	rx, ry, rz := geodeticToECEF(refLat, refLon, refAlt)
+	dx, dy, dz := x-rx, y-ry, z-rz
+
+	phi, lambda := toRadians(refLat), toRadians(refLon)
+	sinPhi, cosPhi := math.Sin(phi), math.Cos(phi)
+	sinLambda, cosLambda := math.Sin(lambda), math.Cos(lambda)
+
+	east = -sinLambda*dx + cosLambda*dy
+	north = -sinPhi*cosLambda*dx - sinPhi*sinLambda*dy + cosPhi*dz
+	up = cosPhi*cosLambda*dx + cosPhi*sinLambda*dy + sinPhi*dz
+	return east, north, up
+}
+
+// Point east/north/up meters from a reference, back in geodetic coordinates
+func enuToGeodetic(east, north, up, refLat, refLon, refAlt float64) (lat, lon, alt float64) {
+	phi, lambda := toRadians(refLat), toRadians(refLon)
+	sinPhi, cosPhi := math.Sin(phi), math.Cos(phi)
+	sinLambda, cosLambda := math.Sin(lambda), math.Cos(lambda)
+
+	dx := -sinLambda*east - sinPhi*cosLambda*north + cosPhi*cosLambda*up
+	dy := cosLambda*east - sinPhi*sinLambda*north + cosPhi*sinLambda*up
+	dz := cosPhi*north + sinPhi*up
+
+	rx, ry, rz := geodeticToECEF(refLat, refLon, refAlt)
+	return ecefToGeodetic(rx+dx, ry+dy, rz+dz)
+}
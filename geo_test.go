@@ -0,0 +1,177 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"testing"
+)
+
+func TestGeodeticToECEF(t *testing.T) {
+	polarRadius := wgs84A * (1 - wgs84F)
+	tests := []struct {
+		name          string
+		lat, lon, alt float64
+		x, y, z       float64
+	}{
+		{"equator prime meridian", 0, 0, 0, wgs84A, 0, 0},
+		{"equator 90E", 0, 90, 0, 0, wgs84A, 0},
+		{"equator antimeridian", 0, 180, 100, -wgs84A - 100, 0, 0},
+		{"north pole", 90, 0, 0, 0, 0, polarRadius},
+		{"south pole above ellipsoid", -90, 45, 10, 0, 0, -polarRadius - 10},
+	}
+	for _, tt := range tests {
+		x, y, z := geodeticToECEF(tt.lat, tt.lon, tt.alt)
+		if math.Abs(x-tt.x) > 1e-6 || math.Abs(y-tt.y) > 1e-6 || math.Abs(z-tt.z) > 1e-6 {
+			t.Errorf("%s: geodeticToECEF = (%.3f, %.3f, %.3f), want (%.3f, %.3f, %.3f)", tt.name, x, y, z, tt.x, tt.y, tt.z)
+		}
+	}
+}
+
+func TestECEFRoundTrip(t *testing.T) {
+	tests := []struct {
+		lat, lon, alt float64
+	}{
+		{0, 0, 0},
+		{48.8584, 2.2945, 35},
+		{-33.8568, 151.2153, 5},
+		{37.7749, -122.4194, -30},
+		{27.9881, 86.925, 8848},
+		{31.5, 35.5, -430},
+		{10, 179.9999, 0},
+		{10, -179.9999, 0},
+		{89.9999, 10, 100},
+		{90, 0, 0},
+		{-90, 0, 2000},
+	}
+	for _, tt := range tests {
+		lat, lon, alt := ecefToGeodetic(geodeticToECEF(tt.lat, tt.lon, tt.alt))
+		if math.Abs(lat-tt.lat) > 1e-9 || math.Abs(alt-tt.alt) > 1e-3 {
+			t.Errorf("(%v, %v, %v): round trip gave (%v, %v, %v)", tt.lat, tt.lon, tt.alt, lat, lon, alt)
+		}
+		// Longitude is undefined at the poles
+		if math.Abs(tt.lat) < 90 && math.Abs(wrapLongitude(lon-tt.lon)) > 1e-9 {
+			t.Errorf("(%v, %v, %v): round trip longitude %v", tt.lat, tt.lon, tt.alt, lon)
+		}
+	}
+}
+
+func TestGeodeticToENU(t *testing.T) {
+	const refLat, refLon, refAlt = 45.0, 7.0, 250.0
+	tests := []struct {
+		name            string
+		lat, lon, alt   float64
+		east, north, up float64
+		tolerance       float64
+	}{
+		{"reference", refLat, refLon, refAlt, 0, 0, 0, 1e-6},
+		{"straight up", refLat, refLon, refAlt + 30, 0, 0, 30, 1e-6},
+		{"100 m north", refLat + 100/metersPerDegreeLat, refLon, refAlt, 0, 100, 0, 0.5},
+		{"100 m east", refLat, refLon + 100/(metersPerDegreeLat*math.Cos(toRadians(refLat))), refAlt, 100, 0, 0, 0.5},
+	}
+	for _, tt := range tests {
+		east, north, up := geodeticToENU(tt.lat, tt.lon, tt.alt, refLat, refLon, refAlt)
+		if math.Abs(east-tt.east) > tt.tolerance || math.Abs(north-tt.north) > tt.tolerance || math.Abs(up-tt.up) > tt.tolerance {
+			t.Errorf("%s: geodeticToENU = (%.3f, %.3f, %.3f), want (%.3f, %.3f, %.3f)", tt.name, east, north, up, tt.east, tt.north, tt.up)
+		}
+	}
+}
+
+func TestENURoundTrip(t *testing.T) {
+	refs := []struct {
+		lat, lon, alt float64
+	}{
+		{0, 0, 0},
+		{45, 7, 250},
+		{-33.8568, 151.2153, 5},
+		{10, 179.9999, 0},
+		{89.999, -60, 1000},
+	}
+	offsets := []ENU{
+		{0, 0, 0},
+		{25, -40, 3},
+		{-1000, 1000, -50},
+		{MaxAnchorOffset, MaxAnchorOffset, MaxAnchorOffset},
+	}
+	for _, ref := range refs {
+		for _, o := range offsets {
+			lat, lon, alt := enuToGeodetic(o.East, o.North, o.Up, ref.lat, ref.lon, ref.alt)
+			east, north, up := geodeticToENU(lat, lon, alt, ref.lat, ref.lon, ref.alt)
+			if math.Abs(east-o.East) > 1e-3 || math.Abs(north-o.North) > 1e-3 || math.Abs(up-o.Up) > 1e-3 {
+				t.Errorf("ref %v offset %v: round trip gave (%.4f, %.4f, %.4f)", ref, o, east, north, up)
+			}
+		}
+	}
+}
+
+func TestInitialBearing(t *testing.T) {
+	tests := []struct {
+		name                   string
+		lat1, lon1, lat2, lon2 float64
+		want                   float64
+	}{
+		{"north", 0, 0, 1, 0, 0},
+		{"east", 0, 0, 0, 1, 90},
+		{"south", 0, 0, -1, 0, 180},
+		{"west", 0, 0, 0, -1, 270},
+		{"east across the antimeridian", 0, 179.5, 0, -179.5, 90},
+	}
+	for _, tt := range tests {
+		if got := initialBearing(tt.lat1, tt.lon1, tt.lat2, tt.lon2); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: initialBearing = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBoundingBoxesAround(t *testing.T) {
+	// 1 km is just under 0.009 degrees of latitude; at the equator longitude too
+	const r = 1000.0
+	d := r / metersPerDegreeLat
+	tests := []struct {
+		name     string
+		lat, lon float64
+		want     []BoundingBox
+	}{
+		{"plain", 0, 10, []BoundingBox{{MinLat: -d, MaxLat: d, MinLon: 10 - d, MaxLon: 10 + d}}},
+		{"crossing east", 0, 179.995, []BoundingBox{
+			{MinLat: -d, MaxLat: d, MinLon: 179.995 - d, MaxLon: 180},
+			{MinLat: -d, MaxLat: d, MinLon: -180, MaxLon: 179.995 + d - 360},
+		}},
+		{"crossing west", 0, -179.995, []BoundingBox{
+			{MinLat: -d, MaxLat: d, MinLon: -180, MaxLon: -179.995 + d},
+			{MinLat: -d, MaxLat: d, MinLon: -179.995 - d + 360, MaxLon: 180},
+		}},
+		{"reaching the pole", 89.995, 10, []BoundingBox{{MinLat: 89.995 - d, MaxLat: 90, MinLon: -180, MaxLon: 180}}},
+	}
+	for _, tt := range tests {
+		got := boundingBoxesAround(tt.lat, tt.lon, r)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: boxes = %+v, want %+v", tt.name, got, tt.want)
+			continue
+		}
+		for i, want := range tt.want {
+			g := got[i]
+			if !closeTo(g.MinLat, want.MinLat) || !closeTo(g.MaxLat, want.MaxLat) || !closeTo(g.MinLon, want.MinLon) || !closeTo(g.MaxLon, want.MaxLon) {
+				t.Errorf("%s: box %d = %+v, want %+v", tt.name, i, g, want)
+			}
+		}
+	}
+}
+
+func TestNearbyAcrossAntimeridian(t *testing.T) {
+	idx := NewSpatialIndex(spatialCellDegrees)
+	idx.Upsert(Building{ID: 1, Lat: 0, Lon: 179.999})
+	idx.Upsert(Building{ID: 2, Lat: 0, Lon: -179.999})
+	idx.Upsert(Building{ID: 3, Lat: 0, Lon: 179})
+
+	for _, lon := range []float64{179.9995, -179.9995} {
+		got := idx.Nearby(0, lon, 500, nil, 0)
+		ids := make([]int, 0, len(got))
+		for _, nb := range got {
+			ids = append(ids, nb.ID)
+		}
+		sort.Ints(ids)
+		if len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+			t.Errorf("near lon %v: found %v, want [1 2]", lon, ids)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// Per-user visit records, key=building id, readable by the owner
+	VisitsCollection = "visits"
+	// Totals across all users, key=building id
+	VisitStatsCollection = "visit_stats"
+
+	// Largest geofence a building may have, also bounds the candidate search
+	// (footprints are found by their centroid, so keep them under this size)
+	MaxGeofenceRadius = 1000.0
+	// Extra distance before an exit counts, so GPS jitter at the edge doesn't flap
+	GeofenceExitMargin = 10.0
+	// Players that stop sending locations are treated as having left
+	GeofenceIdleTimeout = 5 * time.Minute
+)
+
+// Geofence event kinds
+const (
+	GeofenceEnter = "enter"
+	GeofenceDwell = "dwell"
+	GeofenceExit  = "exit"
+)
+
+type GeofenceEvent struct {
+	Type       string `json:"type"`
+	BuildingID int    `json:"building_id"`
+	// Seconds spent inside so far, set on dwell and exit
+	DwellSeconds int64 `json:"dwell_seconds,omitempty"`
+	// Whether the stay was long enough to count as a visit
+	Counted bool `json:"counted,omitempty"`
+}
+
+// Stored visit summary for one user and building
+type Visit struct {
+	BuildingID        int   `json:"building_id"`
+	Count             int   `json:"count"`
+	FirstAt           int64 `json:"first_at"`
+	LastAt            int64 `json:"last_at"`
+	TotalDwellSeconds int64 `json:"total_dwell_seconds"`
+}
+
+// Visits to one building summed over all users
+type VisitStats struct {
+	BuildingID        int   `json:"building_id"`
+	Visits            int   `json:"visits"`
+	Visitors          int   `json:"visitors"`
+	TotalDwellSeconds int64 `json:"total_dwell_seconds"`
+	LastAt            int64 `json:"last_at"`
+}
+
+type geofencePresence struct {
+	EnteredAt time.Time
+	LastSeen  time.Time
+	Dwelled   bool
+}
+
+// Tracks which building geofences each user is inside
+type GeofenceEngine struct {
+	mu    sync.Mutex
+	users map[string]map[int]*geofencePresence
+}
+
+func NewGeofenceEngine() *GeofenceEngine {
+	return &GeofenceEngine{users: make(map[string]map[int]*geofencePresence)}
+}
+
+var geofences = NewGeofenceEngine()
+
+// Geofence radius of a building, falling back to the configured default
+func (b Building) geofenceRadius(c Config) float64 {
+	if b.Radius > 0 {
+		return b.Radius
+	}
+	return c.GeofenceRadius
+}
+
+// Whether a point is inside a building's geofence, with extra slack in meters.
+// Footprints use the polygon, buffered by the building's own radius if set;
+// otherwise it's a circle around lat/lon, distance meters from the point.
+func (b Building) inGeofence(lat, lon, distance, slack float64, c Config) bool {
+	if b.Geometry.HasArea() {
+		return b.Geometry.Contains(lat, lon) || b.Geometry.DistanceToEdge(lat, lon) <= b.Radius+slack
+	}
+	return distance <= b.geofenceRadius(c)+slack
+}
+
+// Feed a user's position in and get the events it causes
+func (g *GeofenceEngine) Update(userID string, lat, lon float64, now time.Time, c Config) []GeofenceEvent {
+	candidates := buildingIndex.Nearby(lat, lon, MaxGeofenceRadius+GeofenceExitMargin, nil, 0)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	present := g.users[userID]
+	if present == nil {
+		present = make(map[int]*geofencePresence)
+		g.users[userID] = present
+	}
+
+	var events []GeofenceEvent
+	inside := make(map[int]bool)
+	for _, nb := range candidates {
+		p, wasInside := present[nb.ID]
+		slack := 0.0
+		if wasInside {
+			slack = GeofenceExitMargin
+		}
+		if !nb.inGeofence(lat, lon, nb.Distance, slack, c) {
+			continue
+		}
+		inside[nb.ID] = true
+
+		if !wasInside {
+			present[nb.ID] = &geofencePresence{EnteredAt: now, LastSeen: now}
+			events = append(events, GeofenceEvent{Type: GeofenceEnter, BuildingID: nb.ID})
+			if c.GeofenceMinDwell == 0 {
+				present[nb.ID].Dwelled = true
+				events = append(events, GeofenceEvent{Type: GeofenceDwell, BuildingID: nb.ID, Counted: true})
+			}
+			continue
+		}
+
+		p.LastSeen = now
+		if !p.Dwelled && now.Sub(p.EnteredAt) >= c.GeofenceMinDwell {
+			p.Dwelled = true
+			events = append(events, GeofenceEvent{Type: GeofenceDwell, BuildingID: nb.ID, DwellSeconds: int64(now.Sub(p.EnteredAt) / time.Second), Counted: true})
+		}
+	}
+
+	for id, p := range present {
+		if !inside[id] {
+			events = append(events, exitEvent(id, p, now))
+			delete(present, id)
+		}
+	}
+	if len(present) == 0 {
+		delete(g.users, userID)
+	}
+	return events
+}
+
+// Exit everything a user is inside, e.g. when they go quiet or disconnect
+func (g *GeofenceEngine) Leave(userID string, now time.Time) []GeofenceEvent {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var events []GeofenceEvent
+	for id, p := range g.users[userID] {
+		events = append(events, exitEvent(id, p, now))
+	}
+	delete(g.users, userID)
+	return events
+}
+
+// Users that haven't reported a position since the cutoff
+func (g *GeofenceEngine) idleUsers(cutoff time.Time) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var idle []string
+	for userID, present := range g.users {
+		quiet := true
+		for _, p := range present {
+			if p.LastSeen.After(cutoff) {
+				quiet = false
+				break
+			}
+		}
+		if quiet {
+			idle = append(idle, userID)
+		}
+	}
+	return idle
+}
+
+func exitEvent(id int, p *geofencePresence, now time.Time) GeofenceEvent {
+	end := now
+	if p.LastSeen.Before(now.Add(-GeofenceIdleTimeout)) {
+		// Don't credit time after the player went quiet
+		end = p.LastSeen
+	}
+	return GeofenceEvent{Type: GeofenceExit, BuildingID: id, DwellSeconds: int64(end.Sub(p.EnteredAt) / time.Second), Counted: p.Dwelled}
+}
+
+// Position a client reports: top-level lat/lon, or inside "data" as older
+// clients sent it (their top-level lat/lon was the cell)
+func positionFromPayload(payload string) (float64, float64, bool) {
+	var msg struct {
+		Lat  *float64 `json:"lat"`
+		Lon  *float64 `json:"lon"`
+		Data struct {
+			Lat *float64 `json:"lat"`
+			Lon *float64 `json:"lon"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+		return 0, 0, false
+	}
+	lat, lon := msg.Lat, msg.Lon
+	if msg.Data.Lat != nil && msg.Data.Lon != nil {
+		lat, lon = msg.Data.Lat, msg.Data.Lon
+	}
+	if lat == nil || lon == nil || *lat < -90 || *lat > 90 || *lon < -180 || *lon > 180 {
+		return 0, 0, false
+	}
+	return *lat, *lon, true
+}
+
+// Run a location update through the geofences, persist visits and tell the player
+func evaluateGeofences(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, userID string, lat, lon float64) {
+	events := geofences.Update(userID, lat, lon, time.Now(), cfg())
+	handleGeofenceEvents(ctx, logger, nk, userID, events)
+}
+
+func handleGeofenceEvents(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, userID string, events []GeofenceEvent) {
+	for _, ev := range events {
+		switch {
+		case ev.Type == GeofenceDwell:
+			firstVisit := false
+			if err := updateVisit(ctx, nk, userID, ev.BuildingID, func(v *Visit, now int64) {
+				v.Count++
+				v.LastAt = now
+				firstVisit = v.Count == 1
+			}); err != nil {
+				logger.Error("Failed to record visit of %s to building %d: %v", userID, ev.BuildingID, err)
+				break
+			}
+			if err := updateVisitStats(ctx, nk, ev.BuildingID, func(s *VisitStats, now int64) {
+				s.Visits++
+				if firstVisit {
+					s.Visitors++
+				}
+				s.LastAt = now
+			}); err != nil {
+				logger.Error("Failed to update visit stats of building %d: %v", ev.BuildingID, err)
+			}
+		case ev.Type == GeofenceExit && ev.Counted:
+			if err := updateVisit(ctx, nk, userID, ev.BuildingID, func(v *Visit, now int64) {
+				v.TotalDwellSeconds += ev.DwellSeconds
+				v.LastAt = now
+			}); err != nil {
+				logger.Error("Failed to record dwell of %s at building %d: %v", userID, ev.BuildingID, err)
+				break
+			}
+			if err := updateVisitStats(ctx, nk, ev.BuildingID, func(s *VisitStats, now int64) {
+				s.TotalDwellSeconds += ev.DwellSeconds
+			}); err != nil {
+				logger.Error("Failed to update visit stats of building %d: %v", ev.BuildingID, err)
+			}
+		}
+
+		content := map[string]interface{}{"data": ev}
+		if err := nk.NotificationSend(ctx, userID, "geofence_"+ev.Type, content, 1, "", false); err != nil {
+			logger.Error("Failed to send geofence %s notification: %v", ev.Type, err)
+		}
+	}
+}
+
+// Read-modify-write one storage object, conditional on the version we read.
+// mutate gets the stored value ("" when there is none) and returns the new
+// one. Objects owned by a user are readable by that user.
+func updateStorageObject(ctx context.Context, nk runtime.NakamaModule, collection, key, userID string, mutate func(value string, now int64) string) error {
+	permissionRead := 0
+	if userID != "" {
+		permissionRead = 1
+	}
+
+	config := cfg()
+	var lastErr error
+	for attempt := 1; attempt <= config.LockRetryCount; attempt++ {
+		records, err := nk.StorageRead(ctx, []*runtime.StorageRead{{
+			Collection: collection,
+			Key:        key,
+			UserID:     userID,
+		}})
+		if err != nil {
+			return err
+		}
+
+		value, version := "", "*"
+		if len(records) > 0 {
+			value, version = records[0].Value, records[0].Version
+		}
+		if _, lastErr = nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+			Collection:      collection,
+			Key:             key,
+			UserID:          userID,
+			Value:           mutate(value, time.Now().Unix()),
+			Version:         version,
+			PermissionRead:  permissionRead,
+			PermissionWrite: 0,
+		}}); lastErr == nil {
+			return nil
+		}
+		time.Sleep(config.LockRetryDelay)
+	}
+	return fmt.Errorf("%s %s write kept conflicting, giving up: %w", collection, key, lastErr)
+}
+
+// Update a user's visit record for a building
+func updateVisit(ctx context.Context, nk runtime.NakamaModule, userID string, buildingID int, fn func(v *Visit, now int64)) error {
+	return updateStorageObject(ctx, nk, VisitsCollection, strconv.Itoa(buildingID), userID, func(value string, now int64) string {
+		visit := Visit{BuildingID: buildingID, FirstAt: now}
+		if value != "" {
+			_ = json.Unmarshal([]byte(value), &visit)
+		}
+		fn(&visit, now)
+		val, _ := json.Marshal(visit)
+		return string(val)
+	})
+}
+
+// Same as updateVisit for the all-users totals
+func updateVisitStats(ctx context.Context, nk runtime.NakamaModule, buildingID int, fn func(s *VisitStats, now int64)) error {
+	return updateStorageObject(ctx, nk, VisitStatsCollection, strconv.Itoa(buildingID), "", func(value string, now int64) string {
+		stats := VisitStats{BuildingID: buildingID}
+		if value != "" {
+			_ = json.Unmarshal([]byte(value), &stats)
+		}
+		fn(&stats, now)
+		val, _ := json.Marshal(stats)
+		return string(val)
+	})
+}
+
+// Close out geofence stays of players that stopped sending locations
+func startGeofenceJanitor(logger runtime.Logger, nk runtime.NakamaModule) {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			now := time.Now()
+			for _, userID := range geofences.idleUsers(now.Add(-GeofenceIdleTimeout)) {
+				handleGeofenceEvents(context.Background(), logger, nk, userID, geofences.Leave(userID, now))
+			}
+		}
+	}()
+}
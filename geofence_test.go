@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGeofenceEngine(t *testing.T) {
+	const id, lat, lon = 9101, 10.0, 10.0
+	buildingIndex.Upsert(Building{ID: id, Lat: lat, Lon: lon})
+	defer buildingIndex.Remove(id)
+
+	c := defaultConfig()
+	c.GeofenceRadius = 30
+	c.GeofenceMinDwell = 30 * time.Second
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	g := NewGeofenceEngine()
+
+	steps := []struct {
+		name  string
+		at    time.Duration
+		north float64 // meters from the building
+		want  []GeofenceEvent
+	}{
+		{"outside", 0, 100, nil},
+		{"enter", 10 * time.Second, 20, []GeofenceEvent{{Type: GeofenceEnter, BuildingID: id}}},
+		{"still inside", 20 * time.Second, 25, nil},
+		{"dwell inside the exit margin", 45 * time.Second, 35, []GeofenceEvent{{Type: GeofenceDwell, BuildingID: id, DwellSeconds: 35, Counted: true}}},
+		{"exit past the margin", 60 * time.Second, 45, []GeofenceEvent{{Type: GeofenceExit, BuildingID: id, DwellSeconds: 50, Counted: true}}},
+		{"margin only holds players inside", 70 * time.Second, 35, nil},
+		{"enter again", 80 * time.Second, 0, []GeofenceEvent{{Type: GeofenceEnter, BuildingID: id}}},
+	}
+	for _, step := range steps {
+		pLat, pLon, _ := enuToGeodetic(0, step.north, 0, lat, lon, 0)
+		got := g.Update("user", pLat, pLon, start.Add(step.at), c)
+		if !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: events = %+v, want %+v", step.name, got, step.want)
+		}
+	}
+
+	lastSeen := start.Add(80 * time.Second)
+	if idle := g.idleUsers(lastSeen.Add(-time.Second)); len(idle) != 0 {
+		t.Errorf("idle before the cutoff: %v", idle)
+	}
+	if idle := g.idleUsers(lastSeen); !reflect.DeepEqual(idle, []string{"user"}) {
+		t.Errorf("idle at the cutoff = %v, want [user]", idle)
+	}
+
+	// A quiet player is credited up to their last position, not the leave
+	got := g.Leave("user", lastSeen.Add(GeofenceIdleTimeout+time.Minute))
+	want := []GeofenceEvent{{Type: GeofenceExit, BuildingID: id, DwellSeconds: 0, Counted: false}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("leave: events = %+v, want %+v", got, want)
+	}
+	if got := g.Leave("user", lastSeen); got != nil {
+		t.Errorf("second leave: events = %+v, want none", got)
+	}
+}
+
+func TestGeofenceNoMinDwell(t *testing.T) {
+	const id, lat, lon = 9102, 11.0, 11.0
+	buildingIndex.Upsert(Building{ID: id, Lat: lat, Lon: lon, Radius: 50})
+	defer buildingIndex.Remove(id)
+
+	c := defaultConfig()
+	c.GeofenceMinDwell = 0
+	g := NewGeofenceEngine()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// The building's own radius beats the default, and the visit counts at once
+	pLat, pLon, _ := enuToGeodetic(40, 0, 0, lat, lon, 0)
+	got := g.Update("user", pLat, pLon, now, c)
+	want := []GeofenceEvent{{Type: GeofenceEnter, BuildingID: id}, {Type: GeofenceDwell, BuildingID: id, Counted: true}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("enter: events = %+v, want %+v", got, want)
+	}
+	if got := g.Update("user", pLat, pLon, now.Add(time.Minute), c); got != nil {
+		t.Errorf("staying: events = %+v, want none", got)
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// GeoJSON geometry types a building footprint may use
+const (
+	GeometryPoint        = "Point"
+	GeometryPolygon      = "Polygon"
+	GeometryMultiPolygon = "MultiPolygon"
+)
+
+// GeoJSON position, longitude first
+type Position [2]float64
+
+func (p Position) Lon() float64 { return p[0] }
+func (p Position) Lat() float64 { return p[1] }
+
+// Closed ring: first and last positions are equal
+type Ring []Position
+
+// Outer ring followed by any holes
+type Polygon []Ring
+
+// Building footprint. A Polygon is stored as a single entry in Polygons so
+// every polygon utility works on both Polygon and MultiPolygon.
+type Geometry struct {
+	Type     string
+	Point    Position
+	Polygons []Polygon
+}
+
+var errEmptyGeometry = errors.New("empty geometry")
+
+func (g Geometry) MarshalJSON() ([]byte, error) {
+	var coords interface{}
+	switch g.Type {
+	case GeometryPoint:
+		coords = g.Point
+	case GeometryPolygon:
+		if len(g.Polygons) != 1 {
+			return nil, fmt.Errorf("polygon geometry with %d polygons", len(g.Polygons))
+		}
+		coords = g.Polygons[0]
+	case GeometryMultiPolygon:
+		coords = g.Polygons
+	default:
+		return nil, fmt.Errorf("unsupported geometry type %q", g.Type)
+	}
+	return json.Marshal(map[string]interface{}{"type": g.Type, "coordinates": coords})
+}
+
+func (g *Geometry) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	g.Type = raw.Type
+	g.Point = Position{}
+	g.Polygons = nil
+	switch raw.Type {
+	case GeometryPoint:
+		// Altitude, if any, is dropped
+		var p []float64
+		if err := json.Unmarshal(raw.Coordinates, &p); err != nil {
+			return fmt.Errorf("point: %w", err)
+		}
+		if len(p) < 2 {
+			return fmt.Errorf("point needs at least 2 coordinates, got %d", len(p))
+		}
+		g.Point = Position{p[0], p[1]}
+	case GeometryPolygon:
+		var rings [][][]float64
+		if err := json.Unmarshal(raw.Coordinates, &rings); err != nil {
+			return fmt.Errorf("polygon: %w", err)
+		}
+		poly, err := polygonFromCoordinates(rings)
+		if err != nil {
+			return err
+		}
+		g.Polygons = []Polygon{poly}
+	case GeometryMultiPolygon:
+		var polys [][][][]float64
+		if err := json.Unmarshal(raw.Coordinates, &polys); err != nil {
+			return fmt.Errorf("multipolygon: %w", err)
+		}
+		for _, rings := range polys {
+			poly, err := polygonFromCoordinates(rings)
+			if err != nil {
+				return err
+			}
+			g.Polygons = append(g.Polygons, poly)
+		}
+	default:
+		return fmt.Errorf("unsupported geometry type %q", raw.Type)
+	}
+	return nil
+}
+
+func polygonFromCoordinates(rings [][][]float64) (Polygon, error) {
+	poly := make(Polygon, 0, len(rings))
+	for _, coords := range rings {
+		ring := make(Ring, 0, len(coords))
+		for _, c := range coords {
+			if len(c) < 2 {
+				return nil, fmt.Errorf("position needs at least 2 coordinates, got %d", len(c))
+			}
+			ring = append(ring, Position{c[0], c[1]})
+		}
+		poly = append(poly, ring)
+	}
+	return poly, nil
+}
+
+// Parse a geometry as WP hands it over: ACF text fields give a JSON string,
+// the REST API may give the decoded object, empty fields give "", null or false.
+func parseGeometryField(v interface{}) (*Geometry, error) {
+	var data []byte
+	switch g := v.(type) {
+	case nil, bool:
+		return nil, nil
+	case string:
+		if strings.TrimSpace(g) == "" {
+			return nil, nil
+		}
+		data = []byte(g)
+	case json.RawMessage:
+		if len(g) == 0 || string(g) == "null" || string(g) == `""` || string(g) == "false" {
+			return nil, nil
+		}
+		// The notifier plugin sends the ACF string as is
+		var s string
+		if json.Unmarshal(g, &s) == nil {
+			return parseGeometryField(s)
+		}
+		data = g
+	default:
+		var err error
+		if data, err = json.Marshal(g); err != nil {
+			return nil, err
+		}
+	}
+
+	// A feature wrapping the geometry is a common paste from geojson.io
+	var feature struct {
+		Type     string          `json:"type"`
+		Geometry json.RawMessage `json:"geometry"`
+	}
+	if json.Unmarshal(data, &feature) == nil && feature.Type == "Feature" {
+		data = feature.Geometry
+	}
+
+	var geom Geometry
+	if err := json.Unmarshal(data, &geom); err != nil {
+		return nil, err
+	}
+	return &geom, geom.Validate()
+}
+
+func validPosition(p Position) bool {
+	return !math.IsNaN(p.Lat()) && !math.IsNaN(p.Lon()) && p.Lat() >= -90 && p.Lat() <= 90 && p.Lon() >= -180 && p.Lon() <= 180
+}
+
+func (g *Geometry) Validate() error {
+	switch g.Type {
+	case GeometryPoint:
+		if !validPosition(g.Point) {
+			return fmt.Errorf("point %v out of range", g.Point)
+		}
+		return nil
+	case GeometryPolygon, GeometryMultiPolygon:
+	default:
+		return fmt.Errorf("unsupported geometry type %q", g.Type)
+	}
+
+	if len(g.Polygons) == 0 {
+		return errEmptyGeometry
+	}
+	for i, poly := range g.Polygons {
+		if len(poly) == 0 {
+			return fmt.Errorf("polygon %d: %w", i, errEmptyGeometry)
+		}
+		for j, ring := range poly {
+			if len(ring) < 4 {
+				return fmt.Errorf("polygon %d ring %d: needs at least 4 positions, got %d", i, j, len(ring))
+			}
+			if ring[0] != ring[len(ring)-1] {
+				return fmt.Errorf("polygon %d ring %d: not closed", i, j)
+			}
+			for _, p := range ring {
+				if !validPosition(p) {
+					return fmt.Errorf("polygon %d ring %d: position %v out of range", i, j, p)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Whether the geometry has an area (Polygon or MultiPolygon)
+func (g *Geometry) HasArea() bool {
+	return g != nil && len(g.Polygons) > 0
+}
+
+// Longitude difference folded into [-180, 180), so footprints straddling
+// the antimeridian stay in one piece
+func wrapLongitude(d float64) float64 {
+	return math.Mod(math.Mod(d+180, 360)+360, 360) - 180
+}
+
+// Longitude of p unwrapped to within 180 degrees of ref
+func (p Position) lonNear(ref float64) float64 {
+	return ref + wrapLongitude(p.Lon()-ref)
+}
+
+// Even-odd ray casting in lon/lat, fine at building scale. Longitudes are
+// unwrapped around the first vertex.
+func (r Ring) contains(lat, lon float64) bool {
+	ref := r[0].Lon()
+	lon = ref + wrapLongitude(lon-ref)
+	inside := false
+	for i, j := 0, len(r)-1; i < len(r); j, i = i, i+1 {
+		a, b := r[i], r[j]
+		aLon, bLon := a.lonNear(ref), b.lonNear(ref)
+		if (a.Lat() > lat) != (b.Lat() > lat) &&
+			lon < (bLon-aLon)*(lat-a.Lat())/(b.Lat()-a.Lat())+aLon {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// Inside the outer ring and outside every hole
+func (p Polygon) Contains(lat, lon float64) bool {
+	if len(p) == 0 || !p[0].contains(lat, lon) {
+		return false
+	}
+	for _, hole := range p[1:] {
+		if hole.contains(lat, lon) {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether a point is inside the footprint. Points have no area, so never.
+func (g *Geometry) Contains(lat, lon float64) bool {
+	for _, poly := range g.Polygons {
+		if poly.Contains(lat, lon) {
+			return true
+		}
+	}
+	return false
+}
+
+// Signed area and area-weighted centroid of a ring, in degrees, with
+// longitudes unwrapped around ref
+func (r Ring) areaCentroid(ref float64) (area, lat, lon float64) {
+	var cx, cy float64
+	for i := 0; i < len(r)-1; i++ {
+		a, b := r[i], r[i+1]
+		aLon, bLon := a.lonNear(ref), b.lonNear(ref)
+		cross := aLon*b.Lat() - bLon*a.Lat()
+		area += cross
+		cx += (aLon + bLon) * cross
+		cy += (a.Lat() + b.Lat()) * cross
+	}
+	area /= 2
+	if area == 0 {
+		return 0, r[0].Lat(), r[0].lonNear(ref)
+	}
+	return area, cy / (6 * area), cx / (6 * area)
+}
+
+// Area-weighted centroid, holes subtracted. Returns lat, lon.
+func (g *Geometry) Centroid() (float64, float64) {
+	if g.Type == GeometryPoint {
+		return g.Point.Lat(), g.Point.Lon()
+	}
+
+	ref := g.Polygons[0][0][0].Lon()
+	var total, sumLat, sumLon float64
+	for _, poly := range g.Polygons {
+		for i, ring := range poly {
+			area, lat, lon := ring.areaCentroid(ref)
+			area = math.Abs(area)
+			if i > 0 {
+				area = -area
+			}
+			total += area
+			sumLat += lat * area
+			sumLon += lon * area
+		}
+	}
+	if total == 0 {
+		first := g.Polygons[0][0][0]
+		return first.Lat(), first.Lon()
+	}
+	return sumLat / total, wrapLongitude(sumLon / total)
+}
+
+// Meters from a point to the nearest edge of the footprint (to the point itself
+// for Point geometries). Uses a local flat projection around the query point,
+// accurate to well under a meter at building scale.
+func (g *Geometry) DistanceToEdge(lat, lon float64) float64 {
+	if g.Type == GeometryPoint {
+		return haversineMeters(lat, lon, g.Point.Lat(), g.Point.Lon())
+	}
+
+	mPerLon := metersPerDegreeLat * math.Cos(toRadians(lat))
+	project := func(p Position) (float64, float64) {
+		return wrapLongitude(p.Lon()-lon) * mPerLon, (p.Lat() - lat) * metersPerDegreeLat
+	}
+
+	best := math.Inf(1)
+	for _, poly := range g.Polygons {
+		for _, ring := range poly {
+			for i := 0; i < len(ring)-1; i++ {
+				ax, ay := project(ring[i])
+				bx, by := project(ring[i+1])
+				if d := distanceToSegment(ax, ay, bx, by); d < best {
+					best = d
+				}
+			}
+		}
+	}
+	return best
+}
+
+// Distance from the origin to segment a-b in a plane
+func distanceToSegment(ax, ay, bx, by float64) float64 {
+	dx, dy := bx-ax, by-ay
+	lenSq := dx*dx + dy*dy
+	t := 0.0
+	if lenSq > 0 {
+		t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/lenSq))
+	}
+	return math.Hypot(ax+t*dx, ay+t*dy)
+}
+
+// Box around the whole geometry
+func (g *Geometry) Bounds() BoundingBox {
+	if g.Type == GeometryPoint {
+		return BoundingBox{MinLat: g.Point.Lat(), MinLon: g.Point.Lon(), MaxLat: g.Point.Lat(), MaxLon: g.Point.Lon()}
+	}
+	bb := BoundingBox{MinLat: 90, MinLon: 180, MaxLat: -90, MaxLon: -180}
+	for _, poly := range g.Polygons {
+		for _, p := range poly[0] {
+			bb.MinLat = math.Min(bb.MinLat, p.Lat())
+			bb.MaxLat = math.Max(bb.MaxLat, p.Lat())
+			bb.MinLon = math.Min(bb.MinLon, p.Lon())
+			bb.MaxLon = math.Max(bb.MaxLon, p.Lon())
+		}
+	}
+	return bb
+}
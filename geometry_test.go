@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+// Closed ring around a lon/lat box
+func boxRing(minLon, minLat, maxLon, maxLat float64) Ring {
+	return Ring{{minLon, minLat}, {maxLon, minLat}, {maxLon, maxLat}, {minLon, maxLat}, {minLon, minLat}}
+}
+
+func polygonGeometry(polys ...Polygon) *Geometry {
+	if len(polys) == 1 {
+		return &Geometry{Type: GeometryPolygon, Polygons: polys}
+	}
+	return &Geometry{Type: GeometryMultiPolygon, Polygons: polys}
+}
+
+func TestWrapLongitude(t *testing.T) {
+	tests := []struct {
+		in, want float64
+	}{
+		{0, 0},
+		{179.5, 179.5},
+		{180, -180},
+		{-180, -180},
+		{190, -170},
+		{-190, 170},
+		{359, -1},
+		{720, 0},
+	}
+	for _, tt := range tests {
+		if got := wrapLongitude(tt.in); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("wrapLongitude(%v) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestGeometryContains(t *testing.T) {
+	square := polygonGeometry(Polygon{boxRing(0, 0, 1, 1)})
+	withHole := polygonGeometry(Polygon{boxRing(0, 0, 4, 4), boxRing(1, 1, 3, 3)})
+	multi := polygonGeometry(Polygon{boxRing(0, 0, 1, 1)}, Polygon{boxRing(5, 5, 6, 6)})
+	// Concave L shape: the notch at the top right is outside
+	lShape := polygonGeometry(Polygon{Ring{{0, 0}, {2, 0}, {2, 1}, {1, 1}, {1, 2}, {0, 2}, {0, 0}}})
+	// Footprint straddling the antimeridian, written with raw longitudes
+	antimeridian := polygonGeometry(Polygon{Ring{{179.9, 10}, {-179.9, 10}, {-179.9, 10.1}, {179.9, 10.1}, {179.9, 10}}})
+	point := &Geometry{Type: GeometryPoint, Point: Position{0.5, 0.5}}
+
+	tests := []struct {
+		name     string
+		geom     *Geometry
+		lat, lon float64
+		want     bool
+	}{
+		{"square center", square, 0.5, 0.5, true},
+		{"square outside east", square, 0.5, 1.5, false},
+		{"square outside north", square, 1.5, 0.5, false},
+		{"square outside at vertex latitude", square, 1, 2, false},
+		{"hole ring interior", withHole, 0.5, 0.5, true},
+		{"inside hole", withHole, 2, 2, false},
+		{"outside outer ring", withHole, 5, 5, false},
+		{"multipolygon first", multi, 0.5, 0.5, true},
+		{"multipolygon second", multi, 5.5, 5.5, true},
+		{"multipolygon gap", multi, 3, 3, false},
+		{"concave arm", lShape, 1.5, 0.5, true},
+		{"concave notch", lShape, 1.5, 1.5, false},
+		{"antimeridian east side", antimeridian, 10.05, 179.95, true},
+		{"antimeridian west side", antimeridian, 10.05, -179.95, true},
+		{"antimeridian outside", antimeridian, 10.05, 179.5, false},
+		{"antimeridian far side of globe", antimeridian, 10.05, 0, false},
+		{"point geometry", point, 0.5, 0.5, false},
+	}
+	for _, tt := range tests {
+		if got := tt.geom.Contains(tt.lat, tt.lon); got != tt.want {
+			t.Errorf("%s: Contains(%v, %v) = %v, want %v", tt.name, tt.lat, tt.lon, got, tt.want)
+		}
+	}
+}
+
+func TestGeometryCentroid(t *testing.T) {
+	tests := []struct {
+		name             string
+		geom             *Geometry
+		wantLat, wantLon float64
+	}{
+		{"point", &Geometry{Type: GeometryPoint, Point: Position{3, 4}}, 4, 3},
+		{"square", polygonGeometry(Polygon{boxRing(0, 0, 2, 2)}), 1, 1},
+		// Clockwise winding must give the same answer
+		{"clockwise square", polygonGeometry(Polygon{Ring{{0, 0}, {0, 2}, {2, 2}, {2, 0}, {0, 0}}}), 1, 1},
+		// A hole on the east half pulls the centroid west
+		{"hole", polygonGeometry(Polygon{boxRing(0, 0, 4, 2), boxRing(2, 0, 4, 2)}), 1, 1},
+		// Equal squares weigh the same
+		{"multipolygon", polygonGeometry(Polygon{boxRing(0, 0, 2, 2)}, Polygon{boxRing(4, 0, 6, 2)}), 1, 3},
+		{"antimeridian", polygonGeometry(Polygon{Ring{{179, 0}, {-179, 0}, {-179, 2}, {179, 2}, {179, 0}}}), 1, -180},
+		{"antimeridian west of line", polygonGeometry(Polygon{Ring{{179, 0}, {-177, 0}, {-177, 2}, {179, 2}, {179, 0}}}), 1, -179},
+		{"degenerate", polygonGeometry(Polygon{Ring{{1, 1}, {2, 2}, {3, 3}, {1, 1}}}), 1, 1},
+	}
+	for _, tt := range tests {
+		lat, lon := tt.geom.Centroid()
+		if math.Abs(lat-tt.wantLat) > 1e-9 || math.Abs(wrapLongitude(lon-tt.wantLon)) > 1e-9 {
+			t.Errorf("%s: Centroid() = (%v, %v), want (%v, %v)", tt.name, lat, lon, tt.wantLat, tt.wantLon)
+		}
+		if lon < -180 || lon > 180 {
+			t.Errorf("%s: Centroid() longitude %v out of range", tt.name, lon)
+		}
+	}
+}
+
+func TestGeometryDistanceToEdge(t *testing.T) {
+	// 0.001 degree box at the equator, about 111 m a side
+	square := polygonGeometry(Polygon{boxRing(0, 0, 0.001, 0.001)})
+	withHole := polygonGeometry(Polygon{boxRing(0, 0, 0.004, 0.004), boxRing(0.001, 0.001, 0.003, 0.003)})
+	antimeridian := polygonGeometry(Polygon{boxRing(179.999, 0, 180, 0.001), boxRing(-180, 0, -179.999, 0.001)})
+	point := &Geometry{Type: GeometryPoint, Point: Position{0, 0}}
+	deg := metersPerDegreeLat / 1000 // meters in 0.001 degree at the equator
+
+	tests := []struct {
+		name     string
+		geom     *Geometry
+		lat, lon float64
+		want     float64
+	}{
+		{"center", square, 0.0005, 0.0005, deg / 2},
+		{"near west edge", square, 0.0005, 0.0001, deg / 10},
+		{"on edge", square, 0, 0.0005, 0},
+		{"outside east", square, 0.0005, 0.002, deg},
+		{"outside corner", square, 0.002, 0.002, math.Sqrt2 * deg},
+		{"hole edge counts", withHole, 0.002, 0.002, deg},
+		{"across the antimeridian", antimeridian, 0.0005, -179.9995, deg / 2},
+		{"point", point, 0.001, 0, haversineMeters(0.001, 0, 0, 0)},
+	}
+	for _, tt := range tests {
+		if got := tt.geom.DistanceToEdge(tt.lat, tt.lon); math.Abs(got-tt.want) > 0.5 {
+			t.Errorf("%s: DistanceToEdge(%v, %v) = %.2f, want %.2f", tt.name, tt.lat, tt.lon, got, tt.want)
+		}
+	}
+}
+
+func TestParseGeometryField(t *testing.T) {
+	polygon := `{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,1],[0,0]]]}`
+	quoted, _ := json.Marshal(polygon)
+
+	tests := []struct {
+		name     string
+		in       interface{}
+		wantType string
+		wantErr  bool
+	}{
+		{"nil", nil, "", false},
+		{"false", false, "", false},
+		{"blank string", "  ", "", false},
+		{"null raw", json.RawMessage("null"), "", false},
+		{"empty string raw", json.RawMessage(`""`), "", false},
+		{"string", polygon, GeometryPolygon, false},
+		{"raw object", json.RawMessage(polygon), GeometryPolygon, false},
+		{"raw quoted string", json.RawMessage(quoted), GeometryPolygon, false},
+		{"decoded object", map[string]interface{}{"type": "Point", "coordinates": []float64{1, 2, 30}}, GeometryPoint, false},
+		{"feature", `{"type":"Feature","geometry":` + polygon + `}`, GeometryPolygon, false},
+		{"multipolygon", `{"type":"MultiPolygon","coordinates":[[[[0,0],[1,0],[1,1],[0,0]]]]}`, GeometryMultiPolygon, false},
+		{"unclosed ring", `{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,1]]]}`, "", true},
+		{"short ring", `{"type":"Polygon","coordinates":[[[0,0],[1,0],[0,0]]]}`, "", true},
+		{"out of range", `{"type":"Point","coordinates":[200,0]}`, "", true},
+		{"empty polygon", `{"type":"Polygon","coordinates":[]}`, "", true},
+		{"unsupported type", `{"type":"LineString","coordinates":[[0,0],[1,1]]}`, "", true},
+		{"not json", "building", "", true},
+	}
+	for _, tt := range tests {
+		geom, err := parseGeometryField(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		gotType := ""
+		if geom != nil {
+			gotType = geom.Type
+		}
+		if gotType != tt.wantType {
+			t.Errorf("%s: type = %q, want %q", tt.name, gotType, tt.wantType)
+		}
+	}
+}
+
+func TestGeometryJSONRoundTrip(t *testing.T) {
+	for _, in := range []*Geometry{
+		{Type: GeometryPoint, Point: Position{1, 2}},
+		polygonGeometry(Polygon{boxRing(0, 0, 4, 4), boxRing(1, 1, 3, 3)}),
+		polygonGeometry(Polygon{boxRing(0, 0, 1, 1)}, Polygon{boxRing(5, 5, 6, 6)}),
+	} {
+		data, err := json.Marshal(in)
+		if err != nil {
+			t.Fatalf("marshal %s: %v", in.Type, err)
+		}
+		var out Geometry
+		if err := json.Unmarshal(data, &out); err != nil {
+			t.Fatalf("unmarshal %s: %v", data, err)
+		}
+		again, _ := json.Marshal(out)
+		if string(again) != string(data) {
+			t.Errorf("round trip of %s gave %s", data, again)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	DefaultBuildingsPageSize = 100
+	MaxBuildingsPageSize     = 500
+
+	// Storage is always scanned in batches of this size so cursor offsets stay valid
+	buildingsScanBatch = 100
+)
+
+// Lat/lon bounding box, inclusive
+type BoundingBox struct {
+	MinLat float64 `json:"min_lat"`
+	MinLon float64 `json:"min_lon"`
+	MaxLat float64 `json:"max_lat"`
+	MaxLon float64 `json:"max_lon"`
+}
+
+func (bb *BoundingBox) Contains(lat, lon float64) bool {
+	return lat >= bb.MinLat && lat <= bb.MaxLat && lon >= bb.MinLon && lon <= bb.MaxLon
+}
+
+func (bb *BoundingBox) Validate() error {
+	if bb.MinLat < -90 || bb.MaxLat > 90 || bb.MinLon < -180 || bb.MaxLon > 180 {
+		return runtime.NewError("bbox out of range", codeInvalidArgument)
+	}
+	if bb.MinLat > bb.MaxLat || bb.MinLon > bb.MaxLon {
+		return runtime.NewError("bbox min must not exceed max", codeInvalidArgument)
+	}
+	return nil
+}
+
+type GetBuildingsRequest struct {
+	Cursor   string       `json:"cursor,omitempty"`
+	Limit    int          `json:"limit,omitempty"`
+	Status   string       `json:"status,omitempty"`
+	Category int          `json:"category,omitempty"`
+	BBox     *BoundingBox `json:"bbox,omitempty"`
+	// Footprints can be large, so they're left out unless asked for
+	IncludeGeometry bool `json:"include_geometry,omitempty"`
+}
+
+type GetBuildingsResponse struct {
+	Buildings []Building `json:"buildings"`
+	Cursor    string     `json:"cursor,omitempty"`
+	// Change token as of the first page, for get_buildings_changes afterwards
+	Token string `json:"token,omitempty"`
+}
+
+// Position in the buildings collection: a storage cursor plus how many
+// objects of that storage page were already consumed
+type buildingsCursor struct {
+	Storage string `json:"c,omitempty"`
+	Skip    int    `json:"s,omitempty"`
+}
+
+func encodeBuildingsCursor(c buildingsCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeBuildingsCursor(s string) (buildingsCursor, error) {
+	var c buildingsCursor
+	if s == "" {
+		return c, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, err
+	}
+	if c.Skip < 0 || c.Skip > buildingsScanBatch {
+		return c, fmt.Errorf("cursor offset %d out of range", c.Skip)
+	}
+	return c, nil
+}
+
+func (r *GetBuildingsRequest) matches(b *Building) bool {
+	if r.Status != "" && b.Status != r.Status {
+		return false
+	}
+	if r.Category != 0 {
+		found := false
+		for _, c := range b.Categories {
+			if c == r.Category {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.BBox != nil && !r.BBox.Contains(b.Lat, b.Lon) {
+		return false
+	}
+	return true
+}
+
+// RPC for clients to page through buildings in Nakama Storage.
+// Payload: {"cursor", "limit", "status", "category", "bbox": {min_lat, min_lon, max_lat, max_lon}, "include_geometry"}, all optional.
+// Returns {"buildings": [...], "cursor": "...", "token": "..."}; no cursor means the
+// last page. The first page carries a change token for get_buildings_changes.
+func rpcGetBuildings(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var req GetBuildingsRequest
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &req); err != nil {
+			return "", runtime.NewError("invalid payload", codeInvalidArgument)
+		}
+	}
+	if req.Limit <= 0 {
+		req.Limit = DefaultBuildingsPageSize
+	}
+	if req.Limit > MaxBuildingsPageSize {
+		req.Limit = MaxBuildingsPageSize
+	}
+	if req.BBox != nil {
+		if err := req.BBox.Validate(); err != nil {
+			return "", err
+		}
+	}
+	pos, err := decodeBuildingsCursor(req.Cursor)
+	if err != nil {
+		return "", runtime.NewError("invalid cursor", codeInvalidArgument)
+	}
+
+	config := cfg()
+	resp := GetBuildingsResponse{Buildings: []Building{}}
+	if req.Cursor == "" {
+		// Read before listing so changes made while paging are replayed, not lost
+		if resp.Token, err = currentChangeToken(ctx, nk); err != nil {
+			logger.Warn("Failed to read change token: %v", err)
+		}
+	}
+	for {
+		objects, next, err := nk.StorageList(ctx, "", "", "buildings", buildingsScanBatch, pos.Storage)
+		if err != nil {
+			logger.Error("Failed to list buildings: %v", err)
+			return "", runtime.NewError("failed to list buildings", codeInternal)
+		}
+
+		for i := pos.Skip; i < len(objects); i++ {
+			obj := objects[i]
+			b, err := decodeBuilding(obj.Value)
+			if err != nil {
+				nk.MetricsCounterAdd("buildings_decode_failures", map[string]string{"rpc": "get_buildings"}, 1)
+				logger.WithField("key", obj.Key).WithField("err", err).Warn("Skipping undecodable stored building")
+				continue
+			}
+			// Records stored before the current rewrite rules still get public URLs
+			if err := b.rewriteAssets(config); err != nil {
+				nk.MetricsCounterAdd("buildings_decode_failures", map[string]string{"rpc": "get_buildings"}, 1)
+				logger.WithField("key", obj.Key).WithField("err", err).Warn("Skipping building with unusable asset URL")
+				continue
+			}
+			if !req.matches(&b) {
+				continue
+			}
+			if !req.IncludeGeometry {
+				b.Geometry = nil
+			}
+
+			resp.Buildings = append(resp.Buildings, b)
+			if len(resp.Buildings) == req.Limit {
+				// Page full: resume after this object, or at the next storage page
+				if i+1 < len(objects) {
+					resp.Cursor = encodeBuildingsCursor(buildingsCursor{Storage: pos.Storage, Skip: i + 1})
+				} else if next != "" {
+					resp.Cursor = encodeBuildingsCursor(buildingsCursor{Storage: next})
+				}
+				return marshalBuildingsResponse(resp)
+			}
+		}
+
+		if next == "" || len(objects) == 0 {
+			return marshalBuildingsResponse(resp)
+		}
+		pos = buildingsCursor{Storage: next}
+	}
+}
+
+func marshalBuildingsResponse(resp GetBuildingsResponse) (string, error) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
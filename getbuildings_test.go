@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestBuildingsCursorRoundTrip(t *testing.T) {
+	for _, c := range []buildingsCursor{
+		{},
+		{Skip: 7},
+		{Storage: "H4sIAAAAAAAA/+Jg"},
+		{Storage: "opaque/storage+cursor=", Skip: buildingsScanBatch},
+	} {
+		s := encodeBuildingsCursor(c)
+		got, err := decodeBuildingsCursor(s)
+		if err != nil {
+			t.Errorf("%+v: decode(%q) failed: %v", c, s, err)
+			continue
+		}
+		if got != c {
+			t.Errorf("%+v: round trip gave %+v", c, got)
+		}
+	}
+}
+
+func TestDecodeBuildingsCursor(t *testing.T) {
+	raw := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		name    string
+		in      string
+		want    buildingsCursor
+		wantErr bool
+	}{
+		{"empty means first page", "", buildingsCursor{}, false},
+		{"storage and offset", raw(`{"c":"abc","s":3}`), buildingsCursor{Storage: "abc", Skip: 3}, false},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte(`{"s":1}`)), buildingsCursor{}, true},
+		{"not base64", "not a cursor!", buildingsCursor{}, true},
+		{"not json", raw("abc"), buildingsCursor{}, true},
+		{"negative offset", raw(`{"s":-1}`), buildingsCursor{}, true},
+		{"offset past batch", raw(`{"c":"abc","s":101}`), buildingsCursor{}, true},
+		{"wrong field type", raw(`{"s":"3"}`), buildingsCursor{}, true},
+	}
+	for _, tt := range tests {
+		got, err := decodeBuildingsCursor(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// Aggregated player positions per location cell, key=cell label
+	HeatmapCollection = "heatmap"
+
+	// How often in-memory counts are folded into storage
+	HeatmapFlushInterval = time.Minute
+)
+
+// Stored statistics for one cell. UserMinutes counts distinct users seen in
+// the cell per flush interval, roughly how many minutes players spent there.
+type HeatCell struct {
+	Lat         float64 `json:"lat"` // south-west corner
+	Lon         float64 `json:"lon"`
+	Size        float64 `json:"size"`
+	Samples     int64   `json:"samples"`
+	UserMinutes int64   `json:"user_minutes"`
+	LastAt      int64   `json:"last_at"`
+}
+
+type heatCounter struct {
+	lat, lon float64
+	samples  int64
+	users    map[string]struct{}
+}
+
+// Counts location updates per cell between flushes
+type Heatmap struct {
+	mu    sync.Mutex
+	cells map[string]*heatCounter
+}
+
+var heatmap = &Heatmap{cells: make(map[string]*heatCounter)}
+
+func (h *Heatmap) Record(userID string, lat, lon float64) {
+	cell := cellFor(lat, lon)
+	cellLat, cellLon := cell.Origin()
+	label := cell.Label()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c := h.cells[label]
+	if c == nil {
+		c = &heatCounter{lat: cellLat, lon: cellLon, users: make(map[string]struct{})}
+		h.cells[label] = c
+	}
+	c.samples++
+	c.users[userID] = struct{}{}
+}
+
+// Take the counts gathered so far and start over
+func (h *Heatmap) drain() map[string]*heatCounter {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	cells := h.cells
+	h.cells = make(map[string]*heatCounter)
+	return cells
+}
+
+// Add drained counts onto the stored cells
+func flushHeatmap(ctx context.Context, nk runtime.NakamaModule, cells map[string]*heatCounter) error {
+	if len(cells) == 0 {
+		return nil
+	}
+
+	reads := make([]*runtime.StorageRead, 0, len(cells))
+	for label := range cells {
+		reads = append(reads, &runtime.StorageRead{Collection: HeatmapCollection, Key: label, UserID: ""})
+	}
+	records, err := nk.StorageRead(ctx, reads)
+	if err != nil {
+		return err
+	}
+	stored := make(map[string]HeatCell, len(records))
+	for _, r := range records {
+		var hc HeatCell
+		if err := json.Unmarshal([]byte(r.Value), &hc); err == nil {
+			stored[r.Key] = hc
+		}
+	}
+
+	now := time.Now().Unix()
+	writes := make([]*runtime.StorageWrite, 0, len(cells))
+	for label, c := range cells {
+		hc := stored[label]
+		hc.Lat, hc.Lon, hc.Size = c.lat, c.lon, CellSize
+		hc.Samples += c.samples
+		hc.UserMinutes += int64(len(c.users))
+		hc.LastAt = now
+
+		val, _ := json.Marshal(hc)
+		writes = append(writes, &runtime.StorageWrite{
+			Collection:      HeatmapCollection,
+			Key:             label,
+			UserID:          "",
+			Value:           string(val),
+			PermissionRead:  0,
+			PermissionWrite: 0,
+		})
+	}
+	if _, err := nk.StorageWrite(ctx, writes); err != nil {
+		return fmt.Errorf("error writing %d heatmap cells: %w", len(writes), err)
+	}
+	return nil
+}
+
+func startHeatmapFlusher(logger runtime.Logger, nk runtime.NakamaModule) {
+	go func() {
+		ticker := time.NewTicker(HeatmapFlushInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := flushHeatmap(context.Background(), nk, heatmap.drain()); err != nil {
+				logger.Error("Failed to flush heatmap: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// runtime.Logger that drops everything
+type nopLogger struct{}
+
+func (nopLogger) Debug(format string, v ...interface{})                     {}
+func (nopLogger) Info(format string, v ...interface{})                      {}
+func (nopLogger) Warn(format string, v ...interface{})                      {}
+func (nopLogger) Error(format string, v ...interface{})                     {}
+func (l nopLogger) WithField(key string, v interface{}) runtime.Logger      { return l }
+func (l nopLogger) WithFields(fields map[string]interface{}) runtime.Logger { return l }
+func (nopLogger) Fields() map[string]interface{}                            { return nil }
+
+// In-memory storage with Nakama's version checks: "*" creates only, any other
+// non-empty version must match the stored one. Every other NakamaModule
+// method panics through the nil embedded interface.
+type fakeStorage struct {
+	runtime.NakamaModule
+
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	version int
+}
+
+type fakeObject struct {
+	value   string
+	version string
+}
+
+var errFakeVersion = errors.New("storage write rejected - version check failed")
+
+func newFakeStorage() *fakeStorage {
+	return &fakeStorage{objects: make(map[string]fakeObject)}
+}
+
+func fakeStorageKey(collection, userID, key string) string {
+	return collection + "/" + userID + "/" + key
+}
+
+func (s *fakeStorage) StorageRead(ctx context.Context, reads []*runtime.StorageRead) ([]*api.StorageObject, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found []*api.StorageObject
+	for _, r := range reads {
+		if obj, ok := s.objects[fakeStorageKey(r.Collection, r.UserID, r.Key)]; ok {
+			found = append(found, &api.StorageObject{Collection: r.Collection, Key: r.Key, UserId: r.UserID, Value: obj.value, Version: obj.version})
+		}
+	}
+	return found, nil
+}
+
+// Lists by key; the cursor is the last key of the previous page
+func (s *fakeStorage) StorageList(ctx context.Context, callerID, userID, collection string, limit int, cursor string) ([]*api.StorageObject, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prefix := fakeStorageKey(collection, userID, "")
+	var keys []string
+	for k := range s.objects {
+		if strings.HasPrefix(k, prefix) && strings.TrimPrefix(k, prefix) > cursor {
+			keys = append(keys, strings.TrimPrefix(k, prefix))
+		}
+	}
+	sort.Strings(keys)
+	next := ""
+	if len(keys) > limit {
+		keys = keys[:limit]
+		next = keys[limit-1]
+	}
+	objects := make([]*api.StorageObject, 0, len(keys))
+	for _, key := range keys {
+		obj := s.objects[prefix+key]
+		objects = append(objects, &api.StorageObject{Collection: collection, Key: key, UserId: userID, Value: obj.value, Version: obj.version})
+	}
+	return objects, next, nil
+}
+
+func (s *fakeStorage) StorageWrite(ctx context.Context, writes []*runtime.StorageWrite) ([]*api.StorageObjectAck, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeLocked(writes)
+}
+
+func (s *fakeStorage) StorageDelete(ctx context.Context, deletes []*runtime.StorageDelete) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range deletes {
+		delete(s.objects, fakeStorageKey(d.Collection, d.UserID, d.Key))
+	}
+	return nil
+}
+
+func (s *fakeStorage) MultiUpdate(ctx context.Context, accountUpdates []*runtime.AccountUpdate, storageWrites []*runtime.StorageWrite, storageDeletes []*runtime.StorageDelete, walletUpdates []*runtime.WalletUpdate, updateLedger bool) ([]*api.StorageObjectAck, []*runtime.WalletUpdateResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	acks, err := s.writeLocked(storageWrites)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, d := range storageDeletes {
+		delete(s.objects, fakeStorageKey(d.Collection, d.UserID, d.Key))
+	}
+	return acks, nil, nil
+}
+
+// All writes land or none do
+func (s *fakeStorage) writeLocked(writes []*runtime.StorageWrite) ([]*api.StorageObjectAck, error) {
+	for _, w := range writes {
+		obj, exists := s.objects[fakeStorageKey(w.Collection, w.UserID, w.Key)]
+		switch {
+		case w.Version == "*" && exists:
+			return nil, errFakeVersion
+		case w.Version != "" && w.Version != "*" && (!exists || obj.version != w.Version):
+			return nil, errFakeVersion
+		}
+	}
+	acks := make([]*api.StorageObjectAck, 0, len(writes))
+	for _, w := range writes {
+		s.version++
+		version := strconv.Itoa(s.version)
+		s.objects[fakeStorageKey(w.Collection, w.UserID, w.Key)] = fakeObject{value: w.Value, version: version}
+		acks = append(acks, &api.StorageObjectAck{Collection: w.Collection, Key: w.Key, UserId: w.UserID, Version: version})
+	}
+	return acks, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// Buildings that exist in WordPress but must not be shown to players
+	// (drafts, pending review, private, scheduled, trashed)
+	DraftsCollection = "buildings_drafts"
+	// Scheduled publishes for "future" posts, key=id
+	ScheduleCollection = "building_schedule"
+
+	SchedulerInterval = 30 * time.Second
+)
+
+// WordPress post statuses the notifier plugin sends
+const (
+	StatusPublish   = "publish"
+	StatusDraft     = "draft"
+	StatusAutoDraft = "auto-draft"
+	StatusPending   = "pending"
+	StatusPrivate   = "private"
+	StatusFuture    = "future"
+	StatusTrash     = "trash"
+)
+
+// Pending publish of a scheduled ("future") post
+type BuildingSchedule struct {
+	ID        int   `json:"id"`
+	PublishAt int64 `json:"publish_at"`
+}
+
+// Check an incoming revision against both the visible and the hidden copy
+func isStalePush(ctx context.Context, nk runtime.NakamaModule, id int, modifiedGMT string) (bool, error) {
+	incoming := parseModifiedGMT(modifiedGMT)
+	if incoming.IsZero() {
+		return false, nil
+	}
+	key := strconv.Itoa(id)
+	records, err := nk.StorageRead(ctx, []*runtime.StorageRead{
+		{Collection: "buildings", Key: key, UserID: ""},
+		{Collection: DraftsCollection, Key: key, UserID: ""},
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, r := range records {
+		var current struct {
+			ModifiedGMT string `json:"modified_gmt"`
+		}
+		_ = json.Unmarshal([]byte(r.Value), &current)
+		if stored := parseModifiedGMT(current.ModifiedGMT); !stored.IsZero() && incoming.Before(stored) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func readHiddenBuilding(ctx context.Context, nk runtime.NakamaModule, id int) (*Building, error) {
+	records, err := nk.StorageRead(ctx, []*runtime.StorageRead{{
+		Collection: DraftsCollection,
+		Key:        strconv.Itoa(id),
+		UserID:     "",
+	}})
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	b, err := decodeBuilding(records[0].Value)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// Store a hidden copy and show it to preview sessions
+func writeHiddenBuilding(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, b *Building) error {
+	if err := b.normalize(); err != nil {
+		return err
+	}
+	val, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	_, err = nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      DraftsCollection,
+		Key:             b.Key(),
+		UserID:          "",
+		Value:           string(val),
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}})
+	if err != nil {
+		return err
+	}
+	notifyPreviewUpdate(logger, nk, *b)
+	return nil
+}
+
+func deleteHiddenBuilding(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, id int) error {
+	if err := nk.StorageDelete(ctx, []*runtime.StorageDelete{
+		{Collection: DraftsCollection, Key: strconv.Itoa(id), UserID: ""},
+		{Collection: ScheduleCollection, Key: strconv.Itoa(id), UserID: ""},
+	}); err != nil {
+		return err
+	}
+	notifyPreviewDelete(logger, nk, id)
+	return nil
+}
+
+// Make a building visible to players and drop any hidden copy or pending schedule
+func publishBuilding(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, b Building) error {
+	b.Status = StatusPublish
+	prev := previousBuilding(b.ID)
+	if err := upsertBuilding(ctx, logger, nk, &b); err != nil {
+		return err
+	}
+	if err := deleteHiddenBuilding(ctx, logger, nk, b.ID); err != nil {
+		logger.Error("Failed to clear hidden copy of building %d: %v", b.ID, err)
+	}
+	notifyBuildingUpdate(ctx, logger, nk, b, prev)
+	return nil
+}
+
+// Take a building away from players, keeping a hidden copy with the given
+// status. hidden may be nil when the push had no usable fields, then the
+// visible copy is kept instead.
+func hideBuilding(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, id int, status string, hidden *Building) error {
+	prev := previousBuilding(id)
+	if hidden == nil && prev != nil {
+		copied := *prev
+		hidden = &copied
+	}
+	if hidden != nil {
+		hidden.Status = status
+		if err := writeHiddenBuilding(ctx, logger, nk, hidden); err != nil {
+			return fmt.Errorf("error storing hidden building %d: %w", id, err)
+		}
+	}
+
+	// Delete even when the index doesn't know the building: it may be out of
+	// sync with storage. prev only decides which cells hear about it.
+	if err := deleteBuildings(ctx, logger, nk, []int{id}); err != nil {
+		return err
+	}
+	notifyBuildingDelete(ctx, logger, nk, id, prev)
+	return nil
+}
+
+// Remove every trace of a building, visible or not
+func purgeBuilding(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, id int) error {
+	prev := previousBuilding(id)
+	if err := deleteHiddenBuilding(ctx, logger, nk, id); err != nil {
+		return err
+	}
+	if err := deleteBuildings(ctx, logger, nk, []int{id}); err != nil {
+		return err
+	}
+	notifyBuildingDelete(ctx, logger, nk, id, prev)
+	return nil
+}
+
+func scheduleBuilding(ctx context.Context, nk runtime.NakamaModule, id int, at time.Time) error {
+	val, _ := json.Marshal(BuildingSchedule{ID: id, PublishAt: at.Unix()})
+	_, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      ScheduleCollection,
+		Key:             strconv.Itoa(id),
+		UserID:          "",
+		Value:           string(val),
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}})
+	return err
+}
+
+// Publish every scheduled building whose date has come
+func runScheduledPublishes(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule) error {
+	now := time.Now().Unix()
+	cursor := ""
+	for {
+		objects, next, err := nk.StorageList(ctx, "", "", ScheduleCollection, 100, cursor)
+		if err != nil {
+			return err
+		}
+		for _, obj := range objects {
+			var s BuildingSchedule
+			if err := json.Unmarshal([]byte(obj.Value), &s); err != nil || s.PublishAt > now {
+				continue
+			}
+
+			hidden, err := readHiddenBuilding(ctx, nk, s.ID)
+			if err != nil {
+				logger.Error("Failed to read scheduled building %d: %v", s.ID, err)
+				continue
+			}
+			if hidden == nil {
+				logger.Warn("Scheduled building %d has no stored copy, dropping schedule", s.ID)
+				_ = nk.StorageDelete(ctx, []*runtime.StorageDelete{{Collection: ScheduleCollection, Key: obj.Key, UserID: ""}})
+				continue
+			}
+			if err := publishBuilding(ctx, logger, nk, *hidden); err != nil {
+				logger.Error("Failed to publish scheduled building %d: %v", s.ID, err)
+				continue
+			}
+			logger.Info("Published scheduled building %d", s.ID)
+		}
+		if next == "" || len(objects) == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+func startBuildingScheduler(logger runtime.Logger, nk runtime.NakamaModule) {
+	go func() {
+		ticker := time.NewTicker(SchedulerInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := runScheduledPublishes(context.Background(), logger, nk); err != nil {
+				logger.Error("Failed to run scheduled publishes: %v", err)
+			}
+		}
+	}()
+}
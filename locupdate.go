@@ -4,131 +4,134 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
-	"fmt"
+	"time"
 
 	"github.com/heroiclabs/nakama-common/runtime"
 )
 
+// Put the caller's session in the cells around their position. The server
+// snaps the position to the grid, so clients never build cell labels themselves.
+// Payload: {"lat", "lon", "view"?, "radius"?}; view is "ar" (default) or "map"
+// and radius overrides the view's default reach in meters. Returns the
+// subscription set ({home, cells, joined, left, view, radius, level}) with
+// the last known positions of everyone in the level 0 cells ({occupants})
+// and the current summary of every occupied coarse cell ({summaries}).
 func rpcJoinCell(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
 	userID := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
-    sessionID := ctx.Value(runtime.RUNTIME_CTX_SESSION_ID).(string)
-
-    // Decode payload JSON
-    var data struct {
-        Lat float64 `json:"lat"`
-        Lon float64 `json:"lon"`
-    }
-    if err := json.Unmarshal([]byte(payload), &data); err != nil {
-        return "", runtime.NewError("invalid payload", 3)
-    }
-
-    // Join the cell stream
-    label := fmt.Sprintf("cell_%f_%f", data.Lat, data.Lon)
-    if _, err := nk.StreamUserJoin(StreamMode, "", "", label, userID, sessionID, false, false, ""); err != nil {
-        return "", fmt.Errorf("failed to join cell: %w", err)
-    }
-
-    return `{"ok":true}`, nil
+	sessionID := ctx.Value(runtime.RUNTIME_CTX_SESSION_ID).(string)
+
+	lat, lon, ok := positionFromPayload(payload)
+	if !ok {
+		return "", runtime.NewError("lat and lon must be valid coordinates", codeInvalidArgument)
+	}
+	opts, err := viewFromPayload(payload)
+	if err != nil {
+		return "", err
+	}
+
+	state, err := moveSubscription(ctx, nk, userID, sessionID, lat, lon, opts)
+	if err != nil {
+		logger.WithField("err", err).Error("failed to update cell subscription")
+		return "", runtime.NewError("failed to join cells", codeInternal)
+	}
+	state.Occupants = positions.Snapshot(interestCells(lat, lon, 0), userID, time.Now())
+	if state.Level > 0 {
+		state.Summaries = coarseCells.Summaries(interestCells(lat, lon, state.Level))
+	}
+	return marshalSubscription(state)
 }
 
+// Take the caller's session out of every cell stream
 func rpcLeaveCell(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
-    userID := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
-    sessionID := ctx.Value(runtime.RUNTIME_CTX_SESSION_ID).(string)
-
-    // Optional: decode payload if you want to specify a group/cell
-    var data struct {
-        Lat float64 `json:"lat,omitempty"`
-        Lon float64 `json:"lon,omitempty"`
-    }
-    _ = json.Unmarshal([]byte(payload), &data) // ignore error if optional
-
-    // Leave all cell streams if lat/lon provided
-    if data.Lat != 0 || data.Lon != 0 {
-        label := fmt.Sprintf("cell_%f_%f", data.Lat, data.Lon)
-        _ = nk.StreamUserLeave(StreamMode, "", "", label, userID, sessionID)
-    }
-	return `{"ok":true}`, nil
+	userID := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+	sessionID := ctx.Value(runtime.RUNTIME_CTX_SESSION_ID).(string)
+
+	sub, err := dropSubscription(nk, sessionID)
+	if err != nil {
+		logger.WithField("err", err).Warn("failed to leave some cell streams")
+	}
+	if !subscriptions.HasUser(userID) {
+		positions.Remove(userID)
+		coarseCells.Remove(userID)
+	}
+	return marshalSubscription(SubscriptionState{Cells: []string{}, Left: sub.labels()})
 }
 
-func sendCellData(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
-    userID := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
-
-    // Decode payload only to extract lat/lon for the cell label
-    var payloadMap map[string]interface{}
-    if err := json.Unmarshal([]byte(payload), &payloadMap); err != nil {
-        return "", runtime.NewError("invalid payload", 3)
-    }
-
-    lat, okLat := payloadMap["lat"].(float64)
-    lon, okLon := payloadMap["lon"].(float64)
-    data, okData := payloadMap["data"]
-    if !okLat || !okLon || !okData {
-        return "", runtime.NewError("missing lat, lon, or data fields", 3)
-    }
-
-    // Construct the JSON object to send
-    msgBytes, err := json.Marshal(map[string]interface{}{
-        "user_id": userID,
-        "data":    data,
-		"group":   nil,
-    })
-    if err != nil {
-        return "", fmt.Errorf("failed to marshal message: %w", err)
-    }
-
-    // Send to the cell stream
-    cellLabel := fmt.Sprintf("cell_%f_%f", lat, lon)
-    if err := nk.StreamSend(StreamMode, "", "", cellLabel, string(msgBytes), nil, true); err != nil {
-        return "", fmt.Errorf("failed to send to cell stream: %w", err)
-    }
-
-    return `{"ok":true}`, nil
+func viewFromPayload(payload string) (ViewOptions, error) {
+	var opts ViewOptions
+	if err := json.Unmarshal([]byte(payload), &opts); err != nil {
+		return opts, runtime.NewError("invalid payload", codeInvalidArgument)
+	}
+	if err := opts.Validate(); err != nil {
+		return opts, runtime.NewError(err.Error(), codeInvalidArgument)
+	}
+	return opts, nil
 }
 
-func sendGroupData(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
-    userID := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
-
-    var payloadMap map[string]interface{}
-    if err := json.Unmarshal([]byte(payload), &payloadMap); err != nil {
-        return "", runtime.NewError("invalid payload", 3)
-    }
-    data, ok := payloadMap["data"]
-    if !ok {
-        return "", runtime.NewError("missing data field", 3)
-    }
-    groupVal, ok := payloadMap["group"]
-    if !ok {
-        return "", runtime.NewError("missing data field", 3)
-    }
-
-	group, ok := groupVal.(string)
-    if !ok || group == "" {
-        return "", runtime.NewError("group must be a string", 3)
-    }
-
-    msgBytes, _ := json.Marshal(map[string]interface{}{
-        "user_id":    userID,
-        "data":       data,
-        "group":      group,
-    })
-
-    if err := nk.StreamSend(StreamMode, "", "", group, string(msgBytes), nil, true); err != nil {
-        logger.WithField("group", group).WithField("err", err).Error("Failed to send to group stream")
-        return "", err
-    }
-
-    return `{"ok":true}`, nil
+func marshalSubscription(state SubscriptionState) (string, error) {
+	if state.Cells == nil {
+		state.Cells = []string{}
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
 }
 
+// Position update. Payload: {"lat", "lon", "data"?, "group"?, "view"?, "radius"?};
+// "data" is relayed as is (defaults to {lat, lon}). Moves the session's cell
+// subscription along, queues the position for the home cell and group
+// batches (see LocationBatcher), feeds the coarse
+// cell summaries and returns the subscription set, with a snapshot of the
+// occupants of any level 0 cell and the summary of any coarse cell it just joined.
 func rpcSendLocation(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
-    if _, err := sendCellData(ctx, logger, db, nk, payload); err != nil {
-		logger.WithField("err", err).Error("failed to send to cell stream")
-		return "", err
+	userID := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+	sessionID := ctx.Value(runtime.RUNTIME_CTX_SESSION_ID).(string)
+
+	var msg struct {
+		Data  interface{} `json:"data"`
+		Group interface{} `json:"group"`
+	}
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+		return "", runtime.NewError("invalid payload", codeInvalidArgument)
 	}
-    if _, err := sendGroupData(ctx, logger, db, nk, payload); err != nil {
-        logger.WithField("err", err).Error("failed to send to group stream")
+	lat, lon, ok := positionFromPayload(payload)
+	if !ok {
+		return "", runtime.NewError("lat and lon must be valid coordinates", codeInvalidArgument)
+	}
+	if msg.Data == nil {
+		msg.Data = map[string]float64{"lat": lat, "lon": lon}
+	}
+	group, ok := msg.Group.(string)
+	if msg.Group != nil && (!ok || group == "") {
+		return "", runtime.NewError("group must be a string", codeInvalidArgument)
+	}
+	opts, err := viewFromPayload(payload)
+	if err != nil {
 		return "", err
-    }
+	}
 
-    return `{"ok":true}`, nil
-}
\ No newline at end of file
+	state, err := moveSubscription(ctx, nk, userID, sessionID, lat, lon, opts)
+	if err != nil {
+		logger.WithField("err", err).Error("failed to update cell subscription")
+		return "", runtime.NewError("failed to update cells", codeInternal)
+	}
+
+	locationBatches.Queue(state.Home, PositionUpdate{UserID: userID, Data: msg.Data, Cell: state.Home})
+	if group != "" {
+		locationBatches.Queue(group, PositionUpdate{UserID: userID, Data: msg.Data, Group: group})
+	}
+
+	now := time.Now()
+	positions.Update(userID, cellFor(lat, lon), msg.Data, now)
+	coarseCells.Record(userID, lat, lon, now)
+	state.Occupants = positions.Snapshot(state.joinedFine, userID, now)
+	state.Summaries = coarseCells.Summaries(state.joinedCoarse)
+
+	// Check the player's actual position against building geofences
+	heatmap.Record(userID, lat, lon)
+	evaluateGeofences(ctx, logger, nk, userID, lat, lon)
+
+	return marshalSubscription(state)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// Positions not refreshed for this long drop out of coarse summaries
+	CoarsePositionTTL = 2 * time.Minute
+
+	// How many levels below a coarse cell its clusters are cut at
+	CoarseClusterDepth = 2
+)
+
+// Players in one sub-cell of a coarse cell, placed at the sub-cell's center
+// so summaries never carry anyone's exact position
+type CoarseCluster struct {
+	Lat   float64 `json:"lat"`
+	Lon   float64 `json:"lon"`
+	Count int     `json:"count"`
+}
+
+// Stream message for a coarse cell. It replaces whatever the cell showed
+// before, so an empty cluster list means the cell emptied out.
+type CellSummary struct {
+	Type     string          `json:"type"` // "cell_summary"
+	Cell     string          `json:"cell"`
+	Level    int             `json:"level"`
+	Clusters []CoarseCluster `json:"clusters"`
+}
+
+// Sub-cell a coarse cell's clusters are cut at
+func clusterLevel(level int) int {
+	if level <= CoarseClusterDepth {
+		return 0
+	}
+	return level - CoarseClusterDepth
+}
+
+// Which sub-cell every player is in, for every coarse cell. Updates only
+// mark cells dirty; the flusher sends one summary per dirty cell, level N
+// cells every N ticks, so the coarser the cell the rarer its updates.
+type CoarseCells struct {
+	mu    sync.Mutex
+	cells map[CellID]map[string]CellID // coarse cell -> user id -> sub-cell
+	users map[string][]CellID          // cell per level, index 0 is level 1
+	seen  map[string]time.Time
+	dirty map[CellID]bool
+}
+
+var coarseCells = &CoarseCells{
+	cells: make(map[CellID]map[string]CellID),
+	users: make(map[string][]CellID),
+	seen:  make(map[string]time.Time),
+	dirty: make(map[CellID]bool),
+}
+
+func (c *CoarseCells) Record(userID string, lat, lon float64, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	prev := c.users[userID]
+	cur := make([]CellID, MaxCellLevel)
+	for level := 1; level <= MaxCellLevel; level++ {
+		cell := cellAt(lat, lon, level)
+		cur[level-1] = cell
+		if prev != nil && prev[level-1] != cell {
+			c.removeLocked(prev[level-1], userID)
+		}
+		players := c.cells[cell]
+		if players == nil {
+			players = make(map[string]CellID)
+			c.cells[cell] = players
+		}
+		// Moves within the same sub-cell change nothing anyone sees
+		sub := cellAt(lat, lon, clusterLevel(level))
+		if prev, ok := players[userID]; !ok || prev != sub {
+			players[userID] = sub
+			c.dirty[cell] = true
+		}
+	}
+	c.users[userID] = cur
+	c.seen[userID] = now
+}
+
+func (c *CoarseCells) Remove(userID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeUserLocked(userID)
+}
+
+func (c *CoarseCells) removeUserLocked(userID string) {
+	for _, cell := range c.users[userID] {
+		c.removeLocked(cell, userID)
+	}
+	delete(c.users, userID)
+	delete(c.seen, userID)
+}
+
+func (c *CoarseCells) removeLocked(cell CellID, userID string) {
+	players := c.cells[cell]
+	if _, ok := players[userID]; !ok {
+		return
+	}
+	delete(players, userID)
+	if len(players) == 0 {
+		delete(c.cells, cell)
+	}
+	c.dirty[cell] = true
+}
+
+// Current summaries of the given cells, skipping empty ones. Clients get
+// these when they join a cell; after that only changes are sent.
+func (c *CoarseCells) Summaries(cells []CellID) []CellSummary {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var summaries []CellSummary
+	for _, cell := range cells {
+		if players := c.cells[cell]; len(players) > 0 {
+			summaries = append(summaries, summarizeCell(cell, players))
+		}
+	}
+	return summaries
+}
+
+// Summaries due at this tick for cells someone watches. Stale players are
+// dropped first; dirty cells nobody watches are just forgotten.
+func (c *CoarseCells) due(tick int, now time.Time, watched map[CellID]bool) []CellSummary {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for userID, at := range c.seen {
+		if now.Sub(at) > CoarsePositionTTL {
+			c.removeUserLocked(userID)
+		}
+	}
+
+	var summaries []CellSummary
+	for cell := range c.dirty {
+		if tick%cell.Level != 0 {
+			continue
+		}
+		delete(c.dirty, cell)
+		if watched[cell] {
+			summaries = append(summaries, summarizeCell(cell, c.cells[cell]))
+		}
+	}
+	return summaries
+}
+
+func summarizeCell(cell CellID, players map[string]CellID) CellSummary {
+	summary := CellSummary{Type: "cell_summary", Cell: cell.Label(), Level: cell.Level, Clusters: []CoarseCluster{}}
+	counts := make(map[CellID]int)
+	for _, sub := range players {
+		counts[sub]++
+	}
+	half := cellSize(clusterLevel(cell.Level)) / 2
+	for sub, count := range counts {
+		lat, lon := sub.Origin()
+		summary.Clusters = append(summary.Clusters, CoarseCluster{Lat: lat + half, Lon: lon + half, Count: count})
+	}
+	sort.Slice(summary.Clusters, func(i, j int) bool {
+		a, b := summary.Clusters[i], summary.Clusters[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.Lat != b.Lat {
+			return a.Lat < b.Lat
+		}
+		return a.Lon < b.Lon
+	})
+	return summary
+}
+
+// Send coarse cell summaries every coarse_tick
+func startCoarseFlusher(logger runtime.Logger, nk runtime.NakamaModule) {
+	go func() {
+		ticker := time.NewTicker(cfg().CoarseTick)
+		defer ticker.Stop()
+		tick := 0
+		for now := range ticker.C {
+			tick++
+			for _, summary := range coarseCells.due(tick, now, subscriptions.coarseCells()) {
+				msg, _ := json.Marshal(summary)
+				if err := nk.StreamSend(cfg().StreamMode, "", "", summary.Cell, string(msg), nil, true); err != nil {
+					logger.WithField("stream", summary.Cell).WithField("err", err).Warn("Failed to send cell summary")
+				}
+			}
+		}
+	}()
+}
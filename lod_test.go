@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+func TestCoarseSummaryHidesPositions(t *testing.T) {
+	c := &CoarseCells{
+		cells: make(map[CellID]map[string]CellID),
+		users: make(map[string][]CellID),
+		seen:  make(map[string]time.Time),
+		dirty: make(map[CellID]bool),
+	}
+	now := time.Now()
+	c.Record("alice", 0.00123, 0.00147, now)
+	c.Record("bob", 0.00171, 0.00102, now)
+	c.Record("carol", 0.0101, 0.0003, now)
+
+	tests := []struct {
+		level int
+		want  []CoarseCluster
+	}{
+		// Level 1 clusters on level 0 cells (0.002 degrees)
+		{1, []CoarseCluster{{Lat: 0.001, Lon: 0.001, Count: 2}}},
+		// Level 3 clusters on level 1 cells (0.004 degrees)
+		{3, []CoarseCluster{{Lat: 0.002, Lon: 0.002, Count: 2}, {Lat: 0.010, Lon: 0.002, Count: 1}}},
+	}
+	for _, tt := range tests {
+		cell := cellAt(0, 0, tt.level)
+		summary := summarizeCell(cell, c.cells[cell])
+		if len(summary.Clusters) != len(tt.want) {
+			t.Errorf("level %d: clusters = %+v, want %+v", tt.level, summary.Clusters, tt.want)
+			continue
+		}
+		for i, want := range tt.want {
+			got := summary.Clusters[i]
+			if got.Count != want.Count || !closeTo(got.Lat, want.Lat) || !closeTo(got.Lon, want.Lon) {
+				t.Errorf("level %d cluster %d = %+v, want %+v", tt.level, i, got, want)
+			}
+		}
+
+		data, _ := json.Marshal(summary)
+		if strings.Contains(string(data), "alice") || strings.Contains(string(data), "0.00123") {
+			t.Errorf("level %d summary leaks a player: %s", tt.level, data)
+		}
+	}
+
+	// Moving within the same sub-cell leaves nothing to resend
+	c.dirty = make(map[CellID]bool)
+	c.Record("alice", 0.0011, 0.0012, now)
+	if len(c.dirty) != 0 {
+		t.Errorf("move within a sub-cell marked %d cells dirty", len(c.dirty))
+	}
+	c.Remove("carol")
+	if !c.dirty[cellAt(0, 0, 3)] {
+		t.Error("removing a player did not mark their cell dirty")
+	}
+}
+
+func closeTo(a, b float64) bool {
+	d := a - b
+	return d < 1e-9 && d > -1e-9
+}
+
+func TestJoinCoarseCellDeliversSummary(t *testing.T) {
+	const lat, lon = 0.0005, 0.0005
+	// Someone already sits in the coarse cells around the joiner
+	coarseCells.Record("other", lat+0.003, lon+0.003, time.Now())
+	defer coarseCells.Remove("other")
+	defer subscriptions.Remove("joiner-session")
+
+	ctx := context.WithValue(context.Background(), runtime.RUNTIME_CTX_USER_ID, "joiner")
+	ctx = context.WithValue(ctx, runtime.RUNTIME_CTX_SESSION_ID, "joiner-session")
+	nk := &fakeStreams{joined: make(map[string]bool)}
+	payload, err := rpcJoinCell(ctx, nopLogger{}, nil, nk, `{"lat":0.0005,"lon":0.0005,"view":"map"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var state struct {
+		Level     int           `json:"level"`
+		Summaries []CellSummary `json:"summaries"`
+	}
+	if err := json.Unmarshal([]byte(payload), &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Level == 0 {
+		t.Fatalf("map view joined no coarse level: %s", payload)
+	}
+	want := cellAt(lat, lon, state.Level).Label()
+	for _, s := range state.Summaries {
+		if s.Cell == want && len(s.Clusters) == 1 && s.Clusters[0].Count == 1 {
+			return
+		}
+	}
+	t.Errorf("no summary for occupied coarse cell %s in %s", want, payload)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const MediaCacheCollection = "media_cache"
+
+// Cached media older than this is re-checked in full. The cheaper
+// modified_after check can't tell that a media item was deleted.
+const MediaCacheTTL = 6 * time.Hour
+
+// The media item is gone from WordPress. Unlike a failed lookup this won't
+// fix itself, so buildings referencing it are stored without an image.
+var errMediaNotFound = errors.New("media not found")
+
+type WPMedia struct {
+	ID          int    `json:"id"`
+	SourceURL   string `json:"source_url"`
+	Modified    string `json:"modified"`
+	ModifiedGMT string `json:"modified_gmt"`
+}
+
+// Resolved media ID -> URL, with the WP modified dates used to spot changes
+type CachedMedia struct {
+	ID          int    `json:"id"`
+	URL         string `json:"url"`
+	Modified    string `json:"modified"`
+	ModifiedGMT string `json:"modified_gmt"`
+	FetchedAt   int64  `json:"fetched_at"`
+}
+
+// Persistent media lookup cache used by WordPressSource
+type MediaCache interface {
+	Get(ctx context.Context, ids []int) (map[int]CachedMedia, error)
+	Put(ctx context.Context, entries []CachedMedia) error
+	Delete(ctx context.Context, ids []int) error
+}
+
+// MediaCache backed by the "media_cache" storage collection, one record per media ID
+type storageMediaCache struct {
+	nk runtime.NakamaModule
+}
+
+func newStorageMediaCache(nk runtime.NakamaModule) MediaCache {
+	return &storageMediaCache{nk: nk}
+}
+
+func (c *storageMediaCache) Get(ctx context.Context, ids []int) (map[int]CachedMedia, error) {
+	result := make(map[int]CachedMedia, len(ids))
+	if len(ids) == 0 {
+		return result, nil
+	}
+
+	reads := make([]*runtime.StorageRead, 0, len(ids))
+	for _, id := range ids {
+		reads = append(reads, &runtime.StorageRead{Collection: MediaCacheCollection, Key: strconv.Itoa(id), UserID: ""})
+	}
+	records, err := c.nk.StorageRead(ctx, reads)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		var entry CachedMedia
+		if err := json.Unmarshal([]byte(r.Value), &entry); err == nil && entry.URL != "" {
+			result[entry.ID] = entry
+		}
+	}
+	return result, nil
+}
+
+func (c *storageMediaCache) Put(ctx context.Context, entries []CachedMedia) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	writes := make([]*runtime.StorageWrite, 0, len(entries))
+	for _, e := range entries {
+		val, _ := json.Marshal(e)
+		writes = append(writes, &runtime.StorageWrite{
+			Collection:      MediaCacheCollection,
+			Key:             strconv.Itoa(e.ID),
+			UserID:          "",
+			Value:           string(val),
+			PermissionRead:  0,
+			PermissionWrite: 0,
+		})
+	}
+	_, err := c.nk.StorageWrite(ctx, writes)
+	return err
+}
+
+func (c *storageMediaCache) Delete(ctx context.Context, ids []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	deletes := make([]*runtime.StorageDelete, 0, len(ids))
+	for _, id := range ids {
+		deletes = append(deletes, &runtime.StorageDelete{Collection: MediaCacheCollection, Key: strconv.Itoa(id), UserID: ""})
+	}
+	return c.nk.StorageDelete(ctx, deletes)
+}
+
+// Fetch up to wpPerPage media items in one request using include=
+func (s *WordPressSource) fetchMediaBatch(ctx context.Context, ids []int, modifiedAfter string) ([]WPMedia, error) {
+	include := make([]string, len(ids))
+	for i, id := range ids {
+		include[i] = strconv.Itoa(id)
+	}
+	q := url.Values{}
+	q.Set("include", strings.Join(include, ","))
+	q.Set("per_page", strconv.Itoa(wpPerPage))
+	q.Set("_fields", "id,source_url,modified,modified_gmt")
+	if modifiedAfter != "" {
+		q.Set("modified_after", modifiedAfter)
+	}
+
+	resp, err := s.get(ctx, s.BaseURL+"/wp-json/wp/v2/media?"+q.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("error fetching media: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("media lookup returned status %d", resp.StatusCode)
+	}
+
+	var media []WPMedia
+	if err := json.Unmarshal(body, &media); err != nil {
+		return nil, fmt.Errorf("error unmarshalling media: %w", err)
+	}
+	return media, nil
+}
+
+func chunkIDs(ids []int, size int) [][]int {
+	var chunks [][]int
+	for len(ids) > size {
+		chunks = append(chunks, ids[:size])
+		ids = ids[size:]
+	}
+	if len(ids) > 0 {
+		chunks = append(chunks, ids)
+	}
+	return chunks
+}
+
+// Resolve media IDs to URLs. Uncached IDs are fetched in batches; cached IDs are
+// re-checked with modified_after so only media edited since caching is refetched,
+// and in full once older than MediaCacheTTL so deleted media drops out.
+// Returns the URLs plus a per-ID error for anything that couldn't be resolved.
+func (s *WordPressSource) resolveMedia(ctx context.Context, logger runtime.Logger, ids []int) (map[int]string, map[int]error) {
+	urls := make(map[int]string, len(ids))
+	failed := make(map[int]error)
+
+	cached := map[int]CachedMedia{}
+	if s.Media != nil {
+		var err error
+		if cached, err = s.Media.Get(ctx, ids); err != nil {
+			logger.Warn("Media cache read failed, fetching everything: %v", err)
+			cached = map[int]CachedMedia{}
+		}
+	}
+
+	now := time.Now().Unix()
+	var missing, known, stale []int
+	for _, id := range ids {
+		entry, ok := cached[id]
+		switch {
+		case !ok:
+			missing = append(missing, id)
+		case now-entry.FetchedAt >= int64(MediaCacheTTL/time.Second):
+			stale = append(stale, id)
+		default:
+			known = append(known, id)
+		}
+	}
+
+	var updates []CachedMedia
+	store := func(m WPMedia) {
+		entry := CachedMedia{ID: m.ID, URL: m.SourceURL, Modified: m.Modified, ModifiedGMT: m.ModifiedGMT, FetchedAt: now}
+		cached[m.ID] = entry
+		updates = append(updates, entry)
+	}
+
+	for _, chunk := range chunkIDs(missing, wpPerPage) {
+		media, err := s.fetchMediaBatch(ctx, chunk, "")
+		if err != nil {
+			for _, id := range chunk {
+				failed[id] = err
+			}
+			continue
+		}
+		for _, m := range media {
+			if m.SourceURL != "" {
+				store(m)
+			}
+		}
+		for _, id := range chunk {
+			if _, ok := cached[id]; !ok {
+				failed[id] = fmt.Errorf("media %d: %w", id, errMediaNotFound)
+			}
+		}
+	}
+
+	// Full re-check of stale entries; anything WordPress no longer returns is gone
+	var gone []int
+	for _, chunk := range chunkIDs(stale, wpPerPage) {
+		media, err := s.fetchMediaBatch(ctx, chunk, "")
+		if err != nil {
+			logger.Warn("Media re-check failed, using cached URLs: %v", err)
+			continue
+		}
+		returned := make(map[int]bool, len(media))
+		for _, m := range media {
+			if m.SourceURL != "" {
+				returned[m.ID] = true
+				store(m)
+			}
+		}
+		for _, id := range chunk {
+			if !returned[id] {
+				logger.Debug("Media %d no longer exists, dropping it from the cache", id)
+				delete(cached, id)
+				gone = append(gone, id)
+				failed[id] = fmt.Errorf("media %d: %w", id, errMediaNotFound)
+			}
+		}
+	}
+
+	// Invalidate cached entries whose media changed. Oldest "modified" in the
+	// chunk is the cut-off so nothing edited after it was cached is missed.
+	for _, chunk := range chunkIDs(known, wpPerPage) {
+		oldest := ""
+		for _, id := range chunk {
+			if m := cached[id].Modified; oldest == "" || m < oldest {
+				oldest = m
+			}
+		}
+		media, err := s.fetchMediaBatch(ctx, chunk, oldest)
+		if err != nil {
+			// Keep serving cached URLs, they were valid last time we looked
+			logger.Warn("Media change check failed, using cached URLs: %v", err)
+			continue
+		}
+		for _, m := range media {
+			if c := cached[m.ID]; m.SourceURL != "" && (m.ModifiedGMT != c.ModifiedGMT || m.SourceURL != c.URL) {
+				logger.Debug("Media %d changed, refreshing cache", m.ID)
+				store(m)
+			}
+		}
+	}
+
+	for _, id := range ids {
+		if entry, ok := cached[id]; ok {
+			urls[id] = entry.URL
+			delete(failed, id)
+		}
+	}
+
+	if s.Media != nil {
+		if err := s.Media.Put(ctx, updates); err != nil {
+			logger.Warn("Media cache write failed: %v", err)
+		}
+		if err := s.Media.Delete(ctx, gone); err != nil {
+			logger.Warn("Media cache delete failed: %v", err)
+		}
+	}
+	return urls, failed
+}
+
+// Unique media IDs referenced by the ACF "image" field, sorted
+func postMediaIDs(posts []WPPost) []int {
+	seen := map[int]bool{}
+	var ids []int
+	for _, post := range posts {
+		if id, ok := post.ACF["image"].(float64); ok && id > 0 && !seen[int(id)] {
+			seen[int(id)] = true
+			ids = append(ids, int(id))
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
@@ -4,41 +4,8 @@ const client = new Client("defaultkey", "127.0.0.1", "7350", false);
 const NUM_BOTS = 800;          // total number of bots
 const BATCH_SIZE = 100;        // spawn this many bots at a time
 const bots = [];
-const CELL_SIZE = 0.002;       // cell size for RPC joins
-
 let cleaningUp = false;        // flag to stop intervals when cleaning
 
-// --- Cell utilities ---
-function getCell(lat, lon) {
-  return {
-    cellLat: Math.floor(lat / CELL_SIZE) * CELL_SIZE,
-    cellLon: Math.floor(lon / CELL_SIZE) * CELL_SIZE
-  };
-}
-
-function cellKey(c) {
-  return `${c.lat},${c.lon}`;
-}
-
-function determineStreams(lat, lon, cell) {
-  const offsetLat = lat - cell.cellLat;
-  const offsetLon = lon - cell.cellLon;
-  const streams = [{ lat: cell.cellLat, lon: cell.cellLon }];
-
-  if (offsetLat > 0) streams.push({ lat: cell.cellLat + CELL_SIZE, lon: cell.cellLon });
-  else if (offsetLat < 0) streams.push({ lat: cell.cellLat - CELL_SIZE, lon: cell.cellLon });
-
-  if (offsetLon > 0) streams.push({ lat: cell.cellLat, lon: cell.cellLon + CELL_SIZE });
-  else if (offsetLon < 0) streams.push({ lat: cell.cellLat, lon: cell.cellLon - CELL_SIZE });
-
-  if (offsetLat !== 0 && offsetLon !== 0) {
-    streams.push({ lat: cell.cellLat + (offsetLat > 0 ? CELL_SIZE : -CELL_SIZE),
-                  lon: cell.cellLon + (offsetLon > 0 ? CELL_SIZE : -CELL_SIZE) });
-  }
-
-  return streams.slice(0, 4); // max 4 streams
-}
-
 // --- Create a single bot ---
 async function createBot(i) {
   if (cleaningUp) return;
@@ -62,24 +29,28 @@ async function createBot(i) {
 
     let lat = 37.7749 + (Math.random() - 0.5) * 0.02;
     let lon = -122.4194 + (Math.random() - 0.5) * 0.02;
-    let cell = getCell(lat, lon);
-    let activeStreams = new Set();
-
-    // join initial streams
-    const initialStreams = determineStreams(lat, lon, cell);
-    for (const s of initialStreams) {
-      try {
-        await socket.rpc("rpcjoincell", JSON.stringify({ lat: s.lat, lon: s.lon }));
-        activeStreams.add(cellKey(s));
-      } catch {}
-    }
-    console.log(`Bot ${i} joined streams around`, cell);
+    // The server picks the cells around us
+    let cells = [];
+    try {
+      const result = await socket.rpc("rpcjoincell", JSON.stringify({ lat, lon }));
+      cells = JSON.parse(result.payload).cells;
+    } catch {}
+    console.log(`Bot ${i} joined streams`, cells);
 
     // Register notification listener ONCE
+    // Catch up on building changes the same way the map does
+    let buildingsToken = null;
     socket.onnotification = async (notification) => {
       if (notification.subject === "buildings_update") {
         try {
-          await socket.rpc("get_buildings", "{}");
+          if (!buildingsToken) {
+            const result = await socket.rpc("get_buildings", JSON.stringify({ limit: 200 }));
+            buildingsToken = JSON.parse(result.payload).token || null;
+          } else if (notification.content.token !== buildingsToken) {
+            const result = await socket.rpc("get_buildings_changes", JSON.stringify({ token: buildingsToken, limit: 200 }));
+            const page = JSON.parse(result.payload);
+            buildingsToken = page.reset ? null : page.token;
+          }
         } catch {}
       }
     };
@@ -91,50 +62,22 @@ async function createBot(i) {
       lat += (Math.random() - 0.5) * 0.0002;
       lon += (Math.random() - 0.5) * 0.0002;
 
-      const newCell = getCell(lat, lon);
-      const needed = determineStreams(lat, lon, newCell);
-
-      // join new streams
-      for (const s of needed) {
-        const key = cellKey(s);
-        if (!activeStreams.has(key)) {
-          try {
-            await socket.rpc("rpcjoincell", JSON.stringify({ lat: s.lat, lon: s.lon }));
-            activeStreams.add(key);
-          } catch {}
-        }
-      }
-
-      // leave unused streams
-      for (const key of Array.from(activeStreams)) {
-        if (!needed.some(s => cellKey(s) === key)) {
-          const [clat, clon] = key.split(",").map(Number);
-          try {
-            await socket.rpc("rpcleavecell", JSON.stringify({ lat: clat, lon: clon }));
-          } catch {}
-          activeStreams.delete(key);
-        }
-      }
-
       // send location
       try {
         await socket.rpc(
           "rpcsendlocation",
           JSON.stringify({
-            lat: newCell.cellLat,
-            lon: newCell.cellLon,
-            data: { lat, lon },
+            lat,
+            lon,
             group: myGroup.name,
           })
         );
       } catch (e) {
         console.error(`Bot ${i} failed sending position`, e);
       }
-
-      cell = newCell;
     }, 1000);
 
-    bots.push({ session, socket, interval, cell, activeStreams });
+    bots.push({ session, socket, interval });
   } catch (e) {
     console.error(`Bot ${i} failed:`, e);
   }
@@ -163,13 +106,10 @@ async function cleanupBots() {
   for (const b of bots) {
     clearInterval(b.interval);
 
-    // leave all active streams
-    for (const key of Array.from(b.activeStreams)) {
-      const [clat, clon] = key.split(",").map(Number);
-      try {
-        await b.socket.rpc("rpcleavecell", JSON.stringify({ lat: clat, lon: clon }));
-      } catch {}
-    }
+    // leave all cell streams
+    try {
+      await b.socket.rpc("rpcleavecell", "{}");
+    } catch {}
 
     try { b.socket.close(); } catch {}
   }
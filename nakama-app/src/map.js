@@ -7,11 +7,11 @@ let socket = null;
 
 // --- Markers ---
 let buildingMarkers = []; // array of building markers with .options.buildingId
-let userMarkers = {}; // { cellKey: { playerId: { marker, lastUpdate } } }
+let userMarkers = {}; // { cellLabel: { playerId: { marker, lastUpdate } } }
 let myMarker = null;
 let myGroup = null;
 
-const CELL_SIZE = 0.002; // ~200m
+const CELL_SIZE = 0.002; // ~200m, only used to hide far-away players
 
 // --- Icons ---
 const redIcon = new L.Icon({
@@ -22,10 +22,93 @@ const blueIcon = new L.Icon({
 });
 
 // --- Buildings ---
+let buildingsToken = null; // change token from get_buildings / get_buildings_changes
+
 async function fetchBuildings() {
   if (!socket) throw new Error("Socket not initialized");
-  const result = await socket.rpc("get_buildings", "{}");
-  return JSON.parse(result.payload);
+  const buildings = [];
+  let cursor = "";
+  let token = null;
+  do {
+    const result = await socket.rpc("get_buildings", JSON.stringify({ cursor, limit: 200 }));
+    const page = JSON.parse(result.payload);
+    if (!cursor) token = page.token || null;
+    buildings.push(...page.buildings);
+    cursor = page.cursor || "";
+  } while (cursor);
+  buildingsToken = token;
+  return buildings;
+}
+
+function upsertBuildingMarker(map, bld) {
+  if (bld.lat == null || bld.lon == null) return;
+  const lat = parseFloat(bld.lat);
+  const lon = parseFloat(bld.lon);
+  if (isNaN(lat) || isNaN(lon)) return;
+
+  const existing = buildingMarkers.find(m => m.options.buildingId === bld.id);
+  if (existing) {
+    existing.setLatLng([lat, lon]);
+    if (bld.image) existing.setIcon(L.icon({ iconUrl: bld.image, iconSize: [40, 40] }));
+    return;
+  }
+
+  const marker = L.marker([lat, lon], {
+    icon: L.icon({ iconUrl: bld.image || "default.png", iconSize: [40, 40] })
+  }).addTo(map)
+    .bindPopup(`<a href="${bld.link || '#'}" target="_blank">${bld.title || 'Building'}</a>`);
+  marker.options.buildingId = bld.id; // keep building ID for updates
+  buildingMarkers.push(marker);
+}
+
+// --- Preview (drafts, only for editors with a preview token) ---
+let previewMarkers = {}; // { buildingId: marker }
+
+// WordPress opens us with ?preview=1 and posts the token once we ask for it,
+// so it never shows up in a URL
+function receivePreviewToken() {
+  return new Promise(resolve => {
+    window.addEventListener("message", function onToken(e) {
+      if (e.source !== window.opener || e.data?.type !== "nakama_preview_token") return;
+      window.removeEventListener("message", onToken);
+      resolve(e.data.token);
+    });
+    window.opener.postMessage("nakama_preview_ready", "*");
+  });
+}
+
+async function startPreview(map) {
+  if (new URLSearchParams(window.location.search).get("preview") !== "1" || !window.opener) return;
+  const token = await receivePreviewToken();
+
+  await socket.rpc("redeem_preview_token", JSON.stringify({ token }));
+  const result = await socket.rpc("get_preview_buildings", "{}");
+  JSON.parse(result.payload).buildings.forEach(bld => upsertPreviewMarker(map, bld));
+}
+
+function upsertPreviewMarker(map, bld) {
+  removePreviewMarker(map, bld.id);
+  const marker = L.marker([bld.lat, bld.lon], {
+    icon: L.icon({ iconUrl: bld.image || "default.png", iconSize: [40, 40] }),
+    opacity: 0.6,
+  }).addTo(map)
+    .bindPopup(`<b>Draft (${bld.status})</b><br>${bld.title || 'Building'}`);
+  previewMarkers[bld.id] = marker;
+}
+
+function removePreviewMarker(map, id) {
+  if (previewMarkers[id]) {
+    map.removeLayer(previewMarkers[id]);
+    delete previewMarkers[id];
+  }
+}
+
+function removeBuildingMarker(map, id) {
+  const index = buildingMarkers.findIndex(m => m.options.buildingId === id);
+  if (index !== -1) {
+    map.removeLayer(buildingMarkers[index]);
+    buildingMarkers.splice(index, 1);
+  }
 }
 
 async function addBuildingsToMap(map) {
@@ -35,46 +118,57 @@ async function addBuildingsToMap(map) {
   buildingMarkers.forEach(m => map.removeLayer(m));
   buildingMarkers = [];
 
-  buildings.forEach(bld => {
-    if (bld.lat != null && bld.lon != null) {
-      const lat = parseFloat(bld.lat);
-      const lon = parseFloat(bld.lon);
-      if (isNaN(lat) || isNaN(lon)) return;
-
-      const icon = L.icon({
-        iconUrl: bld.image || "default.png",
-        iconSize: [40, 40],
-      });
-
-      const marker = L.marker([lat, lon], { icon })
-        .addTo(map)
-        .bindPopup(`<a href="${bld.link || '#'}" target="_blank">${bld.title || 'Building'}</a>`);
-
-      marker.options.buildingId = bld.id; // keep building ID for updates
-      buildingMarkers.push(marker);
-    }
-  });
+  buildings.forEach(bld => upsertBuildingMarker(map, bld));
 }
 
-// --- Cells ---
-function getCell(lat, lon) {
-  return {
-    lat: Math.floor(lat / CELL_SIZE) * CELL_SIZE,
-    lon: Math.floor(lon / CELL_SIZE) * CELL_SIZE,
-  };
+// Apply only what changed since our token; fall back to a full fetch if it expired
+async function syncBuildingChanges(map) {
+  if (!buildingsToken) return addBuildingsToMap(map);
+  let more = true;
+  while (more) {
+    const result = await socket.rpc("get_buildings_changes", JSON.stringify({ token: buildingsToken, limit: 200 }));
+    const page = JSON.parse(result.payload);
+    if (page.reset) return addBuildingsToMap(map);
+    page.changes.forEach(c => {
+      if (c.op === "delete") removeBuildingMarker(map, c.id);
+      else upsertBuildingMarker(map, c.building);
+    });
+    buildingsToken = page.token;
+    more = page.more;
+  }
 }
 
-function cellKey(cell) {
-  return `${cell.lat.toFixed(6)},${cell.lon.toFixed(6)}`;
+// --- Cells ---
+// The server owns the cell grid: we send our position and get back the
+// cell stream labels we're subscribed to.
+function dropCellMarkers(map, labels) {
+  for (const label of labels || []) {
+    if (userMarkers[label]) {
+      for (const pid in userMarkers[label]) map.removeLayer(userMarkers[label][pid].marker);
+      delete userMarkers[label];
+    }
+  }
 }
 
-// --- RPCs ---
-async function joinCell(lat, lon) {
-  await socket.rpc("rpcjoincell", JSON.stringify({ lat, lon }));
+// The map view also subscribes to coarse cells, which only send periodic
+// summaries of how many players are further away
+async function joinCells(lat, lon) {
+  const result = await socket.rpc("rpcjoincell", JSON.stringify({ lat, lon, view: "map" }));
+  return JSON.parse(result.payload);
 }
 
-async function leaveCell(lat, lon) {
-  await socket.rpc("rpcleavecell", JSON.stringify({ lat, lon }));
+// A summary replaces everything the coarse cell showed before. Clusters sit
+// at the center of the sub-cell their players are in.
+function applyCellSummary(map, msg) {
+  dropCellMarkers(map, [msg.cell]);
+  const markers = {};
+  (msg.clusters || []).forEach((c, i) => {
+    const marker = L.circleMarker([c.lat, c.lon], { radius: 6 + Math.min(14, Math.sqrt(c.count)), color: "#666" })
+      .addTo(map)
+      .bindTooltip(`${c.count}`, { permanent: true, direction: "center" });
+    markers[`cluster_${i}`] = { marker, lastUpdate: Date.now() };
+  });
+  userMarkers[msg.cell] = markers;
 }
 
 // --- Session / Socket ---
@@ -110,146 +204,127 @@ function initLeaflet(mapDivId, lat = 37.7749, lon = -122.4194) {
   return map;
 }
 
+// Player position updates, from the cell streams or a join snapshot
+function showPlayerPosition(map, msg) {
+  const playerId = msg.user_id;
+  if (playerId === session.user_id) return;
+
+  const pos = msg.data;
+  const cKey = msg.cell;
+
+  const myPos = myMarker.getLatLng();
+  const d = map.distance([pos.lat, pos.lon], [myPos.lat, myPos.lng]);
+
+  let icon = redIcon;
+  if (msg.group) icon = blueIcon;
+  else if (d > CELL_SIZE * 111000) {
+    if (userMarkers[cKey] && userMarkers[cKey][playerId]) {
+      map.removeLayer(userMarkers[cKey][playerId].marker);
+      delete userMarkers[cKey][playerId];
+    }
+    return;
+  }
+
+  if (!userMarkers[cKey]) userMarkers[cKey] = {};
+
+  if (userMarkers[cKey][playerId]) {
+    userMarkers[cKey][playerId].marker.setIcon(icon);
+    userMarkers[cKey][playerId].marker.setLatLng([pos.lat, pos.lon]);
+    userMarkers[cKey][playerId].lastUpdate = Date.now();
+  } else {
+    const marker = L.marker([pos.lat, pos.lon], { icon })
+      .addTo(map)
+      .bindPopup(`Player: ${playerId}`);
+    marker.options.playerId = playerId;
+    userMarkers[cKey][playerId] = { marker, lastUpdate: Date.now() };
+  }
+}
+
+// Occupants the server already knew about when we joined new cells
+function applyOccupants(map, occupants) {
+  for (const label in occupants || {}) {
+    occupants[label].forEach(occ => showPlayerPosition(map, occ));
+  }
+}
+
 // --- Stream Handlers ---
 function setupStreamHandlers(map) {
-  // Player position updates
   socket.onstreamdata = (streamData) => {
     const msg = JSON.parse(streamData.data);
-    const playerId = msg.user_id;
-    if (playerId === session.user_id) return;
-
-    const pos = msg.data;
-    const cell = getCell(msg.lat, msg.lon);
-    const cKey = cellKey(cell);
-
-    const myPos = myMarker.getLatLng();
-    const d = map.distance([pos.lat, pos.lon], [myPos.lat, myPos.lng]);
-
-    let icon = redIcon;
-    if (msg.group) icon = blueIcon;
-    else if (d > CELL_SIZE * 111000) {
-      if (userMarkers[cKey] && userMarkers[cKey][playerId]) {
-        map.removeLayer(userMarkers[cKey][playerId].marker);
-        delete userMarkers[cKey][playerId];
+
+    // Building changes near us arrive on the cell streams
+    if (msg.type === "building_update") {
+      upsertBuildingMarker(map, msg.data);
+      return;
+    }
+    if (msg.type === "building_delete") {
+      removeBuildingMarker(map, msg.data.id);
+      return;
+    }
+
+    // Someone disconnected, drop their marker wherever it is
+    if (msg.type === "player_left") {
+      for (const label in userMarkers) {
+        if (userMarkers[label][msg.user_id]) {
+          map.removeLayer(userMarkers[label][msg.user_id].marker);
+          delete userMarkers[label][msg.user_id];
+        }
       }
       return;
     }
 
-    if (!userMarkers[cKey]) userMarkers[cKey] = {};
-
-    if (userMarkers[cKey][playerId]) {
-      userMarkers[cKey][playerId].marker.setIcon(icon);
-      userMarkers[cKey][playerId].marker.setLatLng([pos.lat, pos.lon]);
-      userMarkers[cKey][playerId].lastUpdate = Date.now();
-    } else {
-      const marker = L.marker([pos.lat, pos.lon], { icon })
-        .addTo(map)
-        .bindPopup(`Player: ${playerId}`);
-      marker.options.playerId = playerId;
-      userMarkers[cKey][playerId] = { marker, lastUpdate: Date.now() };
+    if (msg.type === "cell_summary") {
+      applyCellSummary(map, msg);
+      return;
+    }
+
+    // Everyone who moved on this stream during the last server tick
+    if (msg.type === "positions") {
+      msg.updates.forEach(update => showPlayerPosition(map, update));
+      return;
     }
+
+    showPlayerPosition(map, msg);
   };
 
-  // Building updates
+  // Building changes elsewhere only come as a hint carrying the latest token
   socket.onnotification = (notification) => {
     const payload = notification.content;
 
-    if (notification.subject === "building_update") {
-      const bld = payload.data;
-      const lat = parseFloat(bld.lat);
-      const lon = parseFloat(bld.lon);
-      if (isNaN(lat) || isNaN(lon)) return;
-
-      const existing = buildingMarkers.find(m => m.options.buildingId === bld.id);
-      if (existing) {
-        existing.setLatLng([lat, lon]);
-        if (bld.image) existing.setIcon(L.icon({ iconUrl: bld.image, iconSize: [40, 40] }));
-      } else {
-        const marker = L.marker([lat, lon], {
-          icon: L.icon({ iconUrl: bld.image || "default.png", iconSize: [40, 40] })
-        }).addTo(map)
-          .bindPopup(`<a href="${bld.link || '#'}" target="_blank">${bld.title || 'Building'}</a>`);
-        marker.options.buildingId = bld.id;
-        buildingMarkers.push(marker);
-      }
+    // Draft changes only reach sessions that redeemed a preview token
+    if (notification.subject === "preview_update") {
+      upsertPreviewMarker(map, payload.data);
+      return;
     }
-
-    if (notification.subject === "building_delete") {
-      const bld = payload.data;
-      const index = buildingMarkers.findIndex(m => m.options.buildingId === bld.id);
-      if (index !== -1) {
-        map.removeLayer(buildingMarkers[index]);
-        buildingMarkers.splice(index, 1);
-      }
+    if (notification.subject === "preview_delete") {
+      removePreviewMarker(map, payload.data.id);
+      return;
     }
 
     if (notification.subject === "buildings_update") {
-      // Refresh all buildings
-      addBuildingsToMap(map).catch(err => console.error("Failed to refresh buildings:", err));
+      if (payload.token && payload.token === buildingsToken) return;
+      // Catch up on what changed since our last sync
+      syncBuildingChanges(map).catch(err => console.error("Failed to refresh buildings:", err));
     }
   };
 }
 
 // --- Position Updates ---
-function determineStreams(lat, lon, cell) {
-  const offsetLat = lat - cell.lat;
-  const offsetLon = lon - cell.lon;
-  const streams = [{ lat: cell.lat, lon: cell.lon }];
-
-  if (offsetLat > 0) streams.push({ lat: cell.lat + CELL_SIZE, lon: cell.lon });
-  else if (offsetLat < 0) streams.push({ lat: cell.lat - CELL_SIZE, lon: cell.lon });
-  if (offsetLon > 0) streams.push({ lat: cell.lat, lon: cell.lon + CELL_SIZE });
-  else if (offsetLon < 0) streams.push({ lat: cell.lat, lon: cell.lon - CELL_SIZE });
-
-  if (offsetLat !== 0 && offsetLon !== 0) {
-    streams.push({
-      lat: cell.lat + (offsetLat > 0 ? CELL_SIZE : -CELL_SIZE),
-      lon: cell.lon + (offsetLon > 0 ? CELL_SIZE : -CELL_SIZE)
-    });
-  }
-
-  return streams.slice(0, 4);
-}
-
-function startPositionUpdates(map, currentCell, lat, lon) {
-  let activeStreams = new Set();
-
+function startPositionUpdates(map, lat, lon) {
   setInterval(async () => {
     lat += (Math.random() - 0.5) * 0.001;
     lon += (Math.random() - 0.5) * 0.001;
     myMarker.setLatLng([lat, lon]);
 
-    const newCell = getCell(lat, lon);
-    const needed = determineStreams(lat, lon, newCell);
-
-    for (const c of needed) {
-      const key = cellKey(c);
-      if (!activeStreams.has(key)) {
-        await joinCell(c.lat, c.lon);
-        activeStreams.add(key);
-      }
-    }
-
-    for (const key of Array.from(activeStreams)) {
-      if (!needed.some(c => cellKey(c) === key)) {
-        const [clat, clon] = key.split(",").map(Number);
-        await leaveCell(clat, clon);
-        if (userMarkers[key]) {
-          for (const pid in userMarkers[key]) map.removeLayer(userMarkers[key][pid].marker);
-          delete userMarkers[key];
-        }
-        activeStreams.delete(key);
-      }
-    }
-
-    await socket.rpc("rpcsendlocation", JSON.stringify({
-      lat: newCell.lat,
-      lon: newCell.lon,
-      data: { lat, lon },
+    const result = await socket.rpc("rpcsendlocation", JSON.stringify({
+      lat,
+      lon,
       group: myGroup?.name
     }));
-
-    currentCell = newCell;
+    const cells = JSON.parse(result.payload);
+    dropCellMarkers(map, cells.left);
+    applyOccupants(map, cells.occupants);
+    (cells.summaries || []).forEach(s => applyCellSummary(map, s));
   }, 1000);
 }
 
@@ -260,17 +335,17 @@ export async function initMap(mapDivId) {
   const map = initLeaflet(mapDivId);
   await addBuildingsToMap(map);
 
-  let currentCell = getCell(37.7749, -122.4194);
-  const streams = determineStreams(37.7749, -122.4194, currentCell);
-
-  for (const c of streams) await joinCell(c.lat, c.lon);
+  const cells = await joinCells(37.7749, -122.4194);
 
   setupStreamHandlers(map);
+  applyOccupants(map, cells.occupants);
+  (cells.summaries || []).forEach(s => applyCellSummary(map, s));
+  await startPreview(map).catch(err => console.error("Preview unavailable:", err));
 
   const account = await client.getAccount(session);
   const user = account.user;
   const metadata = typeof user.metadata === "string" ? JSON.parse(user.metadata) : user.metadata;
   myGroup = metadata.group;
 
-  startPositionUpdates(map, currentCell, 37.7749, -122.4194);
+  startPositionUpdates(map, 37.7749, -122.4194);
 }
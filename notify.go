@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// How long to collect building changes before telling everyone about them
+const BuildingsHintDebounce = 2 * time.Second
+
+// Building event sent on cell streams. Clients switch on Type, which never
+// collides with the "positions" of a PositionBatch on the same stream.
+type cellEvent struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// Send a building event to the cells containing any of the given buildings.
+// Only sessions that joined those cells receive it.
+func sendToBuildingCells(logger runtime.Logger, nk runtime.NakamaModule, eventType string, data interface{}, buildings ...*Building) {
+	msg, err := json.Marshal(cellEvent{Type: eventType, Data: data})
+	if err != nil {
+		logger.Error("Failed to marshal %s event: %v", eventType, err)
+		return
+	}
+
+	sent := make(map[string]bool)
+	for _, b := range buildings {
+		if b == nil {
+			continue
+		}
+		label := cellLabelFor(b.Lat, b.Lon)
+		if sent[label] {
+			continue
+		}
+		sent[label] = true
+		if err := nk.StreamSend(cfg().StreamMode, "", "", label, string(msg), nil, true); err != nil {
+			logger.WithField("cell", label).WithField("err", err).Error("Failed to send building event to cell")
+		}
+	}
+}
+
+// Tell clients near a building it was created or changed. prev is where the
+// building was before, if it existed, so clients around the old spot hear about a move.
+func notifyBuildingUpdate(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, b Building, prev *Building) {
+	sendToBuildingCells(logger, nk, "building_update", b, &b, prev)
+	buildingsHint.schedule(logger, nk)
+}
+
+// Tell clients near a building it was removed
+func notifyBuildingDelete(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, id int, prev *Building) {
+	sendToBuildingCells(logger, nk, "building_delete", map[string]interface{}{"id": id}, prev)
+	buildingsHint.schedule(logger, nk)
+}
+
+// Where a building currently is, from the spatial index, before it changes
+func previousBuilding(id int) *Building {
+	if b, ok := buildingIndex.Get(id); ok {
+		return &b
+	}
+	return nil
+}
+
+// Debounced "changes available" notification for everyone. It only carries
+// the latest change token; clients far from the change catch up lazily with
+// get_buildings_changes, so a burst of edits costs one broadcast.
+type changesHint struct {
+	mu      sync.Mutex
+	pending bool
+}
+
+var buildingsHint = &changesHint{}
+
+func (h *changesHint) schedule(logger runtime.Logger, nk runtime.NakamaModule) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.pending {
+		return
+	}
+	h.pending = true
+
+	time.AfterFunc(BuildingsHintDebounce, func() {
+		h.mu.Lock()
+		h.pending = false
+		h.mu.Unlock()
+
+		ctx := context.Background()
+		token, err := currentChangeToken(ctx, nk)
+		if err != nil {
+			logger.Error("Failed to read change token for buildings_update: %v", err)
+			return
+		}
+		if err := nk.NotificationSendAll(ctx, "buildings_update", map[string]interface{}{"token": token}, 1, false); err != nil {
+			logger.Error("Failed to send buildings_update notification: %v", err)
+		}
+	})
+}
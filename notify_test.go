@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// Records stream sends and broadcast notifications
+type fakeNotifier struct {
+	*fakeStorage
+
+	mu        sync.Mutex
+	sent      map[string][]string // cell label -> event types
+	broadcast []map[string]interface{}
+}
+
+func (f *fakeNotifier) StreamSend(mode uint8, subject, subcontext, label, data string, presences []runtime.Presence, reliable bool) error {
+	var ev cellEvent
+	if err := json.Unmarshal([]byte(data), &ev); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent[label] = append(f.sent[label], ev.Type)
+	return nil
+}
+
+func (f *fakeNotifier) NotificationSendAll(ctx context.Context, subject string, content map[string]interface{}, code int, persistent bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.broadcast = append(f.broadcast, content)
+	return nil
+}
+
+func TestNotifyBuildingTargetsCells(t *testing.T) {
+	here := Building{ID: 1, Lat: 0.0005, Lon: 0.0005}
+	sameCell := Building{ID: 1, Lat: 0.0015, Lon: 0.0015}
+	nextCell := Building{ID: 1, Lat: 0.0025, Lon: 0.0005}
+	hereLabel, nextLabel := cellLabelFor(here.Lat, here.Lon), cellLabelFor(nextCell.Lat, nextCell.Lon)
+
+	tests := []struct {
+		name   string
+		notify func(nk runtime.NakamaModule)
+		want   map[string][]string
+	}{
+		{"new building", func(nk runtime.NakamaModule) {
+			notifyBuildingUpdate(context.Background(), nopLogger{}, nk, here, nil)
+		}, map[string][]string{hereLabel: {"building_update"}}},
+		{"edit in place", func(nk runtime.NakamaModule) {
+			notifyBuildingUpdate(context.Background(), nopLogger{}, nk, here, &sameCell)
+		}, map[string][]string{hereLabel: {"building_update"}}},
+		{"moved across cells", func(nk runtime.NakamaModule) {
+			notifyBuildingUpdate(context.Background(), nopLogger{}, nk, nextCell, &here)
+		}, map[string][]string{hereLabel: {"building_update"}, nextLabel: {"building_update"}}},
+		{"delete", func(nk runtime.NakamaModule) {
+			notifyBuildingDelete(context.Background(), nopLogger{}, nk, 1, &nextCell)
+		}, map[string][]string{nextLabel: {"building_delete"}}},
+		{"delete of an unknown building", func(nk runtime.NakamaModule) {
+			notifyBuildingDelete(context.Background(), nopLogger{}, nk, 1, nil)
+		}, map[string][]string{}},
+	}
+
+	nk := &fakeNotifier{fakeStorage: newFakeStorage()}
+	seq, _ := json.Marshal(changeSeqState{Seq: 7})
+	if _, err := nk.StorageWrite(context.Background(), []*runtime.StorageWrite{{Collection: SyncCollection, Key: ChangeSeqKey, Value: string(seq)}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		nk.mu.Lock()
+		nk.sent = make(map[string][]string)
+		nk.mu.Unlock()
+		tt.notify(nk)
+		nk.mu.Lock()
+		got := nk.sent
+		nk.mu.Unlock()
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: sent %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Every change above falls in one debounce window: one hint, latest token
+	time.Sleep(BuildingsHintDebounce + 500*time.Millisecond)
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	want := []map[string]interface{}{{"token": "7"}}
+	if !reflect.DeepEqual(nk.broadcast, want) {
+		t.Errorf("hints = %v, want %v", nk.broadcast, want)
+	}
+}
@@ -13,15 +13,10 @@ import (
 
 const (
 	GroupNamePrefix = "Group"
-	MaxGroups		= 80
-	RetryCount      = 5
-	RetryDelay      = 100 * time.Millisecond
 	LockCollection  = "locks"
 	JoinLockKey     = "join_lock"
 	GroupSizeKey     = "max_group_size"
     NextGroupKey     = "next_group"
-	StreamMode = 2
-	AdminID = "319e1542-46ed-42fa-aa71-3d26dc6c976e"
 )
 
 //
@@ -71,10 +66,11 @@ func rpcJoinGroup(ctx context.Context, logger runtime.Logger, db *sql.DB, nk run
     // Payload is expected to be the group name
     groupName := payload
 
-    _, err := nk.StreamUserJoin(StreamMode, "", "", groupName, userID, sessionID, false, false, "")
+    _, err := nk.StreamUserJoin(cfg().StreamMode, "", "", groupName, userID, sessionID, false, false, "")
     if err != nil {
         return "", err
     }
+    groupPresence.Track(sessionID, groupName)
 
     return `{"ok":true}`, nil
 }
@@ -84,7 +80,8 @@ func rpcJoinGroup(ctx context.Context, logger runtime.Logger, db *sql.DB, nk run
 //
 
 func acquireLock(nk runtime.NakamaModule, key, userID string) bool {
-	for attempt := 1; attempt <= RetryCount; attempt++ {
+	config := cfg()
+	for attempt := 1; attempt <= config.LockRetryCount; attempt++ {
 		// Try to read current lock state
 		records, err := nk.StorageRead(context.Background(), []*runtime.StorageRead{
 			{
@@ -99,7 +96,7 @@ func acquireLock(nk runtime.NakamaModule, key, userID string) bool {
 
 		// If record exists and is locked, retry after delay
 		if len(records) > 0 && string(records[0].Value) == `{"locked":true}` {
-			time.Sleep(RetryDelay)
+			time.Sleep(config.LockRetryDelay)
 			continue
 		}
 
@@ -149,29 +146,42 @@ func handlePlayerJoin(ctx context.Context, nk runtime.NakamaModule, userID strin
     // List all available groups
     maxmembers := 100
     open := true
-    groups, _, err := nk.GroupsList(ctx, "", "", &maxmembers, &open, 80, "")
+    config := cfg()
+    groups, _, err := nk.GroupsList(ctx, "", "", &maxmembers, &open, config.MaxGroups, "")
     if err != nil {
         logger.Error("Error fetching groups: %v", err)
         return
     }
+    if len(groups) == 0 {
+        logger.Error("No open groups to add user %s to", userID)
+        return
+    }
 
     // Load state from storage
-    maxGroupSize := readInt(nk, GroupSizeKey, 6)
+    maxGroupSize := readInt(nk, GroupSizeKey, config.InitialGroupSize)
     nextGroup := readInt(nk, NextGroupKey, 0)
+    // max_groups may have changed, or fewer groups came back than it allows
+    if nextGroup < 0 || nextGroup >= len(groups) {
+        nextGroup = 0
+    }
 
     logger.Info("Loaded MaxGroupSize=%d, NextGroup=%d from storage", maxGroupSize, nextGroup)
 
     // Look at current group occupancy
     memberState := 2 // member
-    members, _, _ := nk.GroupUsersList(ctx, groups[nextGroup].Id, 100, &memberState, "")
+    members, _, err := nk.GroupUsersList(ctx, groups[nextGroup].Id, 100, &memberState, "")
+    if err != nil {
+        logger.Error("Error fetching members of group %s: %v", groups[nextGroup].Name, err)
+        return
+    }
 
     if len(members)+1 > maxGroupSize {
         // Increase capacity proportionally
-        maxGroupSize = maxGroupSize + (nextGroup+1)/MaxGroups
+        maxGroupSize = maxGroupSize + (nextGroup+1)/len(groups)
         writeInt(nk, GroupSizeKey, maxGroupSize)
 
         // Move to next group (round-robin)
-        nextGroup = (nextGroup + 1) % MaxGroups
+        nextGroup = (nextGroup + 1) % len(groups)
         writeInt(nk, NextGroupKey, nextGroup)
     }
 
@@ -182,8 +192,10 @@ func handlePlayerJoin(ctx context.Context, nk runtime.NakamaModule, userID strin
     }
 
     // Join stream for that group
-    if _, err := nk.StreamUserJoin(StreamMode, "", "", groups[nextGroup].Name, userID, sessionID, false, false, ""); err != nil {
+    if _, err := nk.StreamUserJoin(cfg().StreamMode, "", "", groups[nextGroup].Name, userID, sessionID, false, false, ""); err != nil {
         logger.Error("Failed stream join for user %s: %v", userID, err)
+    } else {
+        groupPresence.Track(sessionID, groups[nextGroup].Name)
     }
 
     groupdata := map[string]interface{}{
@@ -203,25 +215,34 @@ func handlePlayerJoin(ctx context.Context, nk runtime.NakamaModule, userID strin
 //
 
 func InitModule(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, initializer runtime.Initializer) error {
-	members := 100
-	open := true
-	groups, _, err := nk.GroupsList(context.Background(), "", "", &members, &open, 100, "")
+	if err := loadConfig(ctx, logger, nk); err != nil {
+		logger.Error("Failed to load config: %v", err)
+		return err
+	}
+	config := cfg()
+
+	groups, _, err := nk.GroupsList(context.Background(), "", "", nil, nil, MaxGroupsLimit, "")
 	if err != nil {
 		return err
 	}
+	existing := make(map[string]bool, len(groups))
+	for _, group := range groups {
+		existing[group.Name] = true
+	}
 
-	// If no groups found, create MaxGroups
-    if len(groups) == 0 {
-        logger.Info("No groups found, creating groups...")
-        for i := 1; i <= MaxGroups; i++ {
-            name := fmt.Sprintf("%s_%d", GroupNamePrefix, i)
-            _, err := nk.GroupCreate(context.Background(), AdminID, name, "", "", "", "", true, map[string]interface{}{
-				"items": map[string]interface{}{"test": "test",},
-            }, 100)
-            if err != nil {
-                logger.Error("Failed to create group %s: %v", name, err)
-                return err
-            }
+	// Create whichever of the max_groups groups players get spread over is missing
+    for i := 1; i <= config.MaxGroups; i++ {
+        name := fmt.Sprintf("%s_%d", GroupNamePrefix, i)
+        if existing[name] {
+            continue
+        }
+        logger.Info("Creating missing group %s", name)
+        _, err := nk.GroupCreate(context.Background(), config.AdminID, name, "", "", "", "", true, map[string]interface{}{
+			"items": map[string]interface{}{"test": "test",},
+        }, 100)
+        if err != nil {
+            logger.Error("Failed to create group %s: %v", name, err)
+            return err
         }
     }
 
@@ -235,10 +256,11 @@ func InitModule(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runti
 			}
 			if len(groups) != 0 {
 				group := groups[0]
-				if _, err := nk.StreamUserJoin(StreamMode, "", "", group.GetGroup().Name, userID, sessionID, false, false, ""); err != nil {
+				if _, err := nk.StreamUserJoin(cfg().StreamMode, "", "", group.GetGroup().Name, userID, sessionID, false, false, ""); err != nil {
 					logger.Error("Failed stream join for user %s: %v", userID, err)
 					return
 				}
+				groupPresence.Track(sessionID, group.GetGroup().Name)
 			}else{
 				handlePlayerJoin(ctx, nk, userID, sessionID, logger)
 			}
@@ -247,7 +269,7 @@ func InitModule(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runti
         return err
     }
 
-    /*if err := initializer.RegisterEventSessionEnd(
+    if err := initializer.RegisterEventSessionEnd(
         func(ctx context.Context, logger runtime.Logger, evt *api.Event) {
             userID, _ := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
 			sessionID, _ := ctx.Value(runtime.RUNTIME_CTX_SESSION_ID).(string)
@@ -255,7 +277,7 @@ func InitModule(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runti
         },
     ); err != nil {
         return err
-    }*/
+    }
 
 	if err := InitBuildings(ctx, logger, db, nk, initializer); err != nil {
 		logger.Error("Failed to init buildings module: %v", err)
@@ -282,6 +304,16 @@ func InitModule(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runti
 		return err
 	}
 
+	if err := initializer.RegisterRpc("admin_get_config", rpcAdminGetConfig); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("admin_set_config", rpcAdminSetConfig); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
 	logger.Info("Group balancing module loaded (Go).")
 	return nil
 }
\ No newline at end of file
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// Cached positions older than this are left out of join snapshots
+const PositionCacheTTL = 30 * time.Second
+
+// Last known position of a player in a level 0 cell, in the same shape as
+// the cell stream messages so clients can feed both through one handler.
+type CellOccupant struct {
+	UserID string      `json:"user_id"`
+	Data   interface{} `json:"data"`
+	Cell   string      `json:"cell"`
+	At     int64       `json:"at"` // unix time of the update
+}
+
+type cachedPosition struct {
+	data interface{}
+	at   time.Time
+}
+
+// Latest position update per player, indexed by the level 0 cell it was sent to
+type PositionCache struct {
+	mu    sync.Mutex
+	cells map[CellID]map[string]cachedPosition
+	users map[string]CellID
+}
+
+var positions = &PositionCache{
+	cells: make(map[CellID]map[string]cachedPosition),
+	users: make(map[string]CellID),
+}
+
+func (p *PositionCache) Update(userID string, cell CellID, data interface{}, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if prev, ok := p.users[userID]; ok && prev != cell {
+		p.removeLocked(prev, userID)
+	}
+	occupants := p.cells[cell]
+	if occupants == nil {
+		occupants = make(map[string]cachedPosition)
+		p.cells[cell] = occupants
+	}
+	occupants[userID] = cachedPosition{data: data, at: now}
+	p.users[userID] = cell
+}
+
+func (p *PositionCache) Remove(userID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cell, ok := p.users[userID]; ok {
+		p.removeLocked(cell, userID)
+	}
+}
+
+func (p *PositionCache) removeLocked(cell CellID, userID string) {
+	delete(p.cells[cell], userID)
+	if len(p.cells[cell]) == 0 {
+		delete(p.cells, cell)
+	}
+	delete(p.users, userID)
+}
+
+// Fresh occupants of the given level 0 cells by label, without the caller.
+// Cells nobody is in are left out.
+func (p *PositionCache) Snapshot(cells []CellID, exclude string, now time.Time) map[string][]CellOccupant {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	snapshot := make(map[string][]CellOccupant)
+	for _, cell := range cells {
+		label := cell.Label()
+		for userID, pos := range p.cells[cell] {
+			if userID == exclude || now.Sub(pos.at) > PositionCacheTTL {
+				continue
+			}
+			snapshot[label] = append(snapshot[label], CellOccupant{UserID: userID, Data: pos.data, Cell: label, At: pos.at.Unix()})
+		}
+		sort.Slice(snapshot[label], func(i, j int) bool { return snapshot[label][i].UserID < snapshot[label][j].UserID })
+	}
+	return snapshot
+}
+
+// Drop positions past the TTL
+func (p *PositionCache) sweep(now time.Time) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	removed := 0
+	for userID, cell := range p.users {
+		if now.Sub(p.cells[cell][userID].at) > PositionCacheTTL {
+			p.removeLocked(cell, userID)
+			removed++
+		}
+	}
+	return removed
+}
+
+func startPositionCacheJanitor(logger runtime.Logger) {
+	go func() {
+		ticker := time.NewTicker(PositionCacheTTL)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			if n := positions.sweep(now); n > 0 {
+				logger.Debug("Dropped %d stale cached positions", n)
+			}
+		}
+	}()
+}
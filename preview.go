@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// Preview tokens are minted by the nakama-notifier plugin for WordPress users
+// who can edit posts: base64url(claims) + "." + hex(HMAC-SHA256(secret, "preview." + base64url(claims))),
+// signed with the webhook secret. The "preview." prefix keeps a token from
+// ever passing as a webhook signature and vice versa.
+//
+// Draft changes are only ever sent as notifications to users holding a grant;
+// there is no stream a client could join to see them.
+const (
+	// Longest lifetime we accept, whatever the token claims
+	PreviewTokenMaxTTL = 12 * time.Hour
+)
+
+type PreviewClaims struct {
+	WPUserID  int   `json:"sub"`
+	IssuedAt  int64 `json:"iat"`
+	ExpiresAt int64 `json:"exp"`
+}
+
+// What a session got by redeeming a token
+type PreviewGrant struct {
+	UserID    string
+	WPUserID  int
+	ExpiresAt time.Time
+}
+
+var (
+	previewMu     sync.RWMutex
+	previewGrants = make(map[string]PreviewGrant) // by session id
+)
+
+var (
+	errPreviewToken  = runtime.NewError("invalid preview token", codeUnauthenticated)
+	errPreviewExpiry = runtime.NewError("preview token expired", codeUnauthenticated)
+	errNoPreview     = runtime.NewError("session has no preview access", codePermissionDenied)
+)
+
+func signPreviewToken(secret, claims string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("preview." + claims))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check a token against the current secret, or the previous one during a rotation
+func verifyPreviewToken(token string) (PreviewClaims, error) {
+	var claims PreviewClaims
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return claims, errPreviewToken
+	}
+
+	webhookMu.RLock()
+	secrets := webhookSecrets
+	webhookMu.RUnlock()
+	if secrets.Current == "" {
+		return claims, errWebhookNotConfigured
+	}
+	valid := hmac.Equal([]byte(signature), []byte(signPreviewToken(secrets.Current, encoded)))
+	if !valid && secrets.Previous != "" && time.Now().Unix() < secrets.PreviousUntil {
+		valid = hmac.Equal([]byte(signature), []byte(signPreviewToken(secrets.Previous, encoded)))
+	}
+	if !valid {
+		return claims, errPreviewToken
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return claims, errPreviewToken
+	}
+	if err := json.Unmarshal(data, &claims); err != nil || claims.WPUserID <= 0 {
+		return claims, errPreviewToken
+	}
+	now := time.Now().Unix()
+	if claims.ExpiresAt <= now {
+		return claims, errPreviewExpiry
+	}
+	if claims.ExpiresAt-claims.IssuedAt > int64(PreviewTokenMaxTTL/time.Second) {
+		return claims, errPreviewToken
+	}
+	return claims, nil
+}
+
+func previewGrantFor(sessionID string) (PreviewGrant, bool) {
+	previewMu.RLock()
+	defer previewMu.RUnlock()
+	grant, ok := previewGrants[sessionID]
+	if !ok || time.Now().After(grant.ExpiresAt) {
+		return PreviewGrant{}, false
+	}
+	return grant, true
+}
+
+// RPC for an editor's session to turn a WordPress preview token into preview access.
+// Payload: {"token": "..."}. Returns {"expires_at": unix seconds}.
+func rpcRedeemPreviewToken(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	userID, _ := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+	sessionID, _ := ctx.Value(runtime.RUNTIME_CTX_SESSION_ID).(string)
+	if userID == "" || sessionID == "" {
+		return "", runtime.NewError("preview needs a socket session", codeFailedPrecondition)
+	}
+
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal([]byte(payload), &req); err != nil || req.Token == "" {
+		return "", runtime.NewError("invalid payload", codeInvalidArgument)
+	}
+	claims, err := verifyPreviewToken(req.Token)
+	if err != nil {
+		logger.Warn("Rejected preview token from user %s: %v", userID, err)
+		return "", err
+	}
+
+	grant := PreviewGrant{UserID: userID, WPUserID: claims.WPUserID, ExpiresAt: time.Unix(claims.ExpiresAt, 0)}
+	previewMu.Lock()
+	previewGrants[sessionID] = grant
+	previewMu.Unlock()
+
+	logger.Info("Session %s of user %s is previewing as WordPress user %d", sessionID, userID, claims.WPUserID)
+	data, err := json.Marshal(map[string]int64{"expires_at": claims.ExpiresAt})
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// RPC listing unpublished buildings for a preview session.
+// Returns {"buildings": [...]}; trashed posts are left out.
+func rpcGetPreviewBuildings(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	sessionID, _ := ctx.Value(runtime.RUNTIME_CTX_SESSION_ID).(string)
+	if _, ok := previewGrantFor(sessionID); !ok {
+		return "", errNoPreview
+	}
+
+	config := cfg()
+	buildings := []Building{}
+	cursor := ""
+	for {
+		objects, next, err := nk.StorageList(ctx, "", "", DraftsCollection, 100, cursor)
+		if err != nil {
+			logger.Error("Failed to list draft buildings: %v", err)
+			return "", runtime.NewError("failed to list drafts", codeInternal)
+		}
+		for _, obj := range objects {
+			b, err := decodeBuilding(obj.Value)
+			if err != nil {
+				logger.WithField("key", obj.Key).WithField("err", err).Warn("Skipping undecodable draft building")
+				continue
+			}
+			if b.Status == StatusTrash {
+				continue
+			}
+			if err := b.rewriteAssets(config); err != nil {
+				continue
+			}
+			buildings = append(buildings, b)
+		}
+		if next == "" || len(objects) == 0 {
+			break
+		}
+		cursor = next
+	}
+
+	data, err := json.Marshal(map[string]interface{}{"buildings": buildings})
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Tell preview sessions a draft changed. Trashed drafts go away like deletes.
+func notifyPreviewUpdate(logger runtime.Logger, nk runtime.NakamaModule, b Building) {
+	if b.Status == StatusTrash {
+		notifyPreviewDelete(logger, nk, b.ID)
+		return
+	}
+	sendPreviewEvent(logger, nk, cellEvent{Type: "preview_update", Data: b})
+}
+
+func notifyPreviewDelete(logger runtime.Logger, nk runtime.NakamaModule, id int) {
+	sendPreviewEvent(logger, nk, cellEvent{Type: "preview_delete", Data: map[string]interface{}{"id": id}})
+}
+
+// Notify every user with a live grant, once per user however many sessions they have
+func sendPreviewEvent(logger runtime.Logger, nk runtime.NakamaModule, event cellEvent) {
+	now := time.Now()
+	seen := make(map[string]bool)
+	var notifications []*runtime.NotificationSend
+	previewMu.RLock()
+	for _, grant := range previewGrants {
+		if seen[grant.UserID] || now.After(grant.ExpiresAt) {
+			continue
+		}
+		seen[grant.UserID] = true
+		notifications = append(notifications, &runtime.NotificationSend{
+			UserID:  grant.UserID,
+			Subject: event.Type,
+			Content: map[string]interface{}{"data": event.Data},
+			Code:    1,
+		})
+	}
+	previewMu.RUnlock()
+	if len(notifications) == 0 {
+		return
+	}
+
+	if err := nk.NotificationsSend(context.Background(), notifications); err != nil {
+		logger.Error("Failed to send %s to preview sessions: %v", event.Type, err)
+	}
+}
+
+// Drop expired grants
+func startPreviewJanitor(logger runtime.Logger, nk runtime.NakamaModule) {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			now := time.Now()
+			previewMu.Lock()
+			for sessionID, grant := range previewGrants {
+				if now.After(grant.ExpiresAt) {
+					delete(previewGrants, sessionID)
+				}
+			}
+			previewMu.Unlock()
+		}
+	}()
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// A pass may delete at most this share of the stored buildings as orphans
+// unless forced. More than that looks like a broken source, not real deletes.
+const MaxOrphanShare = 0.5
+
+var errTooManyOrphans = errors.New("too many orphans")
+
+// Summary of what drifted between the source and storage in one pass
+type ReconcileResult struct {
+	Added     int `json:"added"`
+	Updated   int `json:"updated"`
+	Deleted   int `json:"deleted"`
+	Unchanged int `json:"unchanged"`
+	Failed    int `json:"failed"` // known to the source but couldn't be loaded, left untouched
+	Held      int `json:"held"`   // orphans kept because the pass looked suspicious
+}
+
+// Refuse orphan deletes that would empty storage or drop more than MaxOrphanShare of it
+func checkOrphanDeletion(stored, orphans int) error {
+	if orphans == 0 {
+		return nil
+	}
+	if orphans == stored {
+		return fmt.Errorf("%w: source returned none of the %d stored buildings", errTooManyOrphans, stored)
+	}
+	if float64(orphans) > float64(stored)*MaxOrphanShare {
+		return fmt.Errorf("%w: %d of %d stored buildings", errTooManyOrphans, orphans, stored)
+	}
+	return nil
+}
+
+// List every object in the buildings collection, following storage cursors
+func listAllBuildingObjects(ctx context.Context, nk runtime.NakamaModule) ([]*api.StorageObject, error) {
+	var all []*api.StorageObject
+	cursor := ""
+	for {
+		objects, next, err := nk.StorageList(ctx, "", "", "buildings", 100, cursor)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, objects...)
+		if next == "" || len(objects) == 0 {
+			return all, nil
+		}
+		cursor = next
+	}
+}
+
+// Diff the source (WordPress by default) against the buildings collection and fix
+// any drift: upsert missing/changed records, delete orphans and notify clients of each change.
+// Orphans are held back when checkOrphanDeletion objects, unless force is set.
+func reconcileBuildings(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, source BuildingSource, force bool) (ReconcileResult, error) {
+	var result ReconcileResult
+
+	fetched, err := source.FetchBuildings(ctx, logger, "")
+	if err != nil {
+		return result, fmt.Errorf("error fetching %s buildings: %w", source.Name(), err)
+	}
+
+	objects, err := listAllBuildingObjects(ctx, nk)
+	if err != nil {
+		return result, fmt.Errorf("error listing stored buildings: %w", err)
+	}
+	stored := make(map[string]*api.StorageObject, len(objects))
+	for _, obj := range objects {
+		stored[obj.Key] = obj
+	}
+
+	var changed []Building
+	for _, b := range fetched.Buildings {
+		key := strconv.Itoa(b.ID)
+		obj, exists := stored[key]
+		delete(stored, key)
+
+		if exists {
+			if current, err := decodeBuilding(obj.Value); err == nil && current.SameContent(b) {
+				result.Unchanged++
+				continue
+			}
+			result.Updated++
+		} else {
+			result.Added++
+		}
+
+		changed = append(changed, b)
+	}
+
+	for _, b := range changed {
+		prev := previousBuilding(b.ID)
+		if err := upsertBuilding(ctx, logger, nk, &b); err != nil {
+			if err == errStaleBuilding {
+				// A push landed something newer while we were fetching
+				continue
+			}
+			return result, fmt.Errorf("error writing reconciled building %d: %w", b.ID, err)
+		}
+		notifyBuildingUpdate(ctx, logger, nk, b, prev)
+	}
+
+	// Items the source failed to load still exist there, don't treat them as orphans
+	for id := range fetched.Failed {
+		delete(stored, strconv.Itoa(id))
+	}
+	result.Failed = len(fetched.Failed)
+	recordSyncFailures(result.Failed)
+
+	// Whatever is left in storage no longer exists in the source
+	if err := checkOrphanDeletion(len(objects), len(stored)); err != nil && !force {
+		logger.Warn("Not deleting orphaned buildings from %s pass: %v", source.Name(), err)
+		result.Held = len(stored)
+		return result, nil
+	}
+	var orphanIDs []int
+	orphans := make(map[int]*Building)
+	for key := range stored {
+		id, _ := strconv.Atoi(key)
+		orphanIDs = append(orphanIDs, id)
+		orphans[id] = previousBuilding(id)
+	}
+	if err := deleteBuildings(ctx, logger, nk, orphanIDs); err != nil {
+		return result, fmt.Errorf("error deleting orphaned buildings: %w", err)
+	}
+	result.Deleted = len(orphanIDs)
+	for _, id := range orphanIDs {
+		notifyBuildingDelete(ctx, logger, nk, id, orphans[id])
+	}
+
+	// A clean full pass is as good as a full sync, so move the incremental cursor along
+	if fetched.Cursor != "" && len(fetched.Failed) == 0 {
+		if err := writeSyncCursor(ctx, nk, SyncCursor{Modified: fetched.Cursor, SyncedAt: time.Now().Unix()}); err != nil {
+			logger.Error("Failed to save WP sync cursor: %v", err)
+		}
+	}
+
+	return result, nil
+}
+
+// Run reconcileBuildings every cfg().ReconcileInterval for the lifetime of the server.
+// Interval and source are re-read each pass so admin config changes apply without a restart.
+func startReconciler(logger runtime.Logger, nk runtime.NakamaModule) {
+	go func() {
+		for {
+			interval := cfg().ReconcileInterval
+			if interval <= 0 {
+				// Disabled, check again later in case an admin turns it on
+				time.Sleep(time.Minute)
+				continue
+			}
+			time.Sleep(interval)
+
+			source, err := newBuildingSource(cfg(), nk)
+			if err != nil {
+				logger.Error("Building reconcile skipped: %v", err)
+				continue
+			}
+
+			start := time.Now()
+			result, err := reconcileBuildings(context.Background(), logger, nk, guardedSource(source, sourceBreaker), false)
+			recordSyncResult(source.Name(), err)
+			if err != nil {
+				logger.Error("Building reconcile failed: %v", err)
+				continue
+			}
+			if result.Added+result.Updated+result.Deleted+result.Failed+result.Held > 0 {
+				logger.Warn("Building drift fixed: %d added, %d updated, %d deleted, %d unchanged, %d failed, %d held (took %v)",
+					result.Added, result.Updated, result.Deleted, result.Unchanged, result.Failed, result.Held, time.Since(start))
+			} else {
+				logger.Info("Buildings in sync with %s: %d unchanged (took %v)", source.Name(), result.Unchanged, time.Since(start))
+			}
+		}
+	}()
+
+	logger.Info("Building reconciler started, interval %v", cfg().ReconcileInterval)
+}
+
+// Admin RPC running one reconcile pass now. Payload: {"force"?}; force deletes
+// orphans even when the pass would remove most of the stored buildings.
+func rpcAdminReconcileBuildings(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return "", err
+	}
+	var req struct {
+		Force bool `json:"force"`
+	}
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &req); err != nil {
+			return "", runtime.NewError("invalid payload", codeInvalidArgument)
+		}
+	}
+
+	source, err := newBuildingSource(cfg(), nk)
+	if err != nil {
+		return "", runtime.NewError(err.Error(), codeFailedPrecondition)
+	}
+	result, err := reconcileBuildings(ctx, logger, nk, guardedSource(source, sourceBreaker), req.Force)
+	recordSyncResult(source.Name(), err)
+	if err != nil {
+		logger.Error("Admin reconcile failed: %v", err)
+		return "", runtime.NewError("reconcile failed", codeUnavailable)
+	}
+	logger.Info("Admin reconcile (force=%v): %+v", req.Force, result)
+
+	data, _ := json.Marshal(result)
+	return string(data), nil
+}
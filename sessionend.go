@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// Group streams each session joined
+type GroupPresence struct {
+	mu       sync.Mutex
+	sessions map[string]map[string]bool // session id -> group names
+}
+
+var groupPresence = &GroupPresence{
+	sessions: make(map[string]map[string]bool),
+}
+
+// Record that a session joined a group stream
+func (g *GroupPresence) Track(sessionID, group string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	groups := g.sessions[sessionID]
+	if groups == nil {
+		groups = make(map[string]bool)
+		g.sessions[sessionID] = groups
+	}
+	groups[group] = true
+}
+
+// Forget a session, returning the groups it was in
+func (g *GroupPresence) Release(sessionID string) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var released []string
+	for group := range g.sessions[sessionID] {
+		released = append(released, group)
+	}
+	delete(g.sessions, sessionID)
+	sort.Strings(released)
+	return released
+}
+
+// Whether any other session of the user still has cell subscriptions
+func (r *SubscriptionRegistry) HasUser(userID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, sub := range r.sessions {
+		if sub.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// Tell a stream a player is gone so clients can drop the marker right away
+func broadcastPlayerLeft(logger runtime.Logger, nk runtime.NakamaModule, label, userID string) {
+	msg, _ := json.Marshal(map[string]interface{}{"type": "player_left", "user_id": userID, "cell": label})
+	if err := nk.StreamSend(cfg().StreamMode, "", "", label, string(msg), nil, true); err != nil {
+		logger.WithField("stream", label).WithField("err", err).Warn("Failed to send player_left")
+	}
+}
+
+// Clean up everything a session had joined: cell and group streams, preview
+// access and, once the user has no session left, open geofence stays.
+func handlePlayerLeave(ctx context.Context, nk runtime.NakamaModule, userID string, sessionID string, logger runtime.Logger) {
+	streamMode := cfg().StreamMode
+
+	sub, err := dropSubscription(nk, sessionID)
+	if err != nil {
+		logger.Debug("Leaving cell streams for ended session %s: %v", sessionID, err)
+	}
+	// Other players only drop the user once their last session is gone
+	lastSession := !subscriptions.HasUser(userID)
+	if lastSession {
+		locationBatches.Drop(userID)
+		for _, label := range sub.labels() {
+			broadcastPlayerLeft(logger, nk, label, userID)
+		}
+	}
+
+	groups := groupPresence.Release(sessionID)
+	for _, group := range groups {
+		if err := nk.StreamUserLeave(streamMode, "", "", group, userID, sessionID); err != nil {
+			logger.Debug("Leaving group stream %s for ended session %s: %v", group, sessionID, err)
+		}
+		if lastSession {
+			broadcastPlayerLeft(logger, nk, group, userID)
+		}
+	}
+
+	previewMu.Lock()
+	delete(previewGrants, sessionID)
+	previewMu.Unlock()
+
+	if lastSession {
+		positions.Remove(userID)
+		coarseCells.Remove(userID)
+		handleGeofenceEvents(ctx, logger, nk, userID, geofences.Leave(userID, time.Now()))
+	}
+
+	logger.Debug("Session %s of user %s ended, left %d cells and %d groups", sessionID, userID, len(sub.Cells), len(groups))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// Where buildings come from. InitBuildings seeds storage from it and the
+// reconciler diffs storage against it.
+type BuildingSource interface {
+	// Short name used in logs
+	Name() string
+	// Returns nil once the source can be fetched from
+	Ready(ctx context.Context) error
+	// Returns buildings changed since cursor ("" for all of them) and the cursor
+	// to pass next time. Sources without change tracking return everything and "".
+	FetchBuildings(ctx context.Context, logger runtime.Logger, cursor string) (FetchResult, error)
+}
+
+// Outcome of a fetch. Failed holds buildings the source knows about but couldn't
+// fully load (e.g. their image lookup failed); they must not be treated as deleted.
+type FetchResult struct {
+	Buildings []Building
+	Cursor    string
+	Failed    map[int]error
+}
+
+// Build the configured building source:
+//
+//	building_source=wordpress (default) | file | memory
+//	building_source_path=/nakama/data/buildings.geojson (file source only)
+func newBuildingSource(c Config, nk runtime.NakamaModule) (BuildingSource, error) {
+	switch kind := c.BuildingSource; kind {
+	case "", "wordpress":
+		return NewWordPressSource(c.WPBaseURL, c.WPCategoryID, newStorageMediaCache(nk)), nil
+	case "file":
+		if c.BuildingSourcePath == "" {
+			return nil, fmt.Errorf("building_source=file needs building_source_path")
+		}
+		return NewFileSource(c.BuildingSourcePath), nil
+	case "memory":
+		// Shared so buildings put in it survive between reconcile passes
+		return memorySource, nil
+	default:
+		return nil, fmt.Errorf("unknown building_source %q", kind)
+	}
+}
+
+// In-memory BuildingSource, for tests and local experiments
+type MemorySource struct {
+	mu        sync.RWMutex
+	buildings map[int]Building
+}
+
+// The one MemorySource building_source=memory hands out
+var memorySource = NewMemorySource()
+
+func NewMemorySource(buildings ...Building) *MemorySource {
+	s := &MemorySource{buildings: make(map[int]Building, len(buildings))}
+	for _, b := range buildings {
+		s.buildings[b.ID] = b
+	}
+	return s
+}
+
+func (s *MemorySource) Name() string { return "memory" }
+
+func (s *MemorySource) Ready(ctx context.Context) error { return nil }
+
+func (s *MemorySource) Put(b Building) {
+	s.mu.Lock()
+	s.buildings[b.ID] = b
+	s.mu.Unlock()
+}
+
+func (s *MemorySource) Delete(id int) {
+	s.mu.Lock()
+	delete(s.buildings, id)
+	s.mu.Unlock()
+}
+
+func (s *MemorySource) FetchBuildings(ctx context.Context, logger runtime.Logger, cursor string) (FetchResult, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	buildings := make([]Building, 0, len(s.buildings))
+	for _, b := range s.buildings {
+		if err := b.normalize(); err != nil {
+			logger.Error("Skipping invalid in-memory building: %v", err)
+			continue
+		}
+		buildings = append(buildings, b)
+	}
+	sort.Slice(buildings, func(i, j int) bool { return buildings[i].ID < buildings[j].ID })
+	return FetchResult{Buildings: buildings}, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestNewBuildingSourceMemoryIsShared(t *testing.T) {
+	c := defaultConfig()
+	c.BuildingSource = "memory"
+
+	first, err := newBuildingSource(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.(*MemorySource).Put(Building{ID: 7, Title: "Tower", Lat: 1, Lon: 2})
+	defer memorySource.Delete(7)
+
+	second, err := newBuildingSource(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetched, err := second.FetchBuildings(context.Background(), nopLogger{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fetched.Buildings) != 1 || fetched.Buildings[0].ID != 7 {
+		t.Fatalf("second source lost the building: %+v", fetched.Buildings)
+	}
+}
+
+func TestMemorySourceFetch(t *testing.T) {
+	s := NewMemorySource(
+		Building{ID: 3, Title: " C ", Lat: 1, Lon: 1},
+		Building{ID: 1, Title: "A", Lat: 1, Lon: 1},
+		Building{ID: 2, Title: "bad", Lat: 0, Lon: 0},
+	)
+	fetched, err := s.FetchBuildings(context.Background(), nopLogger{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fetched.Buildings) != 2 {
+		t.Fatalf("got %d buildings, want 2 (null island skipped)", len(fetched.Buildings))
+	}
+	if fetched.Buildings[0].ID != 1 || fetched.Buildings[1].ID != 3 {
+		t.Errorf("buildings not sorted by id: %d, %d", fetched.Buildings[0].ID, fetched.Buildings[1].ID)
+	}
+	if got := fetched.Buildings[1]; got.Title != "C" || got.Status != "publish" || got.SchemaVersion != BuildingSchemaVersion {
+		t.Errorf("building not normalized: %+v", got)
+	}
+
+	s.Delete(3)
+	fetched, _ = s.FetchBuildings(context.Background(), nopLogger{}, "")
+	if len(fetched.Buildings) != 1 {
+		t.Errorf("delete not applied, got %d buildings", len(fetched.Buildings))
+	}
+}
+
+func TestCheckOrphanDeletion(t *testing.T) {
+	tests := []struct {
+		name            string
+		stored, orphans int
+		wantErr         bool
+	}{
+		{"nothing stored", 0, 0, false},
+		{"no orphans", 10, 0, false},
+		{"a few orphans", 10, 3, false},
+		{"exactly half", 10, 5, false},
+		{"more than half", 10, 6, true},
+		{"empty snapshot", 10, 10, true},
+		{"last building", 1, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkOrphanDeletion(tt.stored, tt.orphans)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkOrphanDeletion(%d, %d) = %v, want error %v", tt.stored, tt.orphans, err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, errTooManyOrphans) {
+				t.Errorf("error %v does not wrap errTooManyOrphans", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// Index bucket size in degrees (~1.1km of latitude)
+	spatialCellDegrees = 0.01
+	// Past this many buckets a query just scans every building
+	spatialMaxQueryCells = 4096
+
+	DefaultNearbyRadius = 500.0
+	MaxNearbyRadius     = 50000.0
+	DefaultNearbyLimit  = 50
+	MaxNearbyLimit      = 500
+)
+
+type spatialCell struct {
+	Lat, Lon int
+}
+
+// In-memory grid index over the buildings collection. Buildings are bucketed
+// into fixed lat/lon cells (geohash-style) so radius and bbox queries only
+// look at nearby buckets instead of every building.
+type SpatialIndex struct {
+	mu        sync.RWMutex
+	cellSize  float64
+	buildings map[int]Building
+	cells     map[spatialCell]map[int]struct{}
+}
+
+func NewSpatialIndex(cellSize float64) *SpatialIndex {
+	return &SpatialIndex{
+		cellSize:  cellSize,
+		buildings: map[int]Building{},
+		cells:     map[spatialCell]map[int]struct{}{},
+	}
+}
+
+// Shared index, kept in step with storage by upsertBuilding and deleteBuildings
+var buildingIndex = NewSpatialIndex(spatialCellDegrees)
+
+func (idx *SpatialIndex) cellFor(lat, lon float64) spatialCell {
+	return spatialCell{Lat: int(math.Floor(lat / idx.cellSize)), Lon: int(math.Floor(lon / idx.cellSize))}
+}
+
+func (idx *SpatialIndex) removeLocked(id int) {
+	old, ok := idx.buildings[id]
+	if !ok {
+		return
+	}
+	cell := idx.cellFor(old.Lat, old.Lon)
+	delete(idx.cells[cell], id)
+	if len(idx.cells[cell]) == 0 {
+		delete(idx.cells, cell)
+	}
+	delete(idx.buildings, id)
+}
+
+func (idx *SpatialIndex) Upsert(b Building) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.removeLocked(b.ID)
+	cell := idx.cellFor(b.Lat, b.Lon)
+	if idx.cells[cell] == nil {
+		idx.cells[cell] = map[int]struct{}{}
+	}
+	idx.cells[cell][b.ID] = struct{}{}
+	idx.buildings[b.ID] = b
+}
+
+func (idx *SpatialIndex) Remove(id int) {
+	idx.mu.Lock()
+	idx.removeLocked(id)
+	idx.mu.Unlock()
+}
+
+// Replace the whole index contents
+func (idx *SpatialIndex) Reset(buildings []Building) {
+	idx.mu.Lock()
+	idx.buildings = map[int]Building{}
+	idx.cells = map[spatialCell]map[int]struct{}{}
+	idx.mu.Unlock()
+	for _, b := range buildings {
+		idx.Upsert(b)
+	}
+}
+
+func (idx *SpatialIndex) Get(id int) (Building, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	b, ok := idx.buildings[id]
+	return b, ok
+}
+
+func (idx *SpatialIndex) Len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.buildings)
+}
+
+// Every building inside the bounding box
+func (idx *SpatialIndex) InBox(bb BoundingBox) []Building {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	lo := idx.cellFor(bb.MinLat, bb.MinLon)
+	hi := idx.cellFor(bb.MaxLat, bb.MaxLon)
+
+	var out []Building
+	if (hi.Lat-lo.Lat+1)*(hi.Lon-lo.Lon+1) > spatialMaxQueryCells {
+		for _, b := range idx.buildings {
+			if bb.Contains(b.Lat, b.Lon) {
+				out = append(out, b)
+			}
+		}
+		return out
+	}
+
+	for cLat := lo.Lat; cLat <= hi.Lat; cLat++ {
+		for cLon := lo.Lon; cLon <= hi.Lon; cLon++ {
+			for id := range idx.cells[spatialCell{Lat: cLat, Lon: cLon}] {
+				if b := idx.buildings[id]; bb.Contains(b.Lat, b.Lon) {
+					out = append(out, b)
+				}
+			}
+		}
+	}
+	return out
+}
+
+// Building plus where it is relative to the caller
+type NearbyBuilding struct {
+	Building
+	Distance float64 `json:"distance"` // meters
+	Bearing  float64 `json:"bearing"`  // degrees from true north
+}
+
+// Buildings within radius meters of a point (and inside bb if given), nearest first
+func (idx *SpatialIndex) Nearby(lat, lon, radius float64, bb *BoundingBox, limit int) []NearbyBuilding {
+	searches := boundingBoxesAround(lat, lon, radius)
+	if bb != nil {
+		searches = []BoundingBox{*bb}
+	}
+
+	var out []NearbyBuilding
+	for _, search := range searches {
+		for _, b := range idx.InBox(search) {
+			d := haversineMeters(lat, lon, b.Lat, b.Lon)
+			if bb == nil && d > radius {
+				continue
+			}
+			out = append(out, NearbyBuilding{Building: b, Distance: d, Bearing: initialBearing(lat, lon, b.Lat, b.Lon)})
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Distance < out[j].Distance })
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+// Fill the index from the buildings collection
+func loadBuildingIndex(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule) error {
+	objects, err := listAllBuildingObjects(ctx, nk)
+	if err != nil {
+		return err
+	}
+	buildings := make([]Building, 0, len(objects))
+	for _, obj := range objects {
+		b, err := decodeBuilding(obj.Value)
+		if err != nil {
+			logger.Warn("Not indexing invalid stored building %s: %v", obj.Key, err)
+			continue
+		}
+		buildings = append(buildings, b)
+	}
+	buildingIndex.Reset(buildings)
+	logger.Info("Spatial index loaded with %d buildings", len(buildings))
+	return nil
+}
+
+// RPC returning buildings near a point, nearest first.
+// Payload: {"lat", "lon", "radius" (meters), "bbox" (instead of radius), "limit"}.
+func rpcGetBuildingsNearby(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var req struct {
+		Lat    *float64     `json:"lat"`
+		Lon    *float64     `json:"lon"`
+		Radius float64      `json:"radius,omitempty"`
+		BBox   *BoundingBox `json:"bbox,omitempty"`
+		Limit  int          `json:"limit,omitempty"`
+	}
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		return "", runtime.NewError("invalid payload", codeInvalidArgument)
+	}
+	if req.Lat == nil || req.Lon == nil {
+		return "", runtime.NewError("lat and lon are required", codeInvalidArgument)
+	}
+	if *req.Lat < -90 || *req.Lat > 90 || *req.Lon < -180 || *req.Lon > 180 {
+		return "", runtime.NewError("lat/lon out of range", codeInvalidArgument)
+	}
+	if req.Radius <= 0 {
+		req.Radius = DefaultNearbyRadius
+	}
+	if req.Radius > MaxNearbyRadius {
+		req.Radius = MaxNearbyRadius
+	}
+	if req.BBox != nil {
+		if err := req.BBox.Validate(); err != nil {
+			return "", err
+		}
+	}
+	if req.Limit <= 0 {
+		req.Limit = DefaultNearbyLimit
+	}
+	if req.Limit > MaxNearbyLimit {
+		req.Limit = MaxNearbyLimit
+	}
+
+	config := cfg()
+	nearby := buildingIndex.Nearby(*req.Lat, *req.Lon, req.Radius, req.BBox, req.Limit)
+	result := make([]NearbyBuilding, 0, len(nearby))
+	for _, n := range nearby {
+		if err := n.rewriteAssets(config); err != nil {
+			logger.Warn("Skipping building %d with unusable asset URL: %v", n.ID, err)
+			continue
+		}
+		result = append(result, n)
+	}
+
+	data, err := json.Marshal(map[string]interface{}{"buildings": result})
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
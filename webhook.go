@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// Headers WordPress sends alongside a signed push.
+// Signature is "sha256=" + hex(HMAC-SHA256(secret, timestamp + "." + nonce + "." + payload)).
+const (
+	WebhookTimestampHeader = "X-Nakama-Timestamp"
+	WebhookNonceHeader     = "X-Nakama-Nonce"
+	WebhookSignatureHeader = "X-Nakama-Signature"
+)
+
+const (
+	WebhookCollection      = "webhook"
+	WebhookSecretKey       = "secret"
+	WebhookNonceCollection = "webhook_nonces"
+
+	// How far a request timestamp may drift from server time
+	WebhookMaxSkew = 5 * time.Minute
+	// How long the old secret keeps working after a rotation by default
+	WebhookRotationGrace = 10 * time.Minute
+)
+
+// Current and previous shared secrets. The previous one is accepted until
+// PreviousUntil so WordPress can be switched over without dropping pushes.
+type WebhookSecrets struct {
+	Current       string `json:"current"`
+	Previous      string `json:"previous,omitempty"`
+	PreviousUntil int64  `json:"previous_until,omitempty"`
+	RotatedAt     int64  `json:"rotated_at,omitempty"`
+}
+
+var (
+	webhookMu      sync.RWMutex
+	webhookSecrets WebhookSecrets
+)
+
+var (
+	errWebhookNotConfigured = runtime.NewError("webhook secret not configured", codeFailedPrecondition)
+	errWebhookUnsigned      = runtime.NewError("missing webhook signature", codeUnauthenticated)
+	errWebhookBadSignature  = runtime.NewError("invalid webhook signature", codeUnauthenticated)
+	errWebhookStale         = runtime.NewError("stale webhook timestamp", codeUnauthenticated)
+	errWebhookReplay        = runtime.NewError("webhook nonce already used", codePermissionDenied)
+)
+
+// Load secrets from storage, falling back to the "wp_webhook_secret" runtime env value
+func initWebhookSecrets(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule) error {
+	records, err := nk.StorageRead(ctx, []*runtime.StorageRead{{
+		Collection: WebhookCollection,
+		Key:        WebhookSecretKey,
+		UserID:     "",
+	}})
+	if err != nil {
+		return err
+	}
+
+	var secrets WebhookSecrets
+	if len(records) > 0 {
+		if err := json.Unmarshal([]byte(records[0].Value), &secrets); err != nil {
+			return err
+		}
+		logger.Info("Loaded rotated webhook secret from storage")
+	} else {
+		secrets.Current = cfg().WebhookSecret
+	}
+
+	if secrets.Current == "" {
+		logger.Warn("No webhook secret configured, wp_push_building will reject every request")
+	}
+
+	webhookMu.Lock()
+	webhookSecrets = secrets
+	webhookMu.Unlock()
+	return nil
+}
+
+// Case-insensitive lookup of an HTTP header passed through to the RPC context
+func headerValue(ctx context.Context, name string) string {
+	headers, _ := ctx.Value(runtime.RUNTIME_CTX_HEADERS).(map[string][]string)
+	for k, v := range headers {
+		if strings.EqualFold(k, name) && len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+func signWebhook(secret, timestamp, nonce, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + nonce + "." + payload))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check the signature, timestamp and nonce of a WordPress push.
+// The nonce is recorded with a create-only write so a replay fails atomically.
+func verifyWebhook(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, payload string) error {
+	webhookMu.RLock()
+	secrets := webhookSecrets
+	webhookMu.RUnlock()
+	if secrets.Current == "" {
+		return errWebhookNotConfigured
+	}
+
+	timestamp := headerValue(ctx, WebhookTimestampHeader)
+	nonce := headerValue(ctx, WebhookNonceHeader)
+	signature := headerValue(ctx, WebhookSignatureHeader)
+	if timestamp == "" || nonce == "" || signature == "" {
+		return errWebhookUnsigned
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errWebhookStale
+	}
+	skew := time.Since(time.Unix(ts, 0))
+	if skew > WebhookMaxSkew || skew < -WebhookMaxSkew {
+		logger.Warn("Rejected webhook with timestamp %d (skew %v)", ts, skew)
+		return errWebhookStale
+	}
+
+	valid := hmac.Equal([]byte(signature), []byte(signWebhook(secrets.Current, timestamp, nonce, payload)))
+	if !valid && secrets.Previous != "" && time.Now().Unix() < secrets.PreviousUntil {
+		valid = hmac.Equal([]byte(signature), []byte(signWebhook(secrets.Previous, timestamp, nonce, payload)))
+	}
+	if !valid {
+		logger.Warn("Rejected webhook with invalid signature")
+		return errWebhookBadSignature
+	}
+
+	val, _ := json.Marshal(map[string]int64{"ts": ts})
+	if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      WebhookNonceCollection,
+		Key:             nonce,
+		UserID:          "",
+		Value:           string(val),
+		Version:         "*", // only succeeds if the nonce was never seen
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}}); err != nil {
+		logger.Warn("Rejected webhook replay for nonce %s", nonce)
+		return errWebhookReplay
+	}
+
+	return nil
+}
+
+// Admin RPC to rotate the shared secret without a redeploy.
+// Payload: {"secret": "...", "grace_seconds": 600}, both optional. A random secret
+// is generated when none is given. The old secret stays valid for the grace period.
+func rpcRotateWebhookSecret(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return "", err
+	}
+
+	var req struct {
+		Secret       string `json:"secret"`
+		GraceSeconds *int   `json:"grace_seconds"`
+	}
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &req); err != nil {
+			return "", runtime.NewError("invalid payload", codeInvalidArgument)
+		}
+	}
+
+	grace := WebhookRotationGrace
+	if req.GraceSeconds != nil {
+		if *req.GraceSeconds < 0 {
+			return "", runtime.NewError("grace_seconds must not be negative", codeInvalidArgument)
+		}
+		grace = time.Duration(*req.GraceSeconds) * time.Second
+	}
+
+	secret := req.Secret
+	if secret == "" {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			return "", runtime.NewError("failed to generate secret", codeInternal)
+		}
+		secret = hex.EncodeToString(buf)
+	} else if len(secret) < 16 {
+		return "", runtime.NewError("secret must be at least 16 characters", codeInvalidArgument)
+	}
+
+	webhookMu.Lock()
+	defer webhookMu.Unlock()
+
+	now := time.Now()
+	next := WebhookSecrets{
+		Current:       secret,
+		Previous:      webhookSecrets.Current,
+		PreviousUntil: now.Add(grace).Unix(),
+		RotatedAt:     now.Unix(),
+	}
+	val, _ := json.Marshal(next)
+	if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      WebhookCollection,
+		Key:             WebhookSecretKey,
+		UserID:          "",
+		Value:           string(val),
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}}); err != nil {
+		logger.Error("Failed to store rotated webhook secret: %v", err)
+		return "", runtime.NewError("failed to store secret", codeInternal)
+	}
+	webhookSecrets = next
+
+	logger.Info("Webhook secret rotated, previous secret valid until %v", time.Unix(next.PreviousUntil, 0))
+
+	resp, _ := json.Marshal(map[string]interface{}{
+		"secret":         secret,
+		"previous_until": next.PreviousUntil,
+	})
+	return string(resp), nil
+}
+
+// Periodically drop nonces older than the accepted timestamp window; they can't be replayed anyway
+func startNonceJanitor(logger runtime.Logger, nk runtime.NakamaModule) {
+	go func() {
+		ticker := time.NewTicker(WebhookMaxSkew * 6)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			ctx := context.Background()
+			cutoff := time.Now().Add(-2 * WebhookMaxSkew).Unix()
+			cursor := ""
+			for {
+				objects, next, err := nk.StorageList(ctx, "", "", WebhookNonceCollection, 100, cursor)
+				if err != nil {
+					logger.Error("Failed to list webhook nonces: %v", err)
+					break
+				}
+
+				var deletes []*runtime.StorageDelete
+				for _, obj := range objects {
+					var val struct {
+						TS int64 `json:"ts"`
+					}
+					if err := json.Unmarshal([]byte(obj.Value), &val); err != nil || val.TS < cutoff {
+						deletes = append(deletes, &runtime.StorageDelete{Collection: WebhookNonceCollection, Key: obj.Key, UserID: ""})
+					}
+				}
+				if len(deletes) > 0 {
+					if err := nk.StorageDelete(ctx, deletes); err != nil {
+						logger.Error("Failed to prune webhook nonces: %v", err)
+					}
+				}
+
+				if next == "" || len(objects) == 0 {
+					break
+				}
+				cursor = next
+			}
+		}
+	}()
+}
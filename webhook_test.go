@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+func TestSignWebhook(t *testing.T) {
+	// Same value PHP's hash_hmac('sha256', "$ts.$nonce.$body", $secret) gives
+	got := signWebhook("topsecret", "1700000000", "abc123", `{"id":42}`)
+	want := "sha256=72087ed43aa0d492d6e00006e3f41ba443c0316ba66ae481bdd865f61863f93c"
+	if got != want {
+		t.Errorf("signWebhook = %s, want %s", got, want)
+	}
+}
+
+// Context carrying the headers Nakama hands an RPC
+func webhookContext(headers map[string]string) context.Context {
+	h := make(map[string][]string, len(headers))
+	for k, v := range headers {
+		h[k] = []string{v}
+	}
+	return context.WithValue(context.Background(), runtime.RUNTIME_CTX_HEADERS, h)
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	saved := webhookSecrets
+	defer func() { webhookSecrets = saved }()
+
+	const payload = `{"id":42}`
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-WebhookMaxSkew-time.Minute).Unix(), 10)
+	future := strconv.FormatInt(time.Now().Add(WebhookMaxSkew+time.Minute).Unix(), 10)
+	inGrace := time.Now().Add(time.Minute).Unix()
+	expired := time.Now().Add(-time.Minute).Unix()
+
+	signed := func(secret, ts, nonce, body string) map[string]string {
+		return map[string]string{
+			WebhookTimestampHeader: ts,
+			WebhookNonceHeader:     nonce,
+			WebhookSignatureHeader: signWebhook(secret, ts, nonce, body),
+		}
+	}
+
+	tests := []struct {
+		name    string
+		secrets WebhookSecrets
+		headers map[string]string
+		want    error
+	}{
+		{"not configured", WebhookSecrets{}, signed("s1", now, "n1", payload), errWebhookNotConfigured},
+		{"valid", WebhookSecrets{Current: "s1"}, signed("s1", now, "n2", payload), nil},
+		{"lowercase headers", WebhookSecrets{Current: "s1"}, map[string]string{
+			"x-nakama-timestamp": now,
+			"x-nakama-nonce":     "n3",
+			"x-nakama-signature": signWebhook("s1", now, "n3", payload),
+		}, nil},
+		{"no signature", WebhookSecrets{Current: "s1"}, map[string]string{WebhookTimestampHeader: now, WebhookNonceHeader: "n4"}, errWebhookUnsigned},
+		{"no headers", WebhookSecrets{Current: "s1"}, nil, errWebhookUnsigned},
+		{"wrong secret", WebhookSecrets{Current: "s1"}, signed("s2", now, "n5", payload), errWebhookBadSignature},
+		{"tampered payload", WebhookSecrets{Current: "s1"}, signed("s1", now, "n6", `{"id":43}`), errWebhookBadSignature},
+		{"signature without prefix", WebhookSecrets{Current: "s1"}, map[string]string{
+			WebhookTimestampHeader: now,
+			WebhookNonceHeader:     "n7",
+			WebhookSignatureHeader: signWebhook("s1", now, "n7", payload)[len("sha256="):],
+		}, errWebhookBadSignature},
+		{"timestamp not a number", WebhookSecrets{Current: "s1"}, signed("s1", "yesterday", "n8", payload), errWebhookStale},
+		{"stale timestamp", WebhookSecrets{Current: "s1"}, signed("s1", stale, "n9", payload), errWebhookStale},
+		{"future timestamp", WebhookSecrets{Current: "s1"}, signed("s1", future, "n10", payload), errWebhookStale},
+		{"previous secret in grace", WebhookSecrets{Current: "s2", Previous: "s1", PreviousUntil: inGrace}, signed("s1", now, "n11", payload), nil},
+		{"previous secret expired", WebhookSecrets{Current: "s2", Previous: "s1", PreviousUntil: expired}, signed("s1", now, "n12", payload), errWebhookBadSignature},
+		{"replayed nonce", WebhookSecrets{Current: "s1"}, signed("s1", now, "n2", payload), errWebhookReplay},
+	}
+
+	nk := newFakeStorage()
+	for _, tt := range tests {
+		webhookSecrets = tt.secrets
+		err := verifyWebhook(webhookContext(tt.headers), nopLogger{}, nk, payload)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: verifyWebhook = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
@@ -2,16 +2,157 @@
 /*
 Plugin Name: Nakama Notifier
 Description: Sends building updates from WordPress to Nakama server when posts change.
-Version: 1.3
+Version: 1.11
 Author: EduardoGDGV
 */
 
 if (!defined('ABSPATH')) exit; // No direct access
 
+// Shared secret used to sign pushes. Must match the Nakama "wp_webhook_secret"
+// runtime env value (or the secret set with the wp_rotate_webhook_secret RPC).
+// Resolution order: nakama_webhook_secret option, NAKAMA_WEBHOOK_SECRET constant, env var.
+function nakama_webhook_secret() {
+    $secret = get_option('nakama_webhook_secret');
+    if (!$secret && defined('NAKAMA_WEBHOOK_SECRET')) $secret = NAKAMA_WEBHOOK_SECRET;
+    if (!$secret) $secret = getenv('NAKAMA_WEBHOOK_SECRET');
+    return $secret ?: '';
+}
+
+// POST a signed payload to the wp_push_building RPC
+function nakama_push_building($payload) {
+    $url  = "http://nakama:7350/v2/rpc/wp_push_building?http_key=defaulthttpkey";
+    $json = json_encode($payload, JSON_UNESCAPED_SLASHES);
+
+    $timestamp = (string) time();
+    $nonce     = bin2hex(random_bytes(16));
+    $signature = 'sha256=' . hash_hmac('sha256', $timestamp . '.' . $nonce . '.' . $json, nakama_webhook_secret());
+
+    return wp_remote_post($url, [
+        'headers' => [
+            'Content-Type'       => 'application/json',
+            'Accept'             => 'application/json',
+            'X-Nakama-Timestamp' => $timestamp,
+            'X-Nakama-Nonce'     => $nonce,
+            'X-Nakama-Signature' => $signature,
+        ],
+        'body'    => json_encode($json),
+        'method'  => 'POST',
+        'timeout' => 10,
+        'data_format' => 'body',
+    ]);
+}
+
+// --- AR preview ---
+
+// Where the map app lives, preview links open it with a token
+function nakama_app_url() {
+    if (defined('NAKAMA_APP_URL')) return NAKAMA_APP_URL;
+    return getenv('NAKAMA_APP_URL') ?: 'http://localhost:5173/src/map.html';
+}
+
+// Token that lets a Nakama session see draft buildings, see preview.go.
+// base64url(claims) . "." . hex(HMAC-SHA256(secret, "preview." . base64url(claims)))
+function nakama_preview_token($user_id, $ttl = 3600) {
+    $claims  = json_encode(["sub" => (int) $user_id, "iat" => time(), "exp" => time() + $ttl]);
+    $encoded = rtrim(strtr(base64_encode($claims), '+/', '-_'), '=');
+    return $encoded . '.' . hash_hmac('sha256', 'preview.' . $encoded, nakama_webhook_secret());
+}
+
+// POST /wp-json/nakama/v1/preview-token, for editors only. The token is a
+// bearer credential, so it is never put in a URL.
+add_action('rest_api_init', function () {
+    register_rest_route('nakama/v1', '/preview-token', [
+        'methods'  => 'POST',
+        'permission_callback' => function () { return current_user_can('edit_posts'); },
+        'callback' => function () {
+            $response = new WP_REST_Response(["token" => nakama_preview_token(get_current_user_id())]);
+            $response->header('Cache-Control', 'no-store');
+            return $response;
+        },
+    ]);
+});
+
+// "Preview in AR" row action on buildings the user can edit
+add_filter('post_row_actions', function ($actions, $post) {
+    if ($post->post_type !== 'post' || !current_user_can('edit_post', $post->ID)) return $actions;
+    if (!in_array(3, wp_get_post_categories($post->ID))) return $actions;
+
+    $actions['nakama_preview'] = '<a href="#" class="nakama-preview" data-building="' . intval($post->ID) . '">Preview in AR</a>';
+    return $actions;
+}, 10, 2);
+
+// On click: open the app, fetch a token from the REST route and hand it over
+// with postMessage once the app says it is ready
+add_action('admin_footer-edit.php', function () {
+    ?>
+<script>
+document.addEventListener('click', function (e) {
+    var link = e.target.closest('a.nakama-preview');
+    if (!link) return;
+    e.preventDefault();
+
+    var target = new URL(<?php echo wp_json_encode(nakama_app_url()); ?>, window.location.href);
+    target.searchParams.set('preview', '1');
+    target.searchParams.set('building', link.dataset.building);
+    var app = window.open(target.toString(), '_blank');
+    if (!app) return;
+
+    var token = fetch(<?php echo wp_json_encode(rest_url('nakama/v1/preview-token')); ?>, {
+        method: 'POST',
+        credentials: 'same-origin',
+        headers: { 'X-WP-Nonce': <?php echo wp_json_encode(wp_create_nonce('wp_rest')); ?> }
+    }).then(function (r) { return r.json(); });
+
+    window.addEventListener('message', function onReady(msg) {
+        if (msg.source !== app || msg.origin !== target.origin || msg.data !== 'nakama_preview_ready') return;
+        window.removeEventListener('message', onReady);
+        token.then(function (body) {
+            app.postMessage({ type: 'nakama_preview_token', token: body.token }, target.origin);
+        });
+    });
+});
+</script>
+    <?php
+});
+
+// ACF "anchor" group subfields, null when none are filled in
+function nakama_building_anchor($post_id) {
+    $anchor = [];
+    foreach (['altitude', 'heading', 'scale', 'offset_east', 'offset_north', 'offset_up'] as $key) {
+        $value = get_post_meta($post_id, 'anchor_' . $key, true);
+        if ($value !== '' && $value !== false) $anchor[$key] = (string) $value;
+    }
+    return $anchor ?: null;
+}
+
+// 3D model: ACF "model" field, else the first 3D asset block in the post.
+// The push and the REST "nakama_model" field both use this, so pulls agree with pushes.
+function nakama_building_model($post) {
+    $model_url = get_post_meta($post->ID, 'model', true) ?: null;
+    if (!$model_url) {
+        foreach (parse_blocks($post->post_content) as $block) {
+            if (($block['blockName'] ?? '') === 'wp-3d-asset-editor/block' && !empty($block['attrs']['assetUrl'])) {
+                $model_url = $block['attrs']['assetUrl'];
+                break;
+            }
+        }
+    }
+    return $model_url;
+}
+
+add_action('rest_api_init', function () {
+    register_rest_field('post', 'nakama_model', [
+        'get_callback' => function ($post) { return nakama_building_model(get_post($post['id'])); },
+        'schema'       => ['type' => ['string', 'null'], 'context' => ['view', 'edit']],
+    ]);
+});
+
 // Hook into post save (create + update)
 add_action('save_post', 'nakama_notify_building_update', 10, 3);
 // Hook into delete
 add_action('before_delete_post', 'nakama_notify_building_delete');
+// Hook into restore from trash (save_post has already sent the restored status)
+add_action('untrashed_post', 'nakama_notify_building_untrash');
 
 function nakama_notify_building_update($post_id, $post, $update) {
     if (wp_is_post_revision($post_id)) {
@@ -50,28 +191,30 @@ function nakama_notify_building_update($post_id, $post, $update) {
     $building = [
         "id"     => $post_id,
         "title"  => get_the_title($post_id),
+        "slug"   => get_post_field('post_name', $post_id),
+        "link"   => get_permalink($post_id),
         "lat"    => (string) get_post_meta($post_id, 'lat', true),
         "lon"    => (string) get_post_meta($post_id, 'lon', true),
+        // Optional geofence radius in meters
+        "radius" => (string) get_post_meta($post_id, 'radius', true),
+        // Optional GeoJSON footprint (Point, Polygon or MultiPolygon) as entered in ACF
+        "geometry" => get_post_meta($post_id, 'geometry', true) ?: null,
+        // AR placement, from the ACF "anchor" group
+        "anchor" => nakama_building_anchor($post_id),
         "image"  => $image_url,
+        "model"  => nakama_building_model($post),
         "status" => get_post_status($post_id),
+        "categories" => array_map('intval', $categories),
+        // Lets Nakama drop out-of-order saves
+        "modified_gmt" => get_post_modified_time('Y-m-d\TH:i:s', true, $post_id),
+        // Lets Nakama schedule "future" posts
+        "date_gmt" => get_post_time('Y-m-d\TH:i:s', true, $post_id),
     ];
 
     error_log("[Nakama Notifier] Preparing to send building update: " . json_encode($building, JSON_UNESCAPED_SLASHES));
 
-    // Nakama RPC endpoint with http_key
-    $url = "http://nakama:7350/v2/rpc/wp_push_building?http_key=defaulthttpkey";
-
-    // Send POST request
-    $response = wp_remote_post($url, [
-        'headers' => [
-            'Content-Type' => 'application/json',
-            'Accept'       => 'application/json',
-        ],
-        'body'    => json_encode(json_encode($building, JSON_UNESCAPED_SLASHES)),
-        'method'  => 'POST',
-        'timeout' => 10,
-        'data_format' => 'body',
-    ]);
+    // Send signed POST request
+    $response = nakama_push_building($building);
 
     // Handle response
     if (is_wp_error($response)) {
@@ -93,18 +236,7 @@ function nakama_notify_building_delete($post_id) {
 
     error_log("[Nakama Notifier] Preparing delete notification: " . json_encode($payload, JSON_UNESCAPED_SLASHES));
 
-    $url = "http://nakama:7350/v2/rpc/wp_push_building?http_key=defaulthttpkey";
-
-    $response = wp_remote_post($url, [
-        'headers' => [
-            'Content-Type' => 'application/json',
-            'Accept'       => 'application/json',
-        ],
-        'body'    => json_encode(json_encode($payload, JSON_UNESCAPED_SLASHES)),
-        'method'  => 'POST',
-        'timeout' => 10,
-        'data_format' => 'body',
-    ]);
+    $response = nakama_push_building($payload);
 
     if (is_wp_error($response)) {
         error_log("[Nakama Notifier] ERROR sending delete for post $post_id: " . $response->get_error_message());
@@ -114,3 +246,26 @@ function nakama_notify_building_delete($post_id) {
         error_log("[Nakama Notifier] Delete response from Nakama for post $post_id: HTTP $code - $body");
     }
 }
+
+function nakama_notify_building_untrash($post_id) {
+    if (get_post_type($post_id) !== 'post') return;
+
+    $payload = [
+        "id"             => $post_id,
+        "status"         => "untrash",
+        "restore_status" => get_post_status($post_id),
+        "modified_gmt"   => get_post_modified_time('Y-m-d\TH:i:s', true, $post_id),
+    ];
+
+    error_log("[Nakama Notifier] Preparing untrash notification: " . json_encode($payload, JSON_UNESCAPED_SLASHES));
+
+    $response = nakama_push_building($payload);
+
+    if (is_wp_error($response)) {
+        error_log("[Nakama Notifier] ERROR sending untrash for post $post_id: " . $response->get_error_message());
+    } else {
+        $code = wp_remote_retrieve_response_code($response);
+        $body = wp_remote_retrieve_body($response);
+        error_log("[Nakama Notifier] Untrash response from Nakama for post $post_id: HTTP $code - $body");
+    }
+}